@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/alfg/ffmpegd/ffmpeg"
+	"github.com/alfg/ffmpegd/protocol"
+)
+
+// capabilities of the local ffmpeg, loaded at startup.
+var capabilities *protocol.Capabilities
+
+// checkEncode rejects a job whose command uses a codec, filter or format the
+// local ffmpeg isn't built with, or fails to build. Jobs are only checked once
+// the capabilities are loaded.
+func checkEncode(typ string, e protocol.Encode) error {
+	if capabilities == nil {
+		return nil
+	}
+
+	data := e.Payload.String()
+	var argv []string
+	var err error
+	switch typ {
+	case protocol.TypePoster, protocol.TypeThumbnails, protocol.TypeSprite, protocol.TypePreview:
+		argv, err = ffmpeg.ImageCommand(typ, e.Input, e.Output, data)
+	case protocol.TypeAudio:
+		argv, err = ffmpeg.AudioCommand(e.Input, e.Output, data)
+	case protocol.TypeConcat:
+		argv, err = ffmpeg.ConcatCommand(e.Input, e.Output, data)
+	case protocol.TypeQuality:
+		argv, err = ffmpeg.QualityCommand(e.Input, e.Output, data)
+	default:
+		argv, _, err = ffmpeg.Command(e.Input, e.Output, data, e.Collision)
+	}
+	if err != nil {
+		return err
+	}
+	return ffmpeg.CheckCapabilities(argv)
+}
+
+// handleCapabilities lists the codecs, filters, muxers, pixel formats and
+// protocols of the local ffmpeg.
+//
+//	GET /capabilities
+func handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	cors(&w, r)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	if capabilities == nil {
+		writeError(w, http.StatusServiceUnavailable, errors.New("ffmpeg capabilities are unavailable"))
+		return
+	}
+	writeJSON(w, http.StatusOK, capabilities)
+}
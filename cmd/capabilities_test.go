@@ -0,0 +1,28 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/alfg/ffmpegd/protocol"
+)
+
+func TestCheckEncode(t *testing.T) {
+	// Jobs are only checked once the capabilities are loaded.
+	e := protocol.Encode{Input: "missing.mov", Output: "out.m4a", Payload: protocol.Payload(`{}`)}
+	if err := checkEncode(protocol.TypeAudio, e); err != nil {
+		t.Error(err)
+	}
+
+	capabilities = &protocol.Capabilities{}
+	t.Cleanup(func() { capabilities = nil })
+
+	// Commands that fail to build are rejected.
+	for _, typ := range []string{protocol.TypeAudio, protocol.TypeConcat, protocol.TypePoster, protocol.TypeQuality} {
+		if err := checkEncode(typ, e); err == nil {
+			t.Errorf("%s: expected an error", typ)
+		}
+	}
+	if err := checkEncode(protocol.TypeEncode, protocol.Encode{Payload: protocol.Payload(`{`)}); err == nil {
+		t.Error("expected an error for an invalid payload")
+	}
+}
@@ -0,0 +1,214 @@
+package cmd
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/alfg/ffmpegd/protocol"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// subscribeAll subscribes a client to every job.
+	subscribeAll = "*"
+
+	writeWait      = 10 * time.Second    // Time allowed to write a frame.
+	pongWait       = 60 * time.Second    // Time allowed to read the next pong.
+	pingPeriod     = (pongWait * 9) / 10 // Send pings at this interval.
+	maxMessageSize = 1 << 20             // Maximum frame size read from a client.
+	sendBufferSize = 256                 // Frames queued before a client is evicted.
+)
+
+var (
+	clients   = make(map[*client]bool)
+	clientsMu sync.Mutex
+)
+
+// client is a connected websocket and the jobs it is watching.
+type client struct {
+	conn          *websocket.Conn
+	out           chan interface{} // Outbound frames, written by writePump.
+	subscriptions map[string]bool
+	legacy        bool // Client speaks the original ffmpeg-commander format.
+}
+
+func newClient(conn *websocket.Conn) *client {
+	return &client{
+		conn:          conn,
+		out:           make(chan interface{}, sendBufferSize),
+		subscriptions: make(map[string]bool),
+	}
+}
+
+func registerClient(c *client) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	clients[c] = true
+}
+
+func unregisterClient(c *client) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	c.drop()
+}
+
+// drop removes the client and stops its writer.
+// Must be called with clientsMu held.
+func (c *client) drop() {
+	if clients[c] {
+		delete(clients, c)
+		close(c.out)
+	}
+}
+
+// readPump reads frames from the connection and passes them to
+// handleMessages until the connection fails or stops answering pings.
+func (c *client) readPump() {
+	defer unregisterClient(c)
+
+	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
+	for {
+		fmt.Printf("\rWaiting for connection......\u001b[32mconnected!\u001b[0m")
+		_, b, err := c.conn.ReadMessage()
+		if err != nil {
+			fmt.Printf("\rWaiting for connection...\u001b[31mdisconnected!\u001b[0m")
+			return
+		}
+
+		// Decode the frame, falling back to the original ffmpeg-commander format.
+		env, legacy, err := decodeMessage(b)
+		c.setLegacy(legacy)
+		if err != nil {
+			c.replyError("", err)
+			continue
+		}
+		// Send the newly received message to the messages channel.
+		messages <- request{client: c, env: env}
+	}
+}
+
+// writePump writes queued frames and pings to the connection. It is the only
+// goroutine that writes to the connection.
+func (c *client) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case v, ok := <-c.out:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				// Client was dropped.
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.conn.WriteJSON(v); err != nil {
+				fmt.Printf("error: %v\n", err)
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// subscribe adds a job ID (or subscribeAll) to the client's watched jobs.
+func (c *client) subscribe(id string) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	c.subscriptions[id] = true
+}
+
+// unsubscribe removes a job ID (or subscribeAll) from the client's watched jobs.
+func (c *client) unsubscribe(id string) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	delete(c.subscriptions, id)
+}
+
+// setLegacy sets whether the client speaks the original ffmpeg-commander format.
+func (c *client) setLegacy(legacy bool) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	c.legacy = legacy
+}
+
+// watching reports whether the client should receive frames for a job.
+// Must be called with clientsMu held.
+func (c *client) watching(j *job) bool {
+	return c == j.owner || c.subscriptions[j.ID] || c.subscriptions[subscribeAll]
+}
+
+// write queues a frame for the client, evicting the client if it is not
+// keeping up. Must be called with clientsMu held.
+func (c *client) write(env *protocol.Envelope) {
+	var v interface{} = env
+	if c.legacy {
+		s := legacyStatus(env)
+		if s == nil {
+			return
+		}
+		v = s
+	}
+
+	select {
+	case c.out <- v:
+	default:
+		fmt.Printf("error: client send buffer full, disconnecting\n")
+		c.drop()
+	}
+}
+
+// send writes a single frame to the client.
+func (c *client) send(env *protocol.Envelope) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	if clients[c] {
+		c.write(env)
+	}
+}
+
+// reply answers a client frame.
+func (c *client) reply(id, typ string, data interface{}) {
+	env, err := protocol.Reply(id, typ, data)
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		return
+	}
+	c.send(env)
+}
+
+// replyError answers a client frame with an error.
+func (c *client) replyError(id string, err error) {
+	c.reply(id, protocol.TypeError, protocol.Error{Message: err.Error()})
+}
+
+// notify sends a job frame to the job owner and any subscribed clients.
+func notify(j *job, typ string, data interface{}) {
+	env, err := protocol.New(typ, data)
+	if err != nil {
+		fmt.Printf("error: %v\n", err)
+		return
+	}
+
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	for c := range clients {
+		if c.watching(j) {
+			c.write(env)
+		}
+	}
+}
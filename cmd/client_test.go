@@ -0,0 +1,158 @@
+package cmd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alfg/ffmpegd/protocol"
+	"github.com/gorilla/websocket"
+)
+
+var handleMessagesOnce sync.Once
+
+// newTestServer serves websocket connections for the duration of a test.
+func newTestServer(t *testing.T) *httptest.Server {
+	handleMessagesOnce.Do(func() { go handleMessages() })
+	srv := httptest.NewServer(http.HandlerFunc(handleConnections))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// dial connects to the server, returning the connection and the server's
+// client for it.
+func dial(t *testing.T, srv *httptest.Server) (*websocket.Conn, *client) {
+	clientsMu.Lock()
+	before := map[*client]bool{}
+	for c := range clients {
+		before[c] = true
+	}
+	clientsMu.Unlock()
+
+	header := http.Header{"Origin": {allowedOrigins[0]}}
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	// The client is registered before its first frame is read.
+	roundTrip(t, conn)
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	for c := range clients {
+		if !before[c] {
+			return conn, c
+		}
+	}
+	t.Fatal("client was not registered")
+	return nil, nil
+}
+
+func sendFrame(t *testing.T, conn *websocket.Conn, typ string, data interface{}) {
+	env, err := protocol.New(typ, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.ID = "1"
+	if err := conn.WriteJSON(env); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// roundTrip sends a hello and waits for its reply, so frames the client was sent
+// before it have been read, and frames it sent have been handled.
+func roundTrip(t *testing.T, conn *websocket.Conn) {
+	sendFrame(t, conn, protocol.TypeHello, nil)
+	if env := readFrame(t, conn); env.Type != protocol.TypeHello {
+		t.Fatalf("got %s, want hello", env.Type)
+	}
+}
+
+func readFrame(t *testing.T, conn *websocket.Conn) *protocol.Envelope {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, b, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := &protocol.Envelope{}
+	if err := json.Unmarshal(b, env); err != nil {
+		t.Fatal(err)
+	}
+	return env
+}
+
+func TestNotifyOwnerAndSubscribers(t *testing.T) {
+	srv := newTestServer(t)
+	owner, c := dial(t, srv)
+	other, _ := dial(t, srv)
+
+	// Job frames go to the client that submitted the job.
+	j := &job{ID: "abc", owner: c}
+	notify(j, protocol.TypeProgress, protocol.Progress{JobID: j.ID, Percent: 50})
+	env := readFrame(t, owner)
+	var p protocol.Progress
+	if env.Type != protocol.TypeProgress || env.Decode(&p) != nil || p.JobID != j.ID {
+		t.Fatalf("owner got %+v", env)
+	}
+	roundTrip(t, other)
+
+	// Other clients receive them once subscribed.
+	sendFrame(t, other, protocol.TypeSubscribe, protocol.Subscribe{JobID: j.ID})
+	roundTrip(t, other)
+	notify(j, protocol.TypeProgress, protocol.Progress{JobID: j.ID, Percent: 60})
+	for _, conn := range []*websocket.Conn{owner, other} {
+		if env := readFrame(t, conn); env.Type != protocol.TypeProgress {
+			t.Errorf("got %s, want progress", env.Type)
+		}
+	}
+
+	// And stop receiving them once unsubscribed.
+	sendFrame(t, other, protocol.TypeUnsubscribe, protocol.Subscribe{JobID: j.ID})
+	roundTrip(t, other)
+	notify(j, protocol.TypeDone, protocol.Done{JobID: j.ID})
+	if env := readFrame(t, owner); env.Type != protocol.TypeDone {
+		t.Errorf("owner got %s, want done", env.Type)
+	}
+	roundTrip(t, other)
+}
+
+func TestEvictStalledClient(t *testing.T) {
+	srv := newTestServer(t)
+	stalled, c := dial(t, srv)
+	owner, o := dial(t, srv)
+
+	// A client that stops reading is dropped once its send buffer fills,
+	// without blocking frames to other clients.
+	j := &job{ID: "abc", owner: o}
+	c.subscribe(j.ID)
+	frame := protocol.Error{JobID: j.ID, Message: strings.Repeat("x", 64<<10)}
+	deadline := time.Now().Add(10 * time.Second)
+	for registered(c) {
+		if time.Now().After(deadline) {
+			t.Fatal("stalled client was not evicted")
+		}
+		notify(j, protocol.TypeError, frame)
+		readFrame(t, owner)
+	}
+
+	// Frames and disconnects after the eviction don't write to its closed
+	// send channel.
+	notify(j, protocol.TypeDone, protocol.Done{JobID: j.ID})
+	c.reply("1", protocol.TypeHello, protocol.Hello{})
+	unregisterClient(c)
+	stalled.Close()
+	if env := readFrame(t, owner); env.Type != protocol.TypeDone {
+		t.Errorf("owner got %s, want done", env.Type)
+	}
+}
+
+func registered(c *client) bool {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	return clients[c]
+}
@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/alfg/ffmpegd/ffmpeg"
+	"github.com/alfg/ffmpegd/protocol"
+)
+
+// Job ID expanded into the {jobid} token of dry runs, which have no job.
+const dryRunJobID = "0000000000000000"
+
+// dryRun generates the ffmpeg command for an encode without running it.
+func dryRun(e protocol.Encode) (*protocol.Command, error) {
+	if err := applyPreset(&e); err != nil {
+		return nil, err
+	}
+	data := e.Payload.String()
+	args, warnings, err := ffmpeg.Command(e.Input, dryRunOutput(e, data), data, e.Collision)
+	if err != nil {
+		return nil, err
+	}
+	return &protocol.Command{
+		Args:     args,
+		Command:  ffmpeg.ShellQuote(args),
+		Warnings: warnings,
+	}, nil
+}
+
+// dryRunOutput returns the path an encode writes to, with its template
+// expanded as runJob does. Single files are written to their temporary path,
+// with their size expanded once they're encoded.
+func dryRunOutput(e protocol.Encode, data string) string {
+	vars := ffmpeg.OutputVars{Input: e.Input, Preset: e.Preset, JobID: dryRunJobID, Date: time.Now()}
+	output := ffmpeg.ExpandOutput(e.Output, vars)
+	if ffmpeg.UsesTempOutput(data) {
+		return ffmpeg.TempOutput(output)
+	}
+	if ffmpeg.HasSizeTokens(output) {
+		probe, err := ffmpeg.FFProbe{}.Run(e.Input)
+		if err == nil {
+			vars.Width, vars.Height = probe.VideoSize()
+			output = ffmpeg.ExpandOutput(output, vars)
+		}
+	}
+	return output
+}
+
+// handleCommand returns the ffmpeg command generated for an encode.
+//
+//	POST /command {"input":"in.mp4","output":"out.mp4","payload":{...}}
+func handleCommand(w http.ResponseWriter, r *http.Request) {
+	cors(&w, r)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	var e protocol.Encode
+	if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	cmd, err := dryRun(e)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, cmd)
+}
@@ -0,0 +1,44 @@
+package cmd
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alfg/ffmpegd/protocol"
+)
+
+func TestDryRunOutput(t *testing.T) {
+	date := time.Now().Format("2006-01-02")
+	tests := []struct {
+		output  string
+		payload string
+		want    string
+	}{
+		{"out/{name}-{preset}.mp4", `{"format":{"container":"mp4"}}`, filepath.Join("out", ".clip-discord-8mb.partial.mp4")},
+		{"{name}-{jobid}-{date}.mkv", `{"raw":["-c","copy"]}`, ".clip-" + dryRunJobID + "-" + date + ".partial.mkv"},
+		{"{name}-{width}p.mp4", `{"format":{"container":"mp4"}}`, ".clip-{width}p.partial.mp4"},
+		{"hls/{name}", `{"format":{"container":"hls"}}`, "hls/clip"},
+	}
+	for _, tt := range tests {
+		e := protocol.Encode{Input: "media/clip.mov", Output: tt.output, Preset: "discord-8mb", Payload: protocol.Payload(tt.payload)}
+		if got := dryRunOutput(e, tt.payload); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.output, got, tt.want)
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	cmd, err := dryRun(protocol.Encode{
+		Input:   "clip.mov",
+		Output:  "{name}-{preset}.mp4",
+		Payload: protocol.Payload(`{"format":{"container":"mp4"},"video":{"codec":"libx264"}}`),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cmd.Args[len(cmd.Args)-1]; got != ".clip-custom.partial.mp4" {
+		t.Errorf("got output %s in %s", got, strings.Join(cmd.Args, " "))
+	}
+}
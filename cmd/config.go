@@ -0,0 +1,16 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// configDir returns the directory ffmpegd stores its state in, falling back
+// to the working directory if the user config directory is unavailable.
+func configDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ".ffmpegd"
+	}
+	return filepath.Join(dir, "ffmpegd")
+}
@@ -2,8 +2,9 @@ package cmd
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"math"
+	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -12,6 +13,7 @@ import (
 	"time"
 
 	"github.com/alfg/ffmpegd/ffmpeg"
+	"github.com/alfg/ffmpegd/protocol"
 	"github.com/gorilla/websocket"
 )
 
@@ -44,37 +46,14 @@ var (
 		"https://alfg.github.io",
 		"https://alfg.dev",
 	}
-	clients   = make(map[*websocket.Conn]bool)
-	broadcast = make(chan Message)
-	upgrader  = websocket.Upgrader{
+	messages = make(chan request)
+	upgrader = websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool {
-			for _, origin := range allowedOrigins {
-				if r.Header.Get("Origin") == origin {
-					return true
-				}
-			}
-			return false
+			return allowedOrigin(r.Header.Get("Origin"))
 		},
 	}
-	progressCh chan struct{}
 )
 
-// Message payload from client.
-type Message struct {
-	Type    string `json:"type"`
-	Input   string `json:"input"`
-	Output  string `json:"output"`
-	Payload string `json:"payload"`
-}
-
-// Status response to client.
-type Status struct {
-	Percent float64 `json:"percent"`
-	Speed   string  `json:"speed"`
-	FPS     float64 `json:"fps"`
-	Err     string  `json:"err,omitempty"`
-}
-
 // FilesResponse http response for files endpoint.
 type FilesResponse struct {
 	Cwd     string   `json:"cwd"`
@@ -82,6 +61,12 @@ type FilesResponse struct {
 	Files   []file   `json:"files"`
 }
 
+// request is a frame along with the client that sent it.
+type request struct {
+	client *client
+	env    *protocol.Envelope
+}
+
 type file struct {
 	Name string `json:"name"`
 	Size int64  `json:"size"`
@@ -128,17 +113,47 @@ func parseArgs() {
 
 func printBanner() {
 	fmt.Println(logo)
-	fmt.Println(description)
+	fmt.Printf("%s\n", description)
 }
 
 func startServer() {
 	http.HandleFunc("/ws", handleConnections)
 	http.HandleFunc("/files", handleFiles)
+	http.HandleFunc("/jobs", handleJobs)
+	http.HandleFunc("/jobs/", handleJob)
+	http.HandleFunc("/command", handleCommand)
+	http.HandleFunc("/presets", handlePresets)
+	http.HandleFunc("/presets/", handlePreset)
+	http.HandleFunc("/capabilities", handleCapabilities)
+	http.HandleFunc("/watch", handleWatch)
 	http.Handle("/", http.FileServer(http.Dir("./")))
 
+	// Load job history.
+	if err := history.load(); err != nil {
+		fmt.Printf("error: failed to load job history: %v\n", err)
+	}
+
+	// Load user-defined presets.
+	if err := presets.load(); err != nil {
+		fmt.Printf("error: failed to load presets: %v\n", err)
+	}
+
 	// Handles incoming WS messages from client.
 	go handleMessages()
 
+	// Runs queued encode jobs.
+	go processJobs()
+
+	// Requeue jobs interrupted by a restart.
+	if err := recoverJobs(); err != nil {
+		fmt.Printf("error: failed to recover pending jobs: %v\n", err)
+	}
+
+	// Submit encodes for files dropped into watch folders.
+	if err := loadWatchFolders(); err != nil {
+		fmt.Printf("error: failed to load watch folders: %v\n", err)
+	}
+
 	fmt.Println("  Server started on port \u001b[33m:" + port + "\u001b[0m.")
 	fmt.Println("  - Go to \u001b[33mhttps://alfg.github.io/ffmpeg-commander\u001b[0m to connect!")
 	fmt.Println("  - \u001b[33mffmpegd\u001b[0m must be enabled in ffmpeg-commander options.")
@@ -159,21 +174,10 @@ func handleConnections(w http.ResponseWriter, r *http.Request) {
 	defer ws.Close()
 
 	// Register client.
-	clients[ws] = true
-
-	for {
-		fmt.Printf("\rWaiting for connection......\u001b[32mconnected!\u001b[0m")
-		var msg Message
-		// Read in a new message as JSON and map it to a Message object.
-		err := ws.ReadJSON(&msg)
-		if err != nil {
-			fmt.Printf("\rWaiting for connection...\u001b[31mdisconnected!\u001b[0m")
-			delete(clients, ws)
-			break
-		}
-		// Send the newly received message to the broadcast channel.
-		broadcast <- msg
-	}
+	c := newClient(ws)
+	registerClient(c)
+	go c.writePump()
+	c.readPump()
 }
 
 func handleFiles(w http.ResponseWriter, r *http.Request) {
@@ -233,16 +237,175 @@ func cors(w *http.ResponseWriter, r *http.Request) {
 	for _, origin := range allowedOrigins {
 		if r.Header.Get("Origin") == origin {
 			(*w).Header().Set("Access-Control-Allow-Origin", origin)
+			(*w).Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+			(*w).Header().Set("Access-Control-Allow-Headers", "Content-Type")
 		}
 	}
 }
 
+func allowedOrigin(origin string) bool {
+	for _, o := range allowedOrigins {
+		if origin == o {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOrigin rejects requests that change state from a page that isn't
+// allowed to, as browsers send them cross-origin without a preflight.
+// Requests without an Origin, e.g. from curl, are allowed.
+func checkOrigin(w http.ResponseWriter, r *http.Request) bool {
+	if origin := r.Header.Get("Origin"); origin != "" && !allowedOrigin(origin) {
+		writeError(w, http.StatusForbidden, errors.New("origin not allowed: "+origin))
+		return false
+	}
+	return true
+}
+
+// checkJSON rejects request bodies that aren't JSON. Unlike form and text
+// bodies, browsers preflight them cross-origin.
+func checkJSON(w http.ResponseWriter, r *http.Request) bool {
+	if t, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); t != "application/json" {
+		writeError(w, http.StatusUnsupportedMediaType, errors.New("content type must be application/json"))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, protocol.Error{Message: err.Error()})
+}
+
 func handleMessages() {
 	for {
-		msg := <-broadcast
-
-		if msg.Type == "encode" {
-			runEncode(msg.Input, msg.Output, msg.Payload)
+		req := <-messages
+		c, env := req.client, req.env
+
+		switch env.Type {
+		case protocol.TypeHello:
+			c.reply(env.ID, protocol.TypeHello, protocol.Hello{
+				Version: protocol.Version,
+				Server:  version,
+				Types: []string{
+					protocol.TypeHello,
+					protocol.TypeEncode,
+					protocol.TypeCancel,
+					protocol.TypeSubscribe,
+					protocol.TypeUnsubscribe,
+					protocol.TypeRerun,
+					protocol.TypeDryRun,
+					protocol.TypePoster,
+					protocol.TypeThumbnails,
+					protocol.TypeSprite,
+					protocol.TypePreview,
+					protocol.TypeAudio,
+					protocol.TypeConcat,
+					protocol.TypeQuality,
+					protocol.TypeCRFSearch,
+					protocol.TypePresets,
+					protocol.TypeSavePreset,
+					protocol.TypeDeletePreset,
+				},
+				Capabilities: capabilities,
+			})
+		case protocol.TypeEncode, protocol.TypePoster, protocol.TypeThumbnails, protocol.TypeSprite, protocol.TypePreview, protocol.TypeAudio, protocol.TypeConcat, protocol.TypeQuality, protocol.TypeCRFSearch:
+			var e protocol.Encode
+			if err := env.Decode(&e); err != nil {
+				c.replyError(env.ID, err)
+				continue
+			}
+			if err := applyPreset(&e); err != nil {
+				c.replyError(env.ID, err)
+				continue
+			}
+			if err := checkEncode(env.Type, e); err != nil {
+				c.replyError(env.ID, err)
+				continue
+			}
+			if err := checkOutput(env.Type, e); err != nil {
+				c.replyError(env.ID, err)
+				continue
+			}
+			j := newJob(c, env.Type, e)
+			c.reply(env.ID, protocol.TypeAccepted, protocol.Accepted{JobID: j.ID})
+			submitJob(j)
+		case protocol.TypeDryRun:
+			var e protocol.Encode
+			if err := env.Decode(&e); err != nil {
+				c.replyError(env.ID, err)
+				continue
+			}
+			cmd, err := dryRun(e)
+			if err != nil {
+				c.replyError(env.ID, err)
+				continue
+			}
+			c.reply(env.ID, protocol.TypeCommand, cmd)
+		case protocol.TypePresets:
+			c.reply(env.ID, protocol.TypePresets, &protocol.Presets{Presets: presets.list()})
+		case protocol.TypeSavePreset:
+			p := &protocol.Preset{}
+			if err := env.Decode(p); err != nil {
+				c.replyError(env.ID, err)
+				continue
+			}
+			if err := presets.save(p); err != nil {
+				c.replyError(env.ID, err)
+				continue
+			}
+			c.reply(env.ID, protocol.TypePresets, &protocol.Presets{Presets: presets.list()})
+		case protocol.TypeDeletePreset:
+			var del protocol.DeletePreset
+			if err := env.Decode(&del); err != nil {
+				c.replyError(env.ID, err)
+				continue
+			}
+			if err := presets.delete(del.Name); err != nil {
+				c.replyError(env.ID, err)
+				continue
+			}
+			c.reply(env.ID, protocol.TypePresets, &protocol.Presets{Presets: presets.list()})
+		case protocol.TypeCancel:
+			var cancel protocol.Cancel
+			if err := env.Decode(&cancel); err != nil {
+				c.replyError(env.ID, err)
+				continue
+			}
+			if err := cancelJob(cancel.JobID); err != nil {
+				c.replyError(env.ID, err)
+			}
+		case protocol.TypeRerun:
+			var rerun protocol.Rerun
+			if err := env.Decode(&rerun); err != nil {
+				c.replyError(env.ID, err)
+				continue
+			}
+			j, err := rerunJob(rerun.JobID, c)
+			if err != nil {
+				c.replyError(env.ID, err)
+				continue
+			}
+			c.reply(env.ID, protocol.TypeAccepted, protocol.Accepted{JobID: j.ID})
+		case protocol.TypeSubscribe, protocol.TypeUnsubscribe:
+			var sub protocol.Subscribe
+			if err := env.Decode(&sub); err != nil {
+				c.replyError(env.ID, err)
+				continue
+			}
+			if env.Type == protocol.TypeSubscribe {
+				c.subscribe(sub.JobID)
+			} else {
+				c.unsubscribe(sub.JobID)
+			}
+		default:
+			c.replyError(env.ID, errors.New("unknown message type: "+env.Type))
 		}
 	}
 }
@@ -260,94 +423,17 @@ func verifyFFmpeg() error {
 	if err != nil {
 		return err
 	}
-	fmt.Println("  Checking FFprobe version...\u001b[32m" + version + "\u001b[0m\n")
-	return nil
-}
+	fmt.Println("  Checking FFprobe version...\u001b[32m" + version + "\u001b[0m")
 
-func runEncode(input, output, payload string) {
-	probe := ffmpeg.FFProbe{}
-	probeData, err := probe.Run(input)
+	// Capabilities are optional, and payloads aren't checked without them.
+	c, err := ffmpeg.LoadCapabilities()
 	if err != nil {
-		sendError(err)
-		return
-	}
-
-	ffmpeg := &ffmpeg.FFmpeg{}
-	go trackEncodeProgress(probeData, ffmpeg)
-	err = ffmpeg.Run(input, output, payload)
-
-	// If we get an error back from ffmpeg, send an error ws message to clients.
-	if err != nil {
-		close(progressCh)
-		sendError(err)
-		return
-	}
-	close(progressCh)
-
-	for client := range clients {
-		p := &Status{
-			Percent: 100,
-		}
-		err := client.WriteJSON(p)
-		if err != nil {
-			fmt.Println("error: %w", err)
-			client.Close()
-			delete(clients, client)
-		}
-	}
-}
-
-func sendError(err error) {
-	for client := range clients {
-		p := &Status{
-			Err: err.Error(),
-		}
-		err := client.WriteJSON(p)
-		if err != nil {
-			fmt.Println("error: %w", err)
-			client.Close()
-			delete(clients, client)
-		}
-	}
-}
-
-func trackEncodeProgress(p *ffmpeg.FFProbeResponse, f *ffmpeg.FFmpeg) {
-	progressCh = make(chan struct{})
-	ticker := time.NewTicker(progressInterval)
-
-	for {
-		select {
-		case <-progressCh:
-			ticker.Stop()
-			fmt.Printf("\rWaiting for next job...                                                    ")
-			return
-		case <-ticker.C:
-			currentFrame := f.Progress.Frame
-			totalFrames, _ := strconv.Atoi(p.Streams[0].NbFrames)
-			speed := f.Progress.Speed
-			fps := f.Progress.FPS
-
-			// Only track progress if we know the total frames.
-			if totalFrames != 0 {
-				pct := (float64(currentFrame) / float64(totalFrames)) * 100
-				pct = math.Round(pct*100) / 100
-
-				fmt.Printf("\rEncoding... %d / %d (%0.2f%%) %s @ %0.2f fps", currentFrame, totalFrames, pct, speed, fps)
-
-				for client := range clients {
-					p := &Status{
-						Percent: pct,
-						Speed:   speed,
-						FPS:     fps,
-					}
-					err := client.WriteJSON(p)
-					if err != nil {
-						fmt.Println("error: %w", err)
-						client.Close()
-						delete(clients, client)
-					}
-				}
-			}
-		}
+		fmt.Println("  Checking capabilities......\u001b[31m" + err.Error() + "\u001b[0m")
+	} else {
+		capabilities = c
+		fmt.Printf("  Checking capabilities......\u001b[32m%d encoders, %d decoders, %d filters\u001b[0m\n",
+			len(c.Encoders), len(c.Decoders), len(c.Filters))
 	}
+	fmt.Println("")
+	return nil
 }
@@ -0,0 +1,254 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alfg/ffmpegd/protocol"
+)
+
+const (
+	historyFile     = "history.json"
+	maxHistory      = 1000
+	defaultPageSize = 20
+)
+
+var history = &historyStore{}
+
+// HistoryEntry is a completed job.
+type HistoryEntry struct {
+	ID        string             `json:"id"`
+	Type      string             `json:"type"`
+	Input     string             `json:"input"`
+	Output    string             `json:"output"`
+	Template  string             `json:"template,omitempty"` // Output as submitted, before its tokens were expanded.
+	Collision string             `json:"collision,omitempty"`
+	Preset    string             `json:"preset,omitempty"`
+	Payload   string             `json:"payload"` // Merged onto the preset, if any.
+	Command   string             `json:"command"`
+	Status    string             `json:"status"`
+	Err       string             `json:"err,omitempty"`
+	ExitCode  int                `json:"exit_code"`
+	StartTime time.Time          `json:"start_time"`
+	EndTime   time.Time          `json:"end_time"`
+	Results   []*protocol.Result `json:"results,omitempty"`
+}
+
+// HistoryResponse http response for jobs endpoint.
+type HistoryResponse struct {
+	Total  int             `json:"total"`
+	Offset int             `json:"offset"`
+	Limit  int             `json:"limit"`
+	Jobs   []*HistoryEntry `json:"jobs"`
+}
+
+func newHistoryEntry(j *job) *HistoryEntry {
+	return &HistoryEntry{
+		ID:        j.ID,
+		Type:      j.Type,
+		Input:     j.Input,
+		Output:    j.Output,
+		Template:  j.Template,
+		Collision: j.Collision,
+		Preset:    j.Preset,
+		Payload:   j.Payload,
+		Command:   j.Command,
+		Status:    j.Status,
+		Err:       j.Err,
+		ExitCode:  j.ExitCode,
+		StartTime: j.StartTime,
+		EndTime:   j.EndTime,
+		Results:   j.Results,
+	}
+}
+
+// historyStore keeps completed jobs, oldest first, persisted to the config
+// directory.
+type historyStore struct {
+	mu      sync.Mutex
+	entries []*HistoryEntry
+}
+
+// load reads persisted history from disk.
+func (h *historyStore) load() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	b, err := os.ReadFile(filepath.Join(configDir(), historyFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &h.entries)
+}
+
+// save writes history to disk. Must be called with h.mu held.
+func (h *historyStore) save() error {
+	if err := os.MkdirAll(configDir(), 0755); err != nil {
+		return err
+	}
+	b, err := json.Marshal(h.entries)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(configDir(), historyFile), b, 0644)
+}
+
+func (h *historyStore) add(e *HistoryEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.entries = append(h.entries, e)
+	if len(h.entries) > maxHistory {
+		h.entries = h.entries[len(h.entries)-maxHistory:]
+	}
+	if err := h.save(); err != nil {
+		fmt.Printf("error: %v\n", err)
+	}
+}
+
+func (h *historyStore) get(id string) *HistoryEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, e := range h.entries {
+		if e.ID == id {
+			return e
+		}
+	}
+	return nil
+}
+
+// list returns a page of entries, newest first, matching the status and a
+// substring of the input or output path. Returns the total number of matches.
+func (h *historyStore) list(status, query string, offset, limit int) ([]*HistoryEntry, int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	matches := []*HistoryEntry{}
+	for i := len(h.entries) - 1; i >= 0; i-- {
+		e := h.entries[i]
+		if status != "" && e.Status != status {
+			continue
+		}
+		if query != "" && !strings.Contains(e.Input, query) && !strings.Contains(e.Output, query) {
+			continue
+		}
+		matches = append(matches, e)
+	}
+
+	total := len(matches)
+	if offset > total {
+		offset = total
+	}
+	end := offset + limit
+	if end > total {
+		end = total
+	}
+	return matches[offset:end], total
+}
+
+// rerunJob resubmits a job from history.
+func rerunJob(id string, owner *client) (*job, error) {
+	e := history.get(id)
+	if e == nil {
+		return nil, errors.New("job not found: " + id)
+	}
+
+	typ := e.Type
+	if typ == "" {
+		typ = protocol.TypeEncode
+	}
+	// The payload was already merged onto the preset. The output template is
+	// expanded again, so a rerun doesn't reuse the original job's output.
+	output := e.Template
+	if output == "" {
+		output = e.Output
+	}
+	j := newJob(owner, typ, protocol.Encode{
+		Input:     e.Input,
+		Output:    output,
+		Collision: e.Collision,
+		Preset:    e.Preset,
+		Payload:   protocol.Payload(e.Payload),
+	})
+	submitJob(j)
+	return j, nil
+}
+
+// handleJobs lists job history.
+//
+//	GET /jobs?status=done&q=movie&offset=0&limit=20
+func handleJobs(w http.ResponseWriter, r *http.Request) {
+	cors(&w, r)
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	q := r.URL.Query()
+	offset, _ := strconv.Atoi(q.Get("offset"))
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	if offset < 0 {
+		offset = 0
+	}
+	if limit <= 0 {
+		limit = defaultPageSize
+	}
+
+	entries, total := history.list(q.Get("status"), q.Get("q"), offset, limit)
+	writeJSON(w, http.StatusOK, &HistoryResponse{
+		Total:  total,
+		Offset: offset,
+		Limit:  limit,
+		Jobs:   entries,
+	})
+}
+
+// handleJob gets or reruns a job from history.
+//
+//	GET  /jobs/{id}
+//	POST /jobs/{id}/rerun
+func handleJob(w http.ResponseWriter, r *http.Request) {
+	cors(&w, r)
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	id, action := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		id, action = path[:i], path[i+1:]
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		e := history.get(id)
+		if e == nil {
+			writeError(w, http.StatusNotFound, errors.New("job not found: "+id))
+			return
+		}
+		writeJSON(w, http.StatusOK, e)
+	case action == "rerun" && r.Method == http.MethodPost:
+		if !checkOrigin(w, r) {
+			return
+		}
+		j, err := rerunJob(id, nil)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, protocol.Accepted{JobID: j.ID})
+	default:
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
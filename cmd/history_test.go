@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alfg/ffmpegd/protocol"
+)
+
+// useTempConfig points the config directory at a temporary directory.
+func useTempConfig(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("HOME", dir)
+	t.Setenv("XDG_CONFIG_HOME", dir)
+}
+
+func TestRerunJobTemplate(t *testing.T) {
+	useTempConfig(t)
+	history = &historyStore{}
+	t.Cleanup(func() {
+		history = &historyStore{}
+		jobs = map[string]*job{}
+		for len(queue) > 0 {
+			<-queue
+		}
+	})
+
+	history.add(&HistoryEntry{ID: "a", Type: protocol.TypeEncode, Input: "in.mov", Output: "out/in-1.mp4", Template: "out/{name}.mp4", Collision: "rename", Payload: "{}"})
+	history.add(&HistoryEntry{ID: "b", Input: "in.mov", Output: "out/in.mp4", Payload: "{}"})
+
+	j, err := rerunJob("a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.Output != "out/{name}.mp4" || j.Template != "out/{name}.mp4" || j.Collision != "rename" {
+		t.Errorf("got output %s, template %s, collision %s", j.Output, j.Template, j.Collision)
+	}
+
+	// Entries from before templates rerun their output.
+	if j, err = rerunJob("b", nil); err != nil || j.Output != "out/in.mp4" || j.Type != protocol.TypeEncode {
+		t.Errorf("got %+v, %v", j, err)
+	}
+	if _, err := rerunJob("c", nil); err == nil {
+		t.Error("expected an error for a missing job")
+	}
+}
+
+func TestRerunOrigin(t *testing.T) {
+	useTempConfig(t)
+	history = &historyStore{}
+	t.Cleanup(func() {
+		history = &historyStore{}
+		jobs = map[string]*job{}
+		for len(queue) > 0 {
+			<-queue
+		}
+	})
+	history.add(&HistoryEntry{ID: "a", Type: protocol.TypeEncode, Input: "in.mov", Output: "out.mp4", Payload: "{}"})
+
+	for _, tt := range []struct {
+		origin string
+		status int
+	}{
+		{"https://evil.example", http.StatusForbidden},
+		{allowedOrigins[0], http.StatusAccepted},
+		{"", http.StatusAccepted},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/jobs/a/rerun", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		w := httptest.NewRecorder()
+		handleJob(w, r)
+		if w.Code != tt.status {
+			t.Errorf("from %q: got %d, want %d", tt.origin, w.Code, tt.status)
+		}
+	}
+	if len(queue) != 2 {
+		t.Errorf("got %d jobs queued", len(queue))
+	}
+}
+
+func TestHistoryList(t *testing.T) {
+	h := &historyStore{}
+	for i, s := range []struct{ status, input, output string }{
+		{"done", "a.mov", "a.mp4"},
+		{"error", "b.mov", "b.mp4"},
+		{"done", "movies/c.mov", "c.mp4"},
+		{"done", "d.mov", "movies/d.mp4"},
+		{"cancelled", "e.mov", "e.mp4"},
+	} {
+		h.entries = append(h.entries, &HistoryEntry{ID: string(rune('a' + i)), Status: s.status, Input: s.input, Output: s.output})
+	}
+
+	tests := []struct {
+		status, query string
+		offset, limit int
+		want          string
+		total         int
+	}{
+		{"", "", 0, 20, "edcba", 5},
+		{"done", "", 0, 20, "dca", 3},
+		{"", "movies", 0, 20, "dc", 2},
+		{"done", "movies", 1, 20, "c", 2},
+		{"", "", 1, 2, "dc", 5},
+		{"", "", 4, 2, "a", 5},
+		{"", "", 10, 2, "", 5},
+		{"error", "a.mov", 0, 20, "", 0},
+	}
+	for _, tt := range tests {
+		got, total := h.list(tt.status, tt.query, tt.offset, tt.limit)
+		ids := ""
+		for _, e := range got {
+			ids += e.ID
+		}
+		if ids != tt.want || total != tt.total {
+			t.Errorf("list(%q, %q, %d, %d): got %q of %d", tt.status, tt.query, tt.offset, tt.limit, ids, total)
+		}
+	}
+}
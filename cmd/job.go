@@ -0,0 +1,665 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alfg/ffmpegd/ffmpeg"
+	"github.com/alfg/ffmpegd/protocol"
+)
+
+var (
+	queue  = make(chan *job, 100)
+	jobs   = make(map[string]*job)
+	jobsMu sync.Mutex
+)
+
+// job is a single encode or image job submitted by a client.
+type job struct {
+	ID        string
+	Type      string
+	Input     string
+	Output    string
+	Template  string // Output as submitted, before its tokens were expanded.
+	Collision string
+	Preset    string
+	Payload   string
+
+	Status    string
+	Err       string
+	Command   string
+	ExitCode  int
+	QueueTime time.Time
+	StartTime time.Time
+	EndTime   time.Time
+	Outputs   []string
+	Results   []*protocol.Result
+
+	owner     *client
+	mu        sync.Mutex // Guards the fields below, and the persisted fields written while the job runs.
+	ffmpeg    *ffmpeg.FFmpeg
+	cancelled bool
+	resolved  bool        // Output template expanded and collision policy applied.
+	onFinish  func(error) // Called once the job has finished, e.g. by a watch folder.
+}
+
+func newJob(owner *client, typ string, e protocol.Encode) *job {
+	return &job{
+		ID:        newJobID(),
+		Type:      typ,
+		Input:     e.Input,
+		Output:    e.Output,
+		Template:  e.Output,
+		Collision: e.Collision,
+		Preset:    e.Preset,
+		Payload:   e.Payload.String(),
+		owner:     owner,
+	}
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// submitJob registers a job and adds it to the queue.
+func submitJob(j *job) {
+	j.QueueTime = time.Now()
+	jobsMu.Lock()
+	jobs[j.ID] = j
+	jobsMu.Unlock()
+	savePending()
+
+	queue <- j
+}
+
+// cancelJob cancels a queued or running job.
+func cancelJob(id string) error {
+	jobsMu.Lock()
+	j, ok := jobs[id]
+	jobsMu.Unlock()
+	if !ok {
+		return errors.New("job not found: " + id)
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.cancelled = true
+	if j.ffmpeg != nil {
+		j.ffmpeg.Cancel()
+	}
+	return nil
+}
+
+// processJobs runs queued jobs one at a time.
+func processJobs() {
+	for j := range queue {
+		j.mu.Lock()
+		j.StartTime = time.Now()
+		j.mu.Unlock()
+		savePending()
+		err := runJob(j)
+		finishJob(j, err)
+	}
+}
+
+// finishJob notifies clients of the job outcome and moves it to history.
+func finishJob(j *job, err error) {
+	j.EndTime = time.Now()
+
+	switch {
+	case err == ffmpeg.ErrCancelled:
+		j.Status = protocol.TypeCancelled
+		notify(j, protocol.TypeCancelled, protocol.Cancelled{JobID: j.ID})
+	case err != nil:
+		j.Status = protocol.TypeError
+		j.Err = err.Error()
+		sendError(j, err)
+	default:
+		j.Status = protocol.TypeDone
+		done := protocol.Done{JobID: j.ID, Results: j.Results}
+		if len(j.Results) > 0 {
+			done.Result = j.Results[0]
+		}
+		notify(j, protocol.TypeDone, done)
+	}
+
+	history.add(newHistoryEntry(j))
+
+	jobsMu.Lock()
+	delete(jobs, j.ID)
+	jobsMu.Unlock()
+	savePending()
+
+	j.mu.Lock()
+	onFinish := j.onFinish
+	j.mu.Unlock()
+	if onFinish != nil {
+		onFinish(err)
+	}
+}
+
+// runJob probes the input and runs the job by type.
+func runJob(j *job) error {
+	probe := ffmpeg.FFProbe{}
+	var probeData *ffmpeg.FFProbeResponse
+	var err error
+	if j.Type == protocol.TypeConcat {
+		probeData, err = ffmpeg.ConcatProbe(j.Input, j.Payload)
+	} else {
+		probeData, err = probe.Run(j.Input)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Expand the output template, and skip the job if the output exists and
+	// the collision policy is skip. Image and quality jobs can't set either.
+	if usesOutputTemplate(j.Type) {
+		skip, err := resolveOutput(j, probeData)
+		if err != nil || skip {
+			return err
+		}
+	}
+
+	f := &ffmpeg.FFmpeg{
+		LogWriter: &logWriter{job: j},
+		Collision: j.Collision,
+	}
+
+	// Register the process so it can be cancelled.
+	j.mu.Lock()
+	if j.cancelled {
+		j.mu.Unlock()
+		return ffmpeg.ErrCancelled
+	}
+	j.ffmpeg = f
+	j.mu.Unlock()
+
+	switch j.Type {
+	case protocol.TypePoster, protocol.TypeThumbnails, protocol.TypeSprite, protocol.TypePreview:
+		err = runImages(j, f, probeData)
+	case protocol.TypeAudio:
+		err = runAudio(j, f, probeData)
+	case protocol.TypeConcat:
+		err = runConcat(j, f, probeData)
+	case protocol.TypeQuality:
+		err = runQuality(j, f, probeData)
+	case protocol.TypeCRFSearch:
+		err = runCRFSearch(j, f, probeData)
+	default:
+		err = runEncode(j, f, probeData)
+	}
+
+	j.Command = f.String()
+	j.ExitCode = f.ExitCode()
+	return err
+}
+
+func runEncode(j *job, f *ffmpeg.FFmpeg, probeData *ffmpeg.FFProbeResponse) error {
+	// Single files are encoded to a temporary path, then renamed into place.
+	output := j.Output
+	temp := j.usesTempOutput()
+	if temp {
+		output = ffmpeg.TempOutput(j.Output)
+	}
+
+	var err error
+	j.Outputs, err = ffmpeg.Outputs(output, j.Payload)
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	go trackProgress(j, probeData, f, done)
+	err = f.Run(j.Input, output, j.Payload)
+	close(done)
+	if err != nil {
+		if temp {
+			os.Remove(output)
+		}
+		return err
+	}
+	if temp {
+		skip, err := commitOutput(j, output)
+		if err != nil || skip {
+			return err
+		}
+	}
+
+	// Probe the outputs for the job results.
+	probe := ffmpeg.FFProbe{}
+	for _, output := range j.Outputs {
+		outputData, err := probe.Run(output)
+		if err != nil {
+			return err
+		}
+		j.Results = append(j.Results, newResult(output, probeData, outputData))
+	}
+
+	// Measure the outputs against the input if quality options are set.
+	for i, output := range j.Outputs {
+		done := make(chan struct{})
+		go trackProgress(j, probeData, f, done)
+		q, err := f.RunEncodeQuality(j.Input, output, j.Payload, probeData)
+		close(done)
+		if err != nil {
+			return err
+		}
+		if q == nil {
+			break
+		}
+		j.Results[i].Quality = newQuality(q)
+	}
+
+	// List the playlists and segments of packaged outputs.
+	files, err := ffmpeg.OutputFiles(j.Output, j.Payload)
+	if err != nil {
+		return err
+	}
+	if len(files) > 0 {
+		j.Results[0].Files = files
+	}
+	return nil
+}
+
+// usesOutputTemplate reports whether a job type expands output templates and
+// applies the collision policy. Image jobs write several files named after
+// the output, and quality jobs read it.
+func usesOutputTemplate(typ string) bool {
+	switch typ {
+	case protocol.TypeEncode, protocol.TypeCRFSearch, protocol.TypeAudio, protocol.TypeConcat:
+		return true
+	}
+	return false
+}
+
+// checkOutput rejects an unknown collision policy, and a collision policy or
+// output template on job types that don't use them.
+func checkOutput(typ string, e protocol.Encode) error {
+	if err := ffmpeg.CheckCollision(e.Collision); err != nil {
+		return err
+	}
+	if usesOutputTemplate(typ) {
+		return nil
+	}
+	if e.Collision != "" && e.Collision != ffmpeg.CollisionOverwrite {
+		return errors.New(typ + " jobs can't use the " + e.Collision + " collision policy")
+	}
+	if ffmpeg.HasTokens(e.Output) {
+		return errors.New(typ + " jobs can't use output template tokens")
+	}
+	return nil
+}
+
+// resolveOutput expands the tokens in the job output and applies the
+// collision policy. Single files are encoded before their size is known, so
+// {width} and {height} are expanded when they're committed. Reports whether
+// the job is skipped. Jobs recovered after a restart keep the output they
+// resolved, and resume any partial output there.
+func resolveOutput(j *job, probeData *ffmpeg.FFProbeResponse) (bool, error) {
+	if j.resolved {
+		return false, nil
+	}
+	vars := ffmpeg.OutputVars{Input: j.Input, Preset: j.Preset, JobID: j.ID, Date: j.StartTime}
+	if !j.usesTempOutput() {
+		vars.Width, vars.Height = probeData.VideoSize()
+	}
+	output := ffmpeg.ExpandOutput(j.Output, vars)
+	if !ffmpeg.HasSizeTokens(output) {
+		resolved, err := ffmpeg.ResolveOutput(j.Input, output, j.Payload, j.Collision)
+		if err != nil {
+			j.setOutput(resolved)
+			return outputExists(j, err)
+		}
+		output = resolved
+	}
+	j.mu.Lock()
+	j.Output = output
+	j.resolved = true
+	j.mu.Unlock()
+
+	// Record the resolved output, so a restart resumes the same one.
+	savePending()
+	return false, nil
+}
+
+// commitOutput renames an encoded temporary file to the job output. Reports
+// whether the job is skipped.
+func commitOutput(j *job, temp string) (bool, error) {
+	if ffmpeg.HasSizeTokens(j.Output) {
+		data, err := ffmpeg.FFProbe{}.Run(temp)
+		if err != nil {
+			os.Remove(temp)
+			return false, err
+		}
+		vars := ffmpeg.OutputVars{Input: j.Input, Preset: j.Preset, JobID: j.ID, Date: j.StartTime}
+		vars.Width, vars.Height = data.VideoSize()
+		j.setOutput(ffmpeg.ExpandOutput(j.Output, vars))
+	}
+
+	output, err := ffmpeg.CommitOutput(temp, j.Output, j.Collision)
+	if err != nil {
+		return outputExists(j, err)
+	}
+	j.setOutput(output)
+	j.Outputs = []string{output}
+	return false, nil
+}
+
+// usesTempOutput reports whether the job writes a single file, which is
+// encoded to a temporary path and renamed into place.
+func (j *job) usesTempOutput() bool {
+	switch j.Type {
+	case protocol.TypeAudio, protocol.TypeConcat:
+		return true
+	}
+	return ffmpeg.UsesTempOutput(j.Payload)
+}
+
+// setOutput sets the job output while savePending may be reading it.
+func (j *job) setOutput(output string) {
+	j.mu.Lock()
+	j.Output = output
+	j.mu.Unlock()
+}
+
+// outputExists skips the job if the collision policy is skip, and otherwise
+// fails it.
+func outputExists(j *job, err error) (bool, error) {
+	if err != ffmpeg.ErrOutputExists {
+		return false, err
+	}
+	if j.Collision == ffmpeg.CollisionSkip {
+		j.Results = []*protocol.Result{{Output: j.Output, Skipped: true}}
+		return true, nil
+	}
+	return false, errors.New("output exists: " + j.Output)
+}
+
+// runImages runs a poster, thumbnails, sprite or preview job.
+func runImages(j *job, f *ffmpeg.FFmpeg, probeData *ffmpeg.FFProbeResponse) error {
+	done := make(chan struct{})
+	go trackProgress(j, probeData, f, done)
+	err := f.RunImages(j.Type, j.Input, j.Output, j.Payload, probeData)
+	close(done)
+	if err != nil {
+		return err
+	}
+
+	files, err := ffmpeg.ImageFiles(j.Type, j.Output)
+	if err != nil {
+		return err
+	}
+
+	r := &protocol.Result{
+		Output: j.Output,
+		Codecs: []string{},
+		Files:  files,
+	}
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			r.Size += info.Size()
+		}
+	}
+	j.Results = []*protocol.Result{r}
+	return nil
+}
+
+// runAudio runs an audio extraction or transcode job.
+func runAudio(j *job, f *ffmpeg.FFmpeg, probeData *ffmpeg.FFProbeResponse) error {
+	done := make(chan struct{})
+	go trackProgress(j, probeData, f, done)
+	temp := ffmpeg.TempOutput(j.Output)
+	err := f.RunAudio(j.Input, temp, j.Payload, probeData)
+	close(done)
+	if err != nil {
+		os.Remove(temp)
+		return err
+	}
+	skip, err := commitOutput(j, temp)
+	if err != nil || skip {
+		return err
+	}
+
+	probe := ffmpeg.FFProbe{}
+	outputData, err := probe.Run(j.Output)
+	if err != nil {
+		return err
+	}
+	j.Results = []*protocol.Result{newResult(j.Output, probeData, outputData)}
+	return nil
+}
+
+// runConcat runs a concat job.
+func runConcat(j *job, f *ffmpeg.FFmpeg, probeData *ffmpeg.FFProbeResponse) error {
+	done := make(chan struct{})
+	go trackProgress(j, probeData, f, done)
+	temp := ffmpeg.TempOutput(j.Output)
+	err := f.RunConcat(j.Input, temp, j.Payload)
+	close(done)
+	if err != nil {
+		os.Remove(temp)
+		return err
+	}
+	skip, err := commitOutput(j, temp)
+	if err != nil || skip {
+		return err
+	}
+
+	probe := ffmpeg.FFProbe{}
+	outputData, err := probe.Run(j.Output)
+	if err != nil {
+		return err
+	}
+	j.Results = []*protocol.Result{newResult(j.Output, probeData, outputData)}
+	return nil
+}
+
+// runQuality runs a quality job, measuring the output against the input.
+func runQuality(j *job, f *ffmpeg.FFmpeg, probeData *ffmpeg.FFProbeResponse) error {
+	done := make(chan struct{})
+	go trackProgress(j, probeData, f, done)
+	q, err := f.RunQuality(j.Input, j.Output, j.Payload, probeData)
+	close(done)
+	if err != nil {
+		return err
+	}
+
+	probe := ffmpeg.FFProbe{}
+	outputData, err := probe.Run(j.Output)
+	if err != nil {
+		return err
+	}
+	r := newResult(j.Output, probeData, outputData)
+	r.Quality = newQuality(q)
+	j.Results = []*protocol.Result{r}
+	return nil
+}
+
+// runCRFSearch searches for the CRF meeting the quality target, then encodes
+// the input with it.
+func runCRFSearch(j *job, f *ffmpeg.FFmpeg, probeData *ffmpeg.FFProbeResponse) error {
+	search, err := f.SearchCRF(j.Input, j.Output, j.Payload, probeData, func(p ffmpeg.CRFProbe) {
+		notify(j, protocol.TypeProgress, protocol.Progress{
+			JobID:   j.ID,
+			Percent: math.Round(float64(p.Step)/float64(p.Steps)*10000) / 100,
+			Probe:   newCRFProbe(p),
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	// Encode with the chosen CRF, recording it in the payload.
+	crf := fmt.Sprintf(`{"video":{"pass":"crf","crf":%d}}`, search.CRF)
+	payload, err := protocol.Payload(j.Payload).Merge(protocol.Payload(crf))
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	j.Payload = payload.String()
+	j.mu.Unlock()
+	if err := runEncode(j, f, probeData); err != nil {
+		return err
+	}
+
+	r := &protocol.CRFSearch{
+		CRF:    search.CRF,
+		Target: search.Target,
+		VMAF:   search.VMAF,
+		Met:    search.Met,
+		Probes: []protocol.CRFProbe{},
+	}
+	for _, p := range search.Probes {
+		r.Probes = append(r.Probes, *newCRFProbe(p))
+	}
+	j.Results[0].CRFSearch = r
+	return nil
+}
+
+func newCRFProbe(p ffmpeg.CRFProbe) *protocol.CRFProbe {
+	return &protocol.CRFProbe{CRF: p.CRF, VMAF: p.VMAF, Bitrate: p.Bitrate, Size: p.Size}
+}
+
+// newResult builds the job result from the input and output probes.
+func newResult(output string, in, out *ffmpeg.FFProbeResponse) *protocol.Result {
+	r := &protocol.Result{
+		Output: output,
+		Codecs: []string{},
+	}
+	r.Size, _ = strconv.ParseInt(out.Format.Size, 10, 64)
+	r.Duration, _ = strconv.ParseFloat(out.Format.Duration, 64)
+	r.Bitrate, _ = strconv.ParseInt(out.Format.BitRate, 10, 64)
+	for _, s := range out.Streams {
+		r.Codecs = append(r.Codecs, s.CodecName)
+	}
+
+	inSize, _ := strconv.ParseInt(in.Format.Size, 10, 64)
+	if r.Size > 0 {
+		r.CompressionRatio = math.Round(float64(inSize)/float64(r.Size)*100) / 100
+	}
+	return r
+}
+
+// newQuality converts quality scores into the protocol result.
+func newQuality(q *ffmpeg.Quality) *protocol.Quality {
+	r := &protocol.Quality{
+		VMAF:     newScore(q.VMAF),
+		SSIM:     newScore(q.SSIM),
+		PSNR:     newScore(q.PSNR),
+		Warnings: q.Warnings,
+	}
+	for _, f := range q.Frames {
+		r.Frames = append(r.Frames, protocol.FrameQuality{Frame: f.Frame, VMAF: f.VMAF, SSIM: f.SSIM, PSNR: f.PSNR})
+	}
+	return r
+}
+
+func newScore(s *ffmpeg.Score) *protocol.Score {
+	if s == nil {
+		return nil
+	}
+	return &protocol.Score{Mean: s.Mean, Min: s.Min, Max: s.Max}
+}
+
+func sendError(j *job, err error) {
+	notify(j, protocol.TypeError, protocol.Error{
+		JobID:   j.ID,
+		Message: err.Error(),
+	})
+}
+
+func trackProgress(j *job, p *ffmpeg.FFProbeResponse, f *ffmpeg.FFmpeg, done chan struct{}) {
+	ticker := time.NewTicker(progressInterval)
+
+	for {
+		select {
+		case <-done:
+			ticker.Stop()
+			fmt.Printf("\rWaiting for next job...                                                    ")
+			return
+		case <-ticker.C:
+			progress := f.CurrentProgress()
+			currentFrame := progress.Frame
+			totalFrames, _ := strconv.Atoi(p.Streams[0].NbFrames)
+			speed := progress.Speed
+			fps := progress.FPS
+
+			// Image, audio and concat jobs don't output the input frames,
+			// so track the output time against the input duration instead.
+			var pct float64
+			if j.Type != protocol.TypeEncode {
+				if p.Duration() == 0 {
+					continue
+				}
+				pct = math.Min(float64(progress.OutTimeMS)/1e6/p.Duration()*100, 100)
+			} else if totalFrames != 0 {
+				pct = (float64(currentFrame) / float64(totalFrames)) * 100
+			}
+
+			// Only track progress if we know the total frames or duration.
+			if pct != 0 {
+				pct = math.Round(pct*100) / 100
+
+				fmt.Printf("\rEncoding... %d / %d (%0.2f%%) %s @ %0.2f fps", currentFrame, totalFrames, pct, speed, fps)
+
+				notify(j, protocol.TypeProgress, protocol.Progress{
+					JobID:   j.ID,
+					Percent: pct,
+					Frame:   currentFrame,
+					Speed:   speed,
+					FPS:     fps,
+					Outputs: outputProgress(j.Outputs),
+				})
+			}
+		}
+	}
+}
+
+// outputProgress returns the bytes written to each output of a multi-output job.
+func outputProgress(outputs []string) []protocol.OutputProgress {
+	if len(outputs) < 2 {
+		return nil
+	}
+
+	progress := []protocol.OutputProgress{}
+	for _, output := range outputs {
+		p := protocol.OutputProgress{Output: output}
+		if info, err := os.Stat(output); err == nil {
+			p.Size = info.Size()
+		}
+		progress = append(progress, p)
+	}
+	return progress
+}
+
+// logWriter sends each line of ffmpeg output to the job's clients.
+type logWriter struct {
+	job *job
+	buf []byte
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexAny(w.buf, "\r\n")
+		if i < 0 {
+			return len(p), nil
+		}
+		line := string(w.buf[:i])
+		w.buf = w.buf[i+1:]
+		if line != "" {
+			notify(w.job, protocol.TypeLog, protocol.Log{JobID: w.job.ID, Line: line})
+		}
+	}
+}
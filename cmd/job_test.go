@@ -0,0 +1,166 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alfg/ffmpegd/ffmpeg"
+	"github.com/alfg/ffmpegd/protocol"
+)
+
+func TestResolveOutput(t *testing.T) {
+	useTempConfig(t)
+	resetJobs(t)
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "clip.mp4"), []byte{0}, 0644)
+	probe := &ffmpeg.FFProbeResponse{}
+	json.Unmarshal([]byte(`{"streams":[{"codec_type":"video","width":1280,"height":720}]}`), probe)
+	start := time.Date(2024, 3, 9, 12, 0, 0, 0, time.UTC)
+	mp4 := `{"format":{"container":"mp4"}}`
+	hls := `{"format":{"container":"hls"}}`
+
+	tests := []struct {
+		output    string
+		payload   string
+		collision string
+		want      string
+		skipped   bool
+		err       bool
+	}{
+		{"{name}.mp4", mp4, "", "clip.mp4", false, false},
+		{"{name}.mp4", mp4, ffmpeg.CollisionRename, "clip-1.mp4", false, false},
+		{"{name}.mp4", mp4, ffmpeg.CollisionSkip, "clip.mp4", true, false},
+		{"{name}.mp4", mp4, ffmpeg.CollisionFail, "clip.mp4", false, true},
+		{"{name}-{date}-{jobid}.mp4", mp4, ffmpeg.CollisionFail, "clip-2024-03-09-abc.mp4", false, false},
+
+		// Single files expand their size once encoded, and packaged outputs
+		// from the input.
+		{"{name}-{height}p.mp4", mp4, ffmpeg.CollisionFail, "clip-{height}p.mp4", false, false},
+		{"{name}-{height}p", hls, ffmpeg.CollisionFail, "clip-720p", false, false},
+	}
+	for _, tt := range tests {
+		j := newJob(nil, protocol.TypeEncode, protocol.Encode{
+			Input:     "media/clip.mov",
+			Output:    filepath.Join(dir, tt.output),
+			Collision: tt.collision,
+			Payload:   protocol.Payload(tt.payload),
+		})
+		j.ID, j.StartTime = "abc", start
+		skipped, err := resolveOutput(j, probe)
+		if skipped != tt.skipped || (err != nil) != tt.err || j.Output != filepath.Join(dir, tt.want) {
+			t.Errorf("%s %s: got %s, %v, %v", tt.output, tt.collision, j.Output, skipped, err)
+		}
+		if tt.skipped && (len(j.Results) != 1 || !j.Results[0].Skipped) {
+			t.Errorf("%s: got results %v", tt.output, j.Results)
+		}
+	}
+
+	// Audio and concat jobs write single files, and multiple outputs are each
+	// checked.
+	os.WriteFile(filepath.Join(dir, "clip.m4a"), []byte{0}, 0644)
+	multi := fmt.Sprintf(`{"outputs":[{"output":%q},{"output":%q}]}`, filepath.Join(dir, "a.mp4"), filepath.Join(dir, "clip.mp4"))
+	for _, tt := range []struct {
+		typ       string
+		output    string
+		payload   string
+		collision string
+		want      string
+		skipped   bool
+		err       bool
+	}{
+		{protocol.TypeAudio, "{name}.m4a", "{}", ffmpeg.CollisionSkip, "clip.m4a", true, false},
+		{protocol.TypeAudio, "{name}.m4a", "{}", ffmpeg.CollisionRename, "clip-1.m4a", false, false},
+		{protocol.TypeConcat, "{name}-{height}p.mp4", "{}", ffmpeg.CollisionFail, "clip-{height}p.mp4", false, false},
+		{protocol.TypeEncode, "ignored", multi, ffmpeg.CollisionOverwrite, "ignored", false, false},
+		{protocol.TypeEncode, "ignored", multi, ffmpeg.CollisionFail, "clip.mp4", false, true},
+		{protocol.TypeEncode, "ignored", multi, ffmpeg.CollisionRename, "ignored", false, true},
+	} {
+		j := newJob(nil, tt.typ, protocol.Encode{
+			Input:     "media/clip.mov",
+			Output:    filepath.Join(dir, tt.output),
+			Collision: tt.collision,
+			Payload:   protocol.Payload(tt.payload),
+		})
+		skipped, err := resolveOutput(j, probe)
+		if skipped != tt.skipped || (err != nil) != tt.err || j.Output != filepath.Join(dir, tt.want) {
+			t.Errorf("%s %s %s: got %s, %v, %v", tt.typ, tt.output, tt.collision, j.Output, skipped, err)
+		}
+	}
+
+	// Recovered jobs keep the output they resolved.
+	j := newJob(nil, protocol.TypeEncode, protocol.Encode{
+		Input:     "media/clip.mov",
+		Output:    filepath.Join(dir, "clip.mp4"),
+		Collision: ffmpeg.CollisionFail,
+		Payload:   protocol.Payload(mp4),
+	})
+	j.resolved = true
+	if skipped, err := resolveOutput(j, probe); skipped || err != nil || j.Output != filepath.Join(dir, "clip.mp4") {
+		t.Errorf("got %s, %v, %v", j.Output, skipped, err)
+	}
+}
+
+func TestCheckOutput(t *testing.T) {
+	tests := []struct {
+		typ string
+		e   protocol.Encode
+		err bool
+	}{
+		{protocol.TypeEncode, protocol.Encode{Output: "{name}.mp4", Collision: ffmpeg.CollisionSkip}, false},
+		{protocol.TypeEncode, protocol.Encode{Output: "out.mp4", Collision: "keep"}, true},
+		{protocol.TypeAudio, protocol.Encode{Output: "{name}.m4a", Collision: ffmpeg.CollisionRename}, false},
+		{protocol.TypeConcat, protocol.Encode{Output: "{date}.mp4", Collision: ffmpeg.CollisionFail}, false},
+		{protocol.TypePoster, protocol.Encode{Output: "poster.jpg", Collision: ffmpeg.CollisionOverwrite}, false},
+		{protocol.TypePoster, protocol.Encode{Output: "poster.jpg", Collision: ffmpeg.CollisionSkip}, true},
+		{protocol.TypeThumbnails, protocol.Encode{Output: "{name}/thumb.jpg"}, true},
+		{protocol.TypeQuality, protocol.Encode{Output: "out.mp4", Collision: ffmpeg.CollisionFail}, true},
+	}
+	for _, tt := range tests {
+		if err := checkOutput(tt.typ, tt.e); (err != nil) != tt.err {
+			t.Errorf("%s %+v: got %v", tt.typ, tt.e, err)
+		}
+	}
+}
+
+func TestCommitOutput(t *testing.T) {
+	dir := t.TempDir()
+	output := filepath.Join(dir, "clip.mp4")
+	os.WriteFile(output, []byte("old"), 0644)
+
+	tests := []struct {
+		collision string
+		want      string
+		skipped   bool
+		err       bool
+	}{
+		{ffmpeg.CollisionRename, "clip-1.mp4", false, false},
+		{ffmpeg.CollisionSkip, "clip.mp4", true, false},
+		{ffmpeg.CollisionFail, "clip.mp4", false, true},
+		{ffmpeg.CollisionOverwrite, "clip.mp4", false, false},
+	}
+	for _, tt := range tests {
+		j := &job{Input: "clip.mov", Output: output, Collision: tt.collision}
+		temp := ffmpeg.TempOutput(output)
+		os.WriteFile(temp, []byte(tt.collision), 0644)
+
+		skipped, err := commitOutput(j, temp)
+		want := filepath.Join(dir, tt.want)
+		if skipped != tt.skipped || (err != nil) != tt.err || j.Output != want {
+			t.Errorf("%s: got %s, %v, %v", tt.collision, j.Output, skipped, err)
+		}
+		if _, err := os.Stat(temp); !os.IsNotExist(err) {
+			t.Errorf("%s: temporary output was left", tt.collision)
+		}
+		if tt.skipped || tt.err {
+			continue
+		}
+		if b, _ := os.ReadFile(want); string(b) != tt.collision || len(j.Outputs) != 1 || j.Outputs[0] != want {
+			t.Errorf("%s: got %q, outputs %v", tt.collision, b, j.Outputs)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"encoding/json"
+
+	"github.com/alfg/ffmpegd/protocol"
+)
+
+// Message payload from client.
+//
+// Deprecated: Message is the original ffmpeg-commander format, kept for
+// compatibility. New clients should use protocol.Envelope.
+type Message struct {
+	Type    string `json:"type"`
+	ID      string `json:"id,omitempty"` // Job ID for subscribe/unsubscribe/cancel, or "*" for all jobs.
+	Input   string `json:"input"`
+	Output  string `json:"output"`
+	Payload string `json:"payload"`
+}
+
+// Status response to client.
+//
+// Deprecated: Status is the original ffmpeg-commander format, kept for
+// compatibility. New clients should use protocol.Envelope.
+type Status struct {
+	Type    string  `json:"type"`
+	JobID   string  `json:"id,omitempty"`
+	Percent float64 `json:"percent"`
+	Speed   string  `json:"speed"`
+	FPS     float64 `json:"fps"`
+	Err     string  `json:"err,omitempty"`
+}
+
+// legacyData holds the union of protocol data fields used by Status.
+type legacyData struct {
+	JobID   string  `json:"job_id"`
+	Percent float64 `json:"percent"`
+	Speed   string  `json:"speed"`
+	FPS     float64 `json:"fps"`
+	Message string  `json:"message"`
+}
+
+// decodeMessage decodes a frame from a client, converting the original
+// ffmpeg-commander format into an envelope. Reports whether the frame was in
+// the original format.
+func decodeMessage(b []byte) (*protocol.Envelope, bool, error) {
+	env := &protocol.Envelope{}
+	if err := json.Unmarshal(b, env); err != nil {
+		return nil, false, err
+	}
+	if env.V != 0 {
+		return env, false, nil
+	}
+
+	var msg Message
+	if err := json.Unmarshal(b, &msg); err != nil {
+		return nil, true, err
+	}
+
+	var data interface{}
+	switch msg.Type {
+	case protocol.TypeEncode, protocol.TypePoster, protocol.TypeThumbnails, protocol.TypeSprite, protocol.TypePreview, protocol.TypeAudio, protocol.TypeConcat, protocol.TypeQuality, protocol.TypeCRFSearch:
+		data = protocol.Encode{
+			Input:   msg.Input,
+			Output:  msg.Output,
+			Payload: protocol.Payload(msg.Payload),
+		}
+	case protocol.TypeSubscribe, protocol.TypeUnsubscribe:
+		data = protocol.Subscribe{JobID: msg.ID}
+	case protocol.TypeCancel:
+		data = protocol.Cancel{JobID: msg.ID}
+	}
+
+	env, err := protocol.New(msg.Type, data)
+	if err != nil {
+		return nil, true, err
+	}
+	env.V = 0
+	return env, true, nil
+}
+
+// legacyStatus converts an envelope into the original Status format. Returns
+// nil for frames that have no equivalent.
+func legacyStatus(env *protocol.Envelope) *Status {
+	var d legacyData
+	if err := env.Decode(&d); err != nil {
+		return nil
+	}
+
+	s := &Status{
+		Type:  env.Type,
+		JobID: d.JobID,
+	}
+
+	switch env.Type {
+	case protocol.TypeAccepted:
+	case protocol.TypeProgress:
+		s.Percent = d.Percent
+		s.Speed = d.Speed
+		s.FPS = d.FPS
+	case protocol.TypeDone:
+		s.Percent = 100
+	case protocol.TypeError:
+		s.Err = d.Message
+	case protocol.TypeCancelled:
+		s.Err = "cancelled"
+	default:
+		return nil
+	}
+	return s
+}
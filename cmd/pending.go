@@ -0,0 +1,153 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alfg/ffmpegd/ffmpeg"
+	"github.com/alfg/ffmpegd/protocol"
+)
+
+const pendingFile = "pending.json"
+
+// pendingMu serializes writes to the pending jobs file.
+var pendingMu sync.Mutex
+
+// pendingJob is a queued or running job, persisted so it runs again if
+// ffmpegd stops before it finishes.
+type pendingJob struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	Input     string `json:"input"`
+	Output    string `json:"output"`
+	Template  string `json:"template,omitempty"`
+	Collision string `json:"collision,omitempty"`
+	Preset    string `json:"preset,omitempty"`
+	Payload   string `json:"payload"`
+	Started   bool   `json:"started"`            // The job was running, and may have left partial outputs.
+	Resolved  bool   `json:"resolved,omitempty"` // The output template was expanded and the collision policy applied.
+}
+
+// savePending writes the queued and running jobs to disk, in queue order.
+func savePending() {
+	pendingMu.Lock()
+	defer pendingMu.Unlock()
+
+	jobsMu.Lock()
+	pending := []*job{}
+	for _, j := range jobs {
+		pending = append(pending, j)
+	}
+	jobsMu.Unlock()
+	sort.Slice(pending, func(a, b int) bool {
+		return pending[a].QueueTime.Before(pending[b].QueueTime)
+	})
+
+	entries := []pendingJob{}
+	for _, j := range pending {
+		entries = append(entries, j.pending())
+	}
+
+	if err := writePending(entries); err != nil {
+		fmt.Printf("error: failed to save pending jobs: %v\n", err)
+	}
+}
+
+// pending returns a snapshot of the job to persist, as it may be running.
+func (j *job) pending() pendingJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return pendingJob{
+		ID:        j.ID,
+		Type:      j.Type,
+		Input:     j.Input,
+		Output:    j.Output,
+		Template:  j.Template,
+		Collision: j.Collision,
+		Preset:    j.Preset,
+		Payload:   j.Payload,
+		Started:   !j.StartTime.IsZero(),
+		Resolved:  j.resolved,
+	}
+}
+
+func writePending(entries []pendingJob) error {
+	if err := os.MkdirAll(configDir(), 0755); err != nil {
+		return err
+	}
+	b, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(configDir(), pendingFile), b, 0644)
+}
+
+// recoverJobs requeues the jobs that were pending when ffmpegd stopped, with
+// their original IDs. Jobs that were running have their partial outputs
+// removed, except for encoded chunks and HLS segments they resume from.
+func recoverJobs() error {
+	b, err := os.ReadFile(filepath.Join(configDir(), pendingFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	entries := []pendingJob{}
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	fmt.Printf("  Resuming %d interrupted jobs.\n", len(entries))
+	recovered := []*job{}
+	for _, e := range entries {
+		if e.Started && usesOutputTemplate(e.Type) {
+			removed, err := ffmpeg.CleanPartial(e.Output, e.Payload)
+			if err != nil {
+				fmt.Printf("error: failed to clean up job %s: %v\n", e.ID, err)
+			}
+			for _, path := range removed {
+				fmt.Printf("  - Removed partial output %s\n", path)
+			}
+		}
+
+		j := newJob(nil, e.Type, protocol.Encode{
+			Input:     e.Input,
+			Output:    e.Output,
+			Collision: e.Collision,
+			Preset:    e.Preset,
+			Payload:   protocol.Payload(e.Payload),
+		})
+		j.ID = e.ID
+		j.QueueTime = time.Now()
+		j.resolved = e.Resolved
+		if e.Template != "" {
+			j.Template = e.Template
+		}
+		recovered = append(recovered, j)
+	}
+
+	// Register every job before the pending file is rewritten, then queue
+	// them without blocking startup.
+	jobsMu.Lock()
+	for _, j := range recovered {
+		jobs[j.ID] = j
+	}
+	jobsMu.Unlock()
+	savePending()
+
+	go func() {
+		for _, j := range recovered {
+			queue <- j
+		}
+	}()
+	return nil
+}
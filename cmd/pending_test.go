@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alfg/ffmpegd/ffmpeg"
+	"github.com/alfg/ffmpegd/protocol"
+)
+
+// resetJobs clears the jobs and queue when a test finishes.
+func resetJobs(t *testing.T) {
+	t.Cleanup(func() {
+		jobsMu.Lock()
+		jobs = map[string]*job{}
+		jobsMu.Unlock()
+		for len(queue) > 0 {
+			<-queue
+		}
+	})
+}
+
+func TestRecoverJobs(t *testing.T) {
+	useTempConfig(t)
+	resetJobs(t)
+
+	dir := t.TempDir()
+	output := filepath.Join(dir, "clip-1.mp4")
+	temp := ffmpeg.TempOutput(output)
+	os.WriteFile(output, []byte{0}, 0644)
+	os.WriteFile(temp, []byte{0}, 0644)
+
+	payload := `{"format":{"container":"mp4"}}`
+	writePending([]pendingJob{
+		{ID: "a", Type: protocol.TypeEncode, Input: "clip.mov", Output: output, Template: filepath.Join(dir, "{name}.mp4"),
+			Collision: ffmpeg.CollisionRename, Payload: payload, Started: true, Resolved: true},
+		{ID: "b", Type: protocol.TypeEncode, Input: "other.mov", Output: filepath.Join(dir, "{name}.mp4"), Payload: payload},
+	})
+	if err := recoverJobs(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The partial output of the running job is removed, and the existing
+	// output kept.
+	if _, err := os.Stat(temp); !os.IsNotExist(err) {
+		t.Error("partial output was not removed")
+	}
+	if _, err := os.Stat(output); err != nil {
+		t.Error("existing output was removed")
+	}
+
+	// Jobs are queued in order with their IDs, resolved outputs and templates.
+	for _, want := range []string{"a", "b"} {
+		select {
+		case j := <-queue:
+			if j.ID != want {
+				t.Fatalf("got job %s, want %s", j.ID, want)
+			}
+			if want == "a" && (!j.resolved || j.Output != output || j.Template != filepath.Join(dir, "{name}.mp4")) {
+				t.Errorf("got %+v", j)
+			}
+			if want == "b" && (j.resolved || j.Template != j.Output) {
+				t.Errorf("got %+v", j)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("job %s was not queued", want)
+		}
+	}
+	jobsMu.Lock()
+	n := len(jobs)
+	jobsMu.Unlock()
+	if n != 2 {
+		t.Errorf("got %d jobs registered", n)
+	}
+}
+
+func TestSavePendingWhileResolving(t *testing.T) {
+	useTempConfig(t)
+	resetJobs(t)
+
+	// Run with -race: jobs are saved while another job resolves its output.
+	dir := t.TempDir()
+	e := protocol.Encode{
+		Input:   "clip.mov",
+		Output:  filepath.Join(dir, "{name}-{jobid}.mp4"),
+		Payload: protocol.Payload(`{"format":{"container":"mp4"}}`),
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			j := newJob(nil, protocol.TypeEncode, e)
+			jobsMu.Lock()
+			jobs[j.ID] = j
+			jobsMu.Unlock()
+			if _, err := resolveOutput(j, &ffmpeg.FFProbeResponse{}); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		submitJob(newJob(nil, protocol.TypeEncode, e))
+		<-queue
+	}
+	<-done
+	savePending()
+
+	b, err := os.ReadFile(filepath.Join(configDir(), pendingFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := []pendingJob{}
+	json.Unmarshal(b, &entries)
+	resolved := 0
+	for _, e := range entries {
+		if e.Resolved {
+			resolved++
+			if e.Output != filepath.Join(dir, "clip-"+e.ID+".mp4") {
+				t.Errorf("got output %s", e.Output)
+			}
+		}
+	}
+	if len(entries) != 40 || resolved != 20 {
+		t.Errorf("got %d entries, %d resolved", len(entries), resolved)
+	}
+}
@@ -0,0 +1,294 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/alfg/ffmpegd/protocol"
+)
+
+const presetDir = "presets"
+
+// Matches preset names, which are also their file names.
+var presetNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+var presets = &presetStore{user: map[string]*protocol.Preset{}}
+
+// builtinPresets are available on every server and cannot be changed.
+var builtinPresets = []*protocol.Preset{
+	{
+		Name:        "web-1080p-h264",
+		Description: "1080p H.264 and AAC in a fast start MP4 for web playback.",
+		Payload: protocol.Payload(`{
+			"format": {"container": "mp4"},
+			"video": {"codec": "libx264", "preset": "medium", "pass": "crf", "crf": 23, "profile": "high", "level": "4.1", "pixel_format": "yuv420p", "faststart": true, "size": "1080"},
+			"audio": {"codec": "aac", "quality": "128k", "sample_rate": "48000"},
+			"filter": {"deinterlace": "none", "denoise": "none"}
+		}`),
+	},
+	{
+		Name:        "archive-prores",
+		Description: "ProRes 422 HQ and PCM audio in a MOV for archiving and editing.",
+		Payload: protocol.Payload(`{
+			"format": {"container": "mov"},
+			"video": {"codec": "prores_ks", "profile": "3", "pixel_format": "yuv422p10le"},
+			"audio": {"codec": "pcm_s16le"},
+			"filter": {"deinterlace": "none", "denoise": "none"}
+		}`),
+	},
+	{
+		Name:        "discord-8mb",
+		Description: "720p H.264 and AAC in an MP4 sized to fit Discord's 8MB upload limit.",
+		Payload: protocol.Payload(`{
+			"format": {"container": "mp4"},
+			"video": {"codec": "libx264", "preset": "slow", "pass": "size", "target_size": "8MB", "pixel_format": "yuv420p", "faststart": true, "size": "720"},
+			"audio": {"codec": "aac", "quality": "96k"},
+			"filter": {"deinterlace": "none", "denoise": "none"}
+		}`),
+	},
+}
+
+// presetStore keeps user-defined presets, each persisted as a file in the
+// presets config directory.
+type presetStore struct {
+	mu   sync.Mutex
+	user map[string]*protocol.Preset
+}
+
+// load reads user-defined presets from disk.
+func (s *presetStore) load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files, err := os.ReadDir(filepath.Join(configDir(), presetDir))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".json" {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(configDir(), presetDir, f.Name()))
+		if err != nil {
+			return err
+		}
+		p := &protocol.Preset{}
+		if err := json.Unmarshal(b, p); err != nil {
+			return fmt.Errorf("%s: %v", f.Name(), err)
+		}
+		p.Name = strings.TrimSuffix(f.Name(), ".json")
+		p.Builtin = false
+		if builtinPreset(p.Name) != nil {
+			continue
+		}
+		s.user[p.Name] = p
+	}
+	return nil
+}
+
+// list returns every preset, built-ins first.
+func (s *presetStore) list() []*protocol.Preset {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := append([]*protocol.Preset{}, builtinPresets...)
+	user := []*protocol.Preset{}
+	for _, p := range s.user {
+		user = append(user, p)
+	}
+	sort.Slice(user, func(i, j int) bool { return user[i].Name < user[j].Name })
+	return append(list, user...)
+}
+
+func (s *presetStore) get(name string) *protocol.Preset {
+	if p := builtinPreset(name); p != nil {
+		return p
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.user[name]
+}
+
+// save creates or replaces a user-defined preset.
+func (s *presetStore) save(p *protocol.Preset) error {
+	if !presetNamePattern.MatchString(p.Name) {
+		return errors.New("invalid preset name: " + p.Name)
+	}
+	if builtinPreset(p.Name) != nil {
+		return errors.New("cannot change built-in preset: " + p.Name)
+	}
+	var obj map[string]interface{}
+	if err := json.Unmarshal(p.Payload, &obj); err != nil || obj == nil {
+		return errors.New("preset payload must be a JSON object")
+	}
+	p.Builtin = false
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir := filepath.Join(configDir(), presetDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, p.Name+".json"), b, 0644); err != nil {
+		return err
+	}
+	s.user[p.Name] = p
+	return nil
+}
+
+// delete removes a user-defined preset.
+func (s *presetStore) delete(name string) error {
+	if builtinPreset(name) != nil {
+		return errors.New("cannot delete built-in preset: " + name)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.user[name] == nil {
+		return errors.New("preset not found: " + name)
+	}
+	err := os.Remove(filepath.Join(configDir(), presetDir, name+".json"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	delete(s.user, name)
+	return nil
+}
+
+func builtinPreset(name string) *protocol.Preset {
+	for _, p := range builtinPresets {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+func init() {
+	// Built-in payloads are written indented for readability.
+	for _, p := range builtinPresets {
+		var b bytes.Buffer
+		if err := json.Compact(&b, p.Payload); err != nil {
+			panic("invalid built-in preset " + p.Name + ": " + err.Error())
+		}
+		p.Builtin = true
+		p.Payload = b.Bytes()
+	}
+}
+
+// applyPreset merges the payload of an encode onto its preset.
+func applyPreset(e *protocol.Encode) error {
+	if e.Preset == "" {
+		return nil
+	}
+	p := presets.get(e.Preset)
+	if p == nil {
+		return errors.New("preset not found: " + e.Preset)
+	}
+	payload, err := p.Payload.Merge(e.Payload)
+	if err != nil {
+		return fmt.Errorf("preset %s: %v", e.Preset, err)
+	}
+	e.Payload = payload
+	return nil
+}
+
+// handlePresets lists or creates presets.
+//
+//	GET  /presets
+//	POST /presets {"name":"my-preset","description":"...","payload":{...}}
+func handlePresets(w http.ResponseWriter, r *http.Request) {
+	cors(&w, r)
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, &protocol.Presets{Presets: presets.list()})
+	case http.MethodPost:
+		if !checkOrigin(w, r) || !checkJSON(w, r) {
+			return
+		}
+		p := &protocol.Preset{}
+		if err := json.NewDecoder(r.Body).Decode(p); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := presets.save(p); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, p)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// handlePreset gets, replaces or deletes a preset.
+//
+//	GET    /presets/{name}
+//	PUT    /presets/{name} {"description":"...","payload":{...}}
+//	DELETE /presets/{name}
+func handlePreset(w http.ResponseWriter, r *http.Request) {
+	cors(&w, r)
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/presets/")
+	switch r.Method {
+	case http.MethodGet:
+		p := presets.get(name)
+		if p == nil {
+			writeError(w, http.StatusNotFound, errors.New("preset not found: "+name))
+			return
+		}
+		writeJSON(w, http.StatusOK, p)
+	case http.MethodPut:
+		if !checkOrigin(w, r) || !checkJSON(w, r) {
+			return
+		}
+		p := &protocol.Preset{}
+		if err := json.NewDecoder(r.Body).Decode(p); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		p.Name = name
+		if err := presets.save(p); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, p)
+	case http.MethodDelete:
+		if !checkOrigin(w, r) {
+			return
+		}
+		if err := presets.delete(name); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
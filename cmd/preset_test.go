@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/alfg/ffmpegd/protocol"
+)
+
+func TestApplyPreset(t *testing.T) {
+	base := builtinPreset("discord-8mb")
+	if base == nil {
+		t.Fatal("missing built-in preset")
+	}
+	want := map[string]interface{}{}
+	json.Unmarshal(base.Payload, &want)
+	want["video"].(map[string]interface{})["preset"] = "veryslow"
+	want["audio"].(map[string]interface{})["quality"] = "128k"
+	want["streams"] = map[string]interface{}{"audio": "all"}
+
+	e := protocol.Encode{
+		Preset:  "discord-8mb",
+		Payload: protocol.Payload(`{"video":{"preset":"veryslow"},"audio":{"quality":"128k"},"streams":{"audio":"all"}}`),
+	}
+	if err := applyPreset(&e); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]interface{}{}
+	if err := json.Unmarshal(e.Payload, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %s", e.Payload)
+	}
+
+	// Without overrides the preset payload is used as is.
+	e = protocol.Encode{Preset: "discord-8mb"}
+	if err := applyPreset(&e); err != nil || string(e.Payload) != string(base.Payload) {
+		t.Errorf("got %s, %v", e.Payload, err)
+	}
+
+	// Encodes without a preset are unchanged.
+	e = protocol.Encode{Payload: protocol.Payload(`{"video":{}}`)}
+	if err := applyPreset(&e); err != nil || string(e.Payload) != `{"video":{}}` {
+		t.Errorf("got %s, %v", e.Payload, err)
+	}
+
+	e = protocol.Encode{Preset: "missing"}
+	if err := applyPreset(&e); err == nil {
+		t.Error("expected an error for a missing preset")
+	}
+}
+
+func TestPresetOrigin(t *testing.T) {
+	useTempConfig(t)
+
+	body := `{"name":"small","payload":{"video":{"crf":30}}}`
+	tests := []struct {
+		method      string
+		path        string
+		origin      string
+		contentType string
+		status      int
+	}{
+		{http.MethodPost, "/presets", "https://evil.example", "application/json", http.StatusForbidden},
+		{http.MethodPost, "/presets", "", "text/plain", http.StatusUnsupportedMediaType},
+		{http.MethodPost, "/presets", allowedOrigins[0], "application/json; charset=utf-8", http.StatusCreated},
+		{http.MethodPut, "/presets/small", "https://evil.example", "application/json", http.StatusForbidden},
+		{http.MethodPut, "/presets/small", "", "application/x-www-form-urlencoded", http.StatusUnsupportedMediaType},
+		{http.MethodPut, "/presets/small", "", "application/json", http.StatusOK},
+		{http.MethodDelete, "/presets/small", "https://evil.example", "", http.StatusForbidden},
+		{http.MethodGet, "/presets/small", "https://evil.example", "", http.StatusOK},
+		{http.MethodDelete, "/presets/small", allowedOrigins[0], "", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(body))
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if tt.contentType != "" {
+			r.Header.Set("Content-Type", tt.contentType)
+		}
+		w := httptest.NewRecorder()
+		if tt.path == "/presets" {
+			handlePresets(w, r)
+		} else {
+			handlePreset(w, r)
+		}
+		if w.Code != tt.status {
+			t.Errorf("%s %s from %q: got %d, want %d", tt.method, tt.path, tt.origin, w.Code, tt.status)
+		}
+	}
+}
@@ -0,0 +1,407 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alfg/ffmpegd/ffmpeg"
+	"github.com/alfg/ffmpegd/protocol"
+)
+
+const (
+	watchFile = "watch.json"
+
+	// Watch folder defaults.
+	watchInterval   = 5
+	watchStableTime = 10
+	watchPattern    = "*"
+	watchOutput     = "{name}.mp4"
+	watchOutputDir  = "encoded"
+
+	// Status of a watched file.
+	watchWaiting = "waiting" // Waiting for the file size to stop changing.
+	watchQueued  = "queued"
+	watchDone    = "done"
+	watchFailed  = "failed"
+)
+
+var watchers = []*watcher{}
+
+// WatchFolder submits an encode for each file dropped into a directory.
+// Relative output, done and failed directories are relative to the watched
+// directory. Outputs can't be written to the watched directory, where they
+// would be picked up as new sources.
+type WatchFolder struct {
+	Dir        string           `json:"dir"`
+	Pattern    string           `json:"pattern,omitempty"` // Glob matched against file names, e.g. *.mov.
+	Preset     string           `json:"preset,omitempty"`
+	Payload    protocol.Payload `json:"payload,omitempty"`    // Merged onto the preset, if any.
+	OutputDir  string           `json:"output_dir,omitempty"` // Defaults to an encoded subdirectory.
+	Output     string           `json:"output,omitempty"`     // File name template, e.g. {name}-{preset}.mp4.
+	Collision  string           `json:"collision,omitempty"`  // overwrite, skip, rename or fail.
+	DoneDir    string           `json:"done_dir,omitempty"`   // Sources are moved here once encoded.
+	FailedDir  string           `json:"failed_dir,omitempty"` // Sources are moved here if the encode fails.
+	Watch      string           `json:"watch,omitempty"`      // poll or inotify. inotify falls back to polling where unsupported.
+	Interval   int              `json:"interval,omitempty"`   // Seconds between polls.
+	StableTime int              `json:"stable_time,omitempty"`
+}
+
+// WatchStatus is a watch folder and the files seen in it.
+type WatchStatus struct {
+	WatchFolder
+	Files []*WatchedFile `json:"files"`
+}
+
+// WatchedFile is a file seen in a watch folder.
+type WatchedFile struct {
+	Path   string `json:"path"`
+	Status string `json:"status"`
+	JobID  string `json:"job_id,omitempty"`
+	Err    string `json:"err,omitempty"`
+
+	size        int64
+	modTime     time.Time
+	stableSince time.Time
+}
+
+// watcher scans a watch folder for files whose size has stopped changing.
+type watcher struct {
+	WatchFolder
+
+	mu      sync.Mutex
+	files   map[string]*WatchedFile
+	outputs map[string]bool // Outputs of finished jobs, which are never submitted.
+}
+
+// loadWatchFolders reads the watch folders from disk and starts watching them.
+func loadWatchFolders() error {
+	b, err := os.ReadFile(filepath.Join(configDir(), watchFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	folders := []WatchFolder{}
+	if err := json.Unmarshal(b, &folders); err != nil {
+		return err
+	}
+
+	for _, f := range folders {
+		w, err := newWatcher(f)
+		if err != nil {
+			fmt.Printf("error: watch folder %s: %v\n", f.Dir, err)
+			continue
+		}
+		watchers = append(watchers, w)
+		fmt.Printf("  Watching %s for %s.\n", w.Dir, w.Pattern)
+		go w.run()
+	}
+	return nil
+}
+
+// newWatcher checks a watch folder and fills in its defaults.
+func newWatcher(f WatchFolder) (*watcher, error) {
+	if f.Dir == "" {
+		return nil, errors.New("dir is required")
+	}
+	if info, err := os.Stat(f.Dir); err != nil || !info.IsDir() {
+		return nil, errors.New("dir is not a directory")
+	}
+	if f.Preset == "" && len(f.Payload) == 0 {
+		return nil, errors.New("a preset or payload is required")
+	}
+	if f.Preset != "" && presets.get(f.Preset) == nil {
+		return nil, errors.New("preset not found: " + f.Preset)
+	}
+	if f.Pattern == "" {
+		f.Pattern = watchPattern
+	}
+	if _, err := filepath.Match(f.Pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid pattern %s: %v", f.Pattern, err)
+	}
+	if f.Output == "" {
+		f.Output = watchOutput
+	}
+	if f.OutputDir == "" {
+		f.OutputDir = watchOutputDir
+	}
+	if samePath(f.outputDir(), f.Dir) {
+		return nil, errors.New("output_dir can't be the watched directory")
+	}
+	if f.Interval <= 0 {
+		f.Interval = watchInterval
+	}
+	if f.StableTime <= 0 {
+		f.StableTime = watchStableTime
+	}
+	if f.Watch == "" {
+		f.Watch = "poll"
+	}
+	if f.Watch != "poll" && f.Watch != "inotify" {
+		return nil, errors.New("watch must be poll or inotify")
+	}
+	if err := ffmpeg.CheckCollision(f.Collision); err != nil {
+		return nil, err
+	}
+
+	return &watcher{
+		WatchFolder: f,
+		files:       map[string]*WatchedFile{},
+		outputs:     map[string]bool{},
+	}, nil
+}
+
+// run scans the folder every interval, and on each inotify event if enabled.
+func (w *watcher) run() {
+	var events <-chan struct{}
+	if w.Watch == "inotify" {
+		var err error
+		if events, err = watchEvents(w.Dir); err != nil {
+			fmt.Printf("error: watch folder %s: %v, polling instead\n", w.Dir, err)
+		}
+	}
+
+	ticker := time.NewTicker(time.Duration(w.Interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		for _, j := range w.scan(time.Now()) {
+			submitJob(j)
+		}
+		select {
+		case <-ticker.C:
+		case <-events:
+		}
+	}
+}
+
+// scan records the size of each matching file, and returns jobs for the files
+// that haven't changed for the stable time.
+func (w *watcher) scan(now time.Time) []*job {
+	entries, err := os.ReadDir(w.Dir)
+	if err != nil {
+		fmt.Printf("error: watch folder %s: %v\n", w.Dir, err)
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	stable := time.Duration(w.StableTime) * time.Second
+	present := map[string]bool{}
+	submit := []*job{}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		if ok, _ := filepath.Match(w.Pattern, name); !ok {
+			continue
+		}
+		path := filepath.Join(w.Dir, name)
+		if w.outputs[path] {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		present[path] = true
+
+		// Files that change are waited on again, unless they're queued.
+		f := w.files[path]
+		if f == nil || (f.Status != watchQueued && (f.size != info.Size() || !f.modTime.Equal(info.ModTime()))) {
+			w.files[path] = &WatchedFile{
+				Path:        path,
+				Status:      watchWaiting,
+				size:        info.Size(),
+				modTime:     info.ModTime(),
+				stableSince: now,
+			}
+			continue
+		}
+		if f.Status == watchWaiting && now.Sub(f.stableSince) >= stable {
+			if j := w.newJob(f); j != nil {
+				submit = append(submit, j)
+			}
+		}
+	}
+
+	// Forget files that were moved or deleted.
+	for path := range w.files {
+		if !present[path] {
+			delete(w.files, path)
+		}
+	}
+	return submit
+}
+
+// outputDir returns the directory outputs are written to.
+func (f WatchFolder) outputDir() string {
+	if filepath.IsAbs(f.OutputDir) {
+		return f.OutputDir
+	}
+	return filepath.Join(f.Dir, f.OutputDir)
+}
+
+// newJob creates the encode job for a file. Returns nil if the file isn't
+// submitted. Must be called with w.mu held.
+func (w *watcher) newJob(f *WatchedFile) *job {
+	// The job expands the output template when it runs. The tokens known now
+	// are expanded to check the output.
+	outDir := w.outputDir()
+	template := filepath.Join(outDir, w.Output)
+	output := ffmpeg.ExpandOutput(template, ffmpeg.OutputVars{Input: f.Path, Preset: w.Preset})
+	if samePath(filepath.Dir(output), w.Dir) {
+		w.fail(f, errors.New("output is in the watched directory: "+output))
+		return nil
+	}
+
+	// Skip files encoded before a restart, or still pending from one.
+	if info, err := os.Stat(output); err == nil && info.ModTime().After(f.modTime) {
+		f.Status = watchDone
+		w.move(f, w.DoneDir)
+		return nil
+	}
+	if j := findJob(f.Path, template); j != nil {
+		f.Status, f.JobID = watchQueued, j.ID
+		j.mu.Lock()
+		j.onFinish = func(err error) { w.finish(f, j.Output, err) }
+		j.mu.Unlock()
+		return nil
+	}
+
+	e := protocol.Encode{
+		Input:     f.Path,
+		Output:    template,
+		Preset:    w.Preset,
+		Payload:   w.Payload,
+		Collision: w.Collision,
+	}
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		w.fail(f, err)
+		return nil
+	}
+	if err := applyPreset(&e); err != nil {
+		w.fail(f, err)
+		return nil
+	}
+	if err := checkEncode(protocol.TypeEncode, e); err != nil {
+		w.fail(f, err)
+		return nil
+	}
+
+	j := newJob(nil, protocol.TypeEncode, e)
+	j.onFinish = func(err error) { w.finish(f, j.Output, err) }
+	f.Status, f.JobID = watchQueued, j.ID
+	fmt.Printf("  Watch folder %s submitted %s as job %s.\n", w.Dir, f.Path, j.ID)
+	return j
+}
+
+// finish records the outcome of a file's job and moves it to the done or
+// failed directory. The job's resolved output is never submitted.
+func (w *watcher) finish(f *WatchedFile, output string, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.outputs[output] = true
+	if err != nil {
+		w.fail(f, err)
+		return
+	}
+	f.Status = watchDone
+	w.move(f, w.DoneDir)
+}
+
+// fail marks a file failed and moves it to the failed directory. Must be
+// called with w.mu held.
+func (w *watcher) fail(f *WatchedFile, err error) {
+	f.Status, f.Err = watchFailed, err.Error()
+	w.move(f, w.FailedDir)
+}
+
+// move moves a file into dir, if set. Must be called with w.mu held.
+func (w *watcher) move(f *WatchedFile, dir string) {
+	if dir == "" {
+		return
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(w.Dir, dir)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		fmt.Printf("error: watch folder %s: %v\n", w.Dir, err)
+		return
+	}
+	if err := os.Rename(f.Path, filepath.Join(dir, filepath.Base(f.Path))); err != nil {
+		fmt.Printf("error: watch folder %s: %v\n", w.Dir, err)
+		return
+	}
+	delete(w.files, f.Path)
+}
+
+// status returns the watch folder and its files, sorted by path.
+func (w *watcher) status() *WatchStatus {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	s := &WatchStatus{WatchFolder: w.WatchFolder, Files: []*WatchedFile{}}
+	for _, f := range w.files {
+		c := *f
+		s.Files = append(s.Files, &c)
+	}
+	sort.Slice(s.Files, func(a, b int) bool {
+		return s.Files[a].Path < s.Files[b].Path
+	})
+	return s
+}
+
+// findJob returns the queued or running job for an input and output
+// template.
+func findJob(input, template string) *job {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	for _, j := range jobs {
+		if j.Input == input && j.Template == template {
+			return j
+		}
+	}
+	return nil
+}
+
+// samePath reports whether two paths are the same directory or file.
+func samePath(a, b string) bool {
+	if abs, err := filepath.Abs(a); err == nil {
+		a = abs
+	}
+	if abs, err := filepath.Abs(b); err == nil {
+		b = abs
+	}
+	return a == b
+}
+
+// handleWatch lists the watch folders and the files seen in them.
+//
+//	GET /watch
+func handleWatch(w http.ResponseWriter, r *http.Request) {
+	cors(&w, r)
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	status := []*WatchStatus{}
+	for _, wt := range watchers {
+		status = append(status, wt.status())
+	}
+	writeJSON(w, http.StatusOK, status)
+}
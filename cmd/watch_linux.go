@@ -0,0 +1,41 @@
+//go:build linux
+
+package cmd
+
+import (
+	"syscall"
+)
+
+// watchEvents signals when a file in dir is written, created or moved in,
+// using inotify.
+func watchEvents(dir string) (<-chan struct{}, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	mask := uint32(syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_MOVED_TO)
+	if _, err := syscall.InotifyAddWatch(fd, dir, mask); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	events := make(chan struct{}, 1)
+	go func() {
+		defer syscall.Close(fd)
+		buf := make([]byte, syscall.SizeofInotifyEvent*64+syscall.NAME_MAX+1)
+		for {
+			if _, err := syscall.Read(fd, buf); err != nil {
+				if err == syscall.EINTR {
+					continue
+				}
+				return
+			}
+			// Coalesce events until the next scan.
+			select {
+			case events <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return events, nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package cmd
+
+import "errors"
+
+// watchEvents is only supported on Linux, and watch folders are polled
+// elsewhere.
+func watchEvents(dir string) (<-chan struct{}, error) {
+	return nil, errors.New("inotify is only supported on linux")
+}
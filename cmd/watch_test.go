@@ -0,0 +1,156 @@
+package cmd
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alfg/ffmpegd/protocol"
+)
+
+func TestNewWatcher(t *testing.T) {
+	dir := t.TempDir()
+	payload := protocol.Payload(`{"format":{"container":"mp4"}}`)
+	tests := []struct {
+		folder WatchFolder
+		err    bool
+	}{
+		{WatchFolder{Dir: dir, Payload: payload}, false},
+		{WatchFolder{Dir: dir, Preset: "discord-8mb"}, false},
+		{WatchFolder{Dir: dir, Payload: payload, OutputDir: "."}, true},
+		{WatchFolder{Dir: dir, Payload: payload, OutputDir: dir}, true},
+		{WatchFolder{Dir: dir, Payload: payload, Collision: "keep"}, true},
+		{WatchFolder{Dir: dir, Payload: payload, Watch: "fsevents"}, true},
+		{WatchFolder{Dir: dir, Payload: payload, Pattern: "["}, true},
+		{WatchFolder{Dir: dir, Preset: "missing"}, true},
+		{WatchFolder{Dir: dir}, true},
+		{WatchFolder{Dir: filepath.Join(dir, "missing"), Payload: payload}, true},
+	}
+	for _, tt := range tests {
+		if _, err := newWatcher(tt.folder); (err != nil) != tt.err {
+			t.Errorf("%+v: got %v", tt.folder, err)
+		}
+	}
+
+	w, err := newWatcher(WatchFolder{Dir: dir, Payload: payload})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.outputDir() != filepath.Join(dir, watchOutputDir) || w.Output != watchOutput || w.Pattern != watchPattern {
+		t.Errorf("got defaults %+v", w.WatchFolder)
+	}
+}
+
+func TestWatcherScan(t *testing.T) {
+	dir := t.TempDir()
+	w, err := newWatcher(WatchFolder{
+		Dir:        dir,
+		Pattern:    "*.mov",
+		Payload:    protocol.Payload(`{"format":{"container":"mp4"}}`),
+		Output:     "{name}-{jobid}.mp4",
+		DoneDir:    "done",
+		StableTime: 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := filepath.Join(dir, "clip.mov")
+	os.WriteFile(input, []byte{0}, 0644)
+	os.WriteFile(filepath.Join(dir, ".hidden.mov"), []byte{0}, 0644)
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte{0}, 0644)
+
+	// Files are submitted once they haven't changed for the stable time.
+	start := time.Now()
+	steps := []struct {
+		after  time.Duration
+		write  bool
+		jobs   int
+		status string
+	}{
+		{0, false, 0, watchWaiting},
+		{5 * time.Second, false, 0, watchWaiting},
+		{8 * time.Second, true, 0, watchWaiting}, // Changed, so waited on again.
+		{15 * time.Second, false, 0, watchWaiting},
+		{18 * time.Second, false, 1, watchQueued},
+		{30 * time.Second, false, 0, watchQueued},
+	}
+	var submitted *job
+	for _, s := range steps {
+		if s.write {
+			os.WriteFile(input, []byte{0, 1}, 0644)
+		}
+		got := w.scan(start.Add(s.after))
+		if len(got) != s.jobs {
+			t.Fatalf("after %v: got %d jobs", s.after, len(got))
+		}
+		if len(got) > 0 {
+			submitted = got[0]
+		}
+		if f := w.files[input]; f == nil || f.Status != s.status {
+			t.Fatalf("after %v: got %+v", s.after, f)
+		}
+	}
+	if len(w.files) != 1 {
+		t.Errorf("got files %v", w.files)
+	}
+
+	// The job expands the output template when it runs.
+	template := filepath.Join(dir, watchOutputDir, "{name}-{jobid}.mp4")
+	if submitted.Input != input || submitted.Output != template || submitted.Template != template {
+		t.Errorf("got input %s, output %s", submitted.Input, submitted.Output)
+	}
+
+	output := filepath.Join(dir, watchOutputDir, "clip-"+submitted.ID+".mp4")
+	submitted.Output = output
+	submitted.onFinish(nil)
+	if _, err := os.Stat(filepath.Join(dir, "done", "clip.mov")); err != nil {
+		t.Error("source was not moved to the done directory")
+	}
+	if !w.outputs[output] {
+		t.Error("output was not recorded")
+	}
+	if len(w.files) != 0 {
+		t.Errorf("got files %v", w.files)
+	}
+}
+
+func TestWatcherSkipsEncoded(t *testing.T) {
+	dir := t.TempDir()
+	w, err := newWatcher(WatchFolder{Dir: dir, Payload: protocol.Payload(`{}`), FailedDir: "failed", StableTime: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	input := filepath.Join(dir, "clip.mov")
+	os.WriteFile(input, []byte{0}, 0644)
+	os.Chtimes(input, old, old)
+	os.MkdirAll(w.outputDir(), 0755)
+	os.WriteFile(filepath.Join(w.outputDir(), "clip.mp4"), []byte{0}, 0644)
+
+	// A source whose output is newer is done.
+	now := time.Now()
+	w.scan(now)
+	if got := w.scan(now.Add(2 * time.Second)); len(got) != 0 || w.files[input].Status != watchDone {
+		t.Errorf("got %d jobs, %+v", len(got), w.files[input])
+	}
+
+	// Outputs written back to the watched directory fail.
+	w.Output = "../{name}.mp4"
+	w.files[input].Status = watchWaiting
+	if got := w.scan(now.Add(4 * time.Second)); len(got) != 0 {
+		t.Errorf("got %d jobs", len(got))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "failed", "clip.mov")); err != nil {
+		t.Error("source was not moved to the failed directory")
+	}
+
+	// Failed jobs move the source to the failed directory.
+	f := &WatchedFile{Path: filepath.Join(dir, "other.mov"), Status: watchQueued}
+	os.WriteFile(f.Path, []byte{0}, 0644)
+	w.finish(f, "", errors.New("encode failed"))
+	if f.Status != watchFailed || f.Err != "encode failed" {
+		t.Errorf("got %+v", f)
+	}
+}
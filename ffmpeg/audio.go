@@ -0,0 +1,331 @@
+package ffmpeg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Loudnorm targets, matching the ffmpeg filter defaults.
+const (
+	loudnormI   = -24
+	loudnormTP  = -2
+	loudnormLRA = 7
+)
+
+// Sample rate used if the input's is unknown.
+const defaultSampleRate = "48000"
+
+// Default audio codec for each audio container.
+var audioCodecs = map[string]string{
+	"m4a":  "aac",
+	"opus": "libopus",
+	"flac": "flac",
+	"mp3":  "libmp3lame",
+	"ogg":  "libvorbis",
+	"wav":  "pcm_s16le",
+}
+
+// Muxers for containers not named after their muxer.
+var audioMuxers = map[string]string{
+	"m4a": "ipod",
+}
+
+// audioJobOptions struct passed into FFmpeg.RunAudio.
+type audioJobOptions struct {
+	Format   formatOptions    `json:"format"` // Container and clip.
+	Audio    audioOptions     `json:"audio"`
+	Filter   filterOptions    `json:"filter"`
+	Track    *int             `json:"track"`    // Audio track number, counting audio streams only.
+	Language string           `json:"language"` // Audio track language tag, e.g. "eng". Ignored if a track is set.
+	Loudnorm *loudnormOptions `json:"loudnorm"` // EBU R128 loudness normalization.
+}
+
+// loudnormOptions sets the loudness targets. Unset values use the defaults.
+type loudnormOptions struct {
+	I   *float64 `json:"i"`   // Integrated loudness target in LUFS, -70 to -5.
+	TP  *float64 `json:"tp"`  // Maximum true peak in dBTP, -9 to 0.
+	LRA *float64 `json:"lra"` // Loudness range target in LU, 1 to 50.
+}
+
+// filter returns the loudnorm targets as filter options.
+func (l *loudnormOptions) filter() string {
+	return fmt.Sprintf("loudnorm=I=%g:TP=%g:LRA=%g",
+		loudnormValue(l.I, loudnormI), loudnormValue(l.TP, loudnormTP), loudnormValue(l.LRA, loudnormLRA))
+}
+
+// validate returns an error if a target is outside the range loudnorm accepts.
+func (l *loudnormOptions) validate() error {
+	targets := []struct {
+		name     string
+		v        *float64
+		min, max float64
+	}{
+		{"i", l.I, -70, -5},
+		{"tp", l.TP, -9, 0},
+		{"lra", l.LRA, 1, 50},
+	}
+	for _, t := range targets {
+		if t.v != nil && (*t.v < t.min || *t.v > t.max) {
+			return fmt.Errorf("loudnorm %s must be between %g and %g", t.name, t.min, t.max)
+		}
+	}
+	return nil
+}
+
+// loudnormMeasurement is printed by the measuring loudnorm pass.
+type loudnormMeasurement struct {
+	InputI       string `json:"input_i"`
+	InputTP      string `json:"input_tp"`
+	InputLRA     string `json:"input_lra"`
+	InputThresh  string `json:"input_thresh"`
+	TargetOffset string `json:"target_offset"`
+}
+
+// RunAudio runs an audio job. With loudness normalization the track is
+// measured in a first pass and normalized linearly in the second.
+func (f *FFmpeg) RunAudio(input, output, data string, probe *FFProbeResponse) error {
+	opt, err := decodeAudioOptions(data)
+	if err != nil {
+		return err
+	}
+
+	var m *loudnormMeasurement
+	if opt.Loudnorm != nil {
+		args, err := loudnormArgs(input, opt, probe)
+		if err != nil {
+			return err
+		}
+		stderr, err := f.runAnalysis(args)
+		if err != nil {
+			return err
+		}
+		if m, err = parseLoudnorm(stderr); err != nil {
+			return err
+		}
+		if f.cancelled() {
+			return ErrCancelled
+		}
+	}
+
+	args, err := audioArgs(input, output, opt, probe, m)
+	if err != nil {
+		return err
+	}
+	return f.run(args)
+}
+
+// AudioCommand returns the ffmpeg argv of an audio job without running it.
+// With loudness normalization it's the normalizing pass, with the values the
+// measuring pass finds left empty.
+func AudioCommand(input, output, data string) ([]string, error) {
+	opt, err := decodeAudioOptions(data)
+	if err != nil {
+		return nil, err
+	}
+	probe, err := FFProbe{}.Run(input)
+	if err != nil {
+		return nil, err
+	}
+
+	var m *loudnormMeasurement
+	if opt.Loudnorm != nil {
+		if err := opt.Loudnorm.validate(); err != nil {
+			return nil, err
+		}
+		m = &loudnormMeasurement{}
+	}
+	args, err := audioArgs(input, output, opt, probe, m)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{ffmpegCmd}, args...), nil
+}
+
+func decodeAudioOptions(data string) (audioJobOptions, error) {
+	opt := audioJobOptions{}
+	if data != "" {
+		if err := json.Unmarshal([]byte(data), &opt); err != nil {
+			return opt, err
+		}
+	}
+	return opt, nil
+}
+
+// audioArgs builds the ffmpeg arguments for an audio job. The loudnorm
+// measurement is required if loudness normalization is set.
+func audioArgs(input, output string, opt audioJobOptions, probe *FFProbeResponse, m *loudnormMeasurement) ([]string, error) {
+	args, err := audioInputArgs(input, "error", opt, probe)
+	if err != nil {
+		return nil, err
+	}
+
+	// Container and codec.
+	container := opt.Format.Container
+	if container == "" {
+		container = strings.ToLower(strings.TrimPrefix(filepath.Ext(output), "."))
+	} else if _, ok := audioCodecs[container]; !ok {
+		return nil, errors.New("unsupported audio container: " + container)
+	}
+	aopt := opt.Audio
+	if aopt.Codec == "" {
+		aopt.Codec = audioCodecs[container]
+	}
+
+	filters := setAudioFilters(aopt, opt.Filter)
+	if opt.Loudnorm != nil {
+		if aopt.Codec == "copy" {
+			return nil, errors.New("loudness normalization cannot be used with audio codec copy")
+		}
+		if m == nil {
+			return nil, errors.New("loudness normalization requires a measurement")
+		}
+
+		// loudnorm resamples to 192kHz, so keep the source rate.
+		if aopt.SampleRate == "" || aopt.SampleRate == "auto" {
+			aopt.SampleRate = audioSampleRate(opt, probe)
+		}
+		filters = joinFilters(filters, setLoudnorm(opt.Loudnorm, m))
+	}
+
+	args = append(args, setAudioFlags(aopt)...)
+	if filters != "" {
+		args = append(args, "-af", filters)
+	}
+
+	if opt.Format.Container != "" {
+		muxer := audioMuxers[container]
+		if muxer == "" {
+			muxer = container
+		}
+		args = append(args, "-f", muxer)
+	}
+
+	return append(args, "-y", output), nil
+}
+
+// loudnormArgs builds the ffmpeg arguments for the loudnorm measuring pass.
+// The measurement is printed to stderr at the info log level.
+func loudnormArgs(input string, opt audioJobOptions, probe *FFProbeResponse) ([]string, error) {
+	args, err := audioInputArgs(input, "info", opt, probe)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := opt.Loudnorm.validate(); err != nil {
+		return nil, err
+	}
+	filter := opt.Loudnorm.filter() + ":print_format=json"
+	filter = joinFilters(setAudioFilters(opt.Audio, opt.Filter), filter)
+
+	return append(args, "-af", filter, "-f", "null", "-"), nil
+}
+
+// audioInputArgs returns the input, clip and stream selection arguments
+// shared by both passes.
+func audioInputArgs(input, loglevel string, opt audioJobOptions, probe *FFProbeResponse) ([]string, error) {
+	track, err := audioTrack(opt, probe)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{
+		"-hide_banner",
+		"-loglevel", loglevel,
+		"-progress", "pipe:1",
+		"-i", input,
+	}
+	if opt.Format.Clip {
+		args = append(args, setFormatFlags(opt.Format)...)
+	}
+	return append(args, "-map", track, "-vn", "-sn", "-dn"), nil
+}
+
+// audioTrack returns the map specifier of the selected audio track. Without
+// a track or language, the default track is used.
+func audioTrack(opt audioJobOptions, probe *FFProbeResponse) (string, error) {
+	streams := probe.audioStreams()
+	if len(streams) == 0 {
+		return "", errors.New("input has no audio stream")
+	}
+
+	if opt.Track != nil {
+		if *opt.Track < 0 || *opt.Track >= len(streams) {
+			return "", fmt.Errorf("input has no audio track %d", *opt.Track)
+		}
+		return "0:" + strconv.Itoa(streams[*opt.Track].Index), nil
+	}
+
+	if opt.Language != "" {
+		for _, s := range streams {
+			if strings.EqualFold(s.Tags.Language, opt.Language) {
+				return "0:" + strconv.Itoa(s.Index), nil
+			}
+		}
+		return "", errors.New("input has no audio track with language " + opt.Language)
+	}
+
+	for _, s := range streams {
+		if s.Disposition.Default == 1 {
+			return "0:" + strconv.Itoa(s.Index), nil
+		}
+	}
+	return "0:" + strconv.Itoa(streams[0].Index), nil
+}
+
+// audioSampleRate returns the sample rate of the selected track.
+func audioSampleRate(opt audioJobOptions, probe *FFProbeResponse) string {
+	track, _ := audioTrack(opt, probe)
+	for _, s := range probe.Streams {
+		if "0:"+strconv.Itoa(s.Index) == track && s.SampleRate != "" {
+			return s.SampleRate
+		}
+	}
+	return defaultSampleRate
+}
+
+// setLoudnorm returns the loudnorm filter for the normalizing pass, using
+// the measured values for linear normalization.
+func setLoudnorm(opt *loudnormOptions, m *loudnormMeasurement) string {
+	return fmt.Sprintf("%s:measured_I=%s:measured_TP=%s:measured_LRA=%s:measured_thresh=%s:offset=%s:linear=true",
+		opt.filter(), m.InputI, m.InputTP, m.InputLRA, m.InputThresh, m.TargetOffset)
+}
+
+// parseLoudnorm parses the JSON measurement printed at the end of the
+// measuring pass.
+func parseLoudnorm(stderr string) (*loudnormMeasurement, error) {
+	start := strings.LastIndex(stderr, "{")
+	end := strings.LastIndex(stderr, "}")
+	if start < 0 || end < start {
+		return nil, errors.New("loudnorm measurement not found")
+	}
+
+	m := &loudnormMeasurement{}
+	if err := json.Unmarshal([]byte(stderr[start:end+1]), m); err != nil {
+		return nil, err
+	}
+	if m.InputI == "" || strings.HasSuffix(m.InputI, "inf") {
+		return nil, errors.New("cannot normalize silent audio")
+	}
+	return m, nil
+}
+
+func loudnormValue(v *float64, def float64) float64 {
+	if v == nil {
+		return def
+	}
+	return *v
+}
+
+func joinFilters(filters ...string) string {
+	args := []string{}
+	for _, f := range filters {
+		if f != "" {
+			args = append(args, f)
+		}
+	}
+	return strings.Join(args, ",")
+}
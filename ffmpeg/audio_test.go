@@ -0,0 +1,131 @@
+package ffmpeg
+
+import (
+	"strings"
+	"testing"
+)
+
+var testAudioProbe = &FFProbeResponse{
+	Streams: []stream{
+		{Index: 0, CodecType: "video"},
+		{Index: 1, CodecType: "audio", SampleRate: "44100", Tags: tags{Language: "eng"}},
+		{Index: 2, CodecType: "audio", SampleRate: "48000", Tags: tags{Language: "fre"}, Disposition: disposition{Default: 1}},
+	},
+}
+
+const testLoudnormOutput = `[Parsed_loudnorm_0 @ 0x55d5c8c0]
+{
+	"input_i" : "-27.61",
+	"input_tp" : "-4.47",
+	"input_lra" : "18.06",
+	"input_thresh" : "-39.20",
+	"output_i" : "-16.58",
+	"output_tp" : "-1.50",
+	"output_lra" : "14.78",
+	"output_thresh" : "-27.71",
+	"normalization_type" : "dynamic",
+	"target_offset" : "0.58"
+}
+`
+
+func TestAudioArgs(t *testing.T) {
+	track := 0
+	tests := []struct {
+		opt    audioJobOptions
+		output string
+		want   string
+	}{
+		{audioJobOptions{}, "out.mp3", "-i in.mp4 -map 0:2 -vn -sn -dn -c:a libmp3lame -y out.mp3"},
+		{audioJobOptions{Track: &track}, "out.flac", "-i in.mp4 -map 0:1 -vn -sn -dn -c:a flac -y out.flac"},
+		{audioJobOptions{Language: "eng", Audio: audioOptions{Quality: "128k"}}, "out.m4a", "-i in.mp4 -map 0:1 -vn -sn -dn -c:a aac -b:a 128k -y out.m4a"},
+		{audioJobOptions{Format: formatOptions{Container: "m4a"}}, "out", "-i in.mp4 -map 0:2 -vn -sn -dn -c:a aac -f ipod -y out"},
+		{audioJobOptions{Format: formatOptions{Container: "opus", Clip: true, StartTime: "5"}}, "out.opus", "-i in.mp4 -ss 5 -map 0:2 -vn -sn -dn -c:a libopus -f opus -y out.opus"},
+	}
+
+	for _, tt := range tests {
+		args, err := audioArgs("in.mp4", tt.output, tt.opt, testAudioProbe, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := strings.Join(args, " ")
+		if !strings.HasSuffix(got, tt.want) {
+			t.Errorf("got %s, want suffix %s", got, tt.want)
+		}
+	}
+}
+
+func TestAudioTrackErrors(t *testing.T) {
+	track := 2
+	for _, opt := range []audioJobOptions{{Track: &track}, {Language: "ger"}} {
+		if _, err := audioTrack(opt, testAudioProbe); err == nil {
+			t.Errorf("expected error for %+v", opt)
+		}
+	}
+
+	noAudio := &FFProbeResponse{Streams: []stream{{CodecType: "video"}}}
+	if _, err := audioTrack(audioJobOptions{}, noAudio); err == nil {
+		t.Error("expected error for input without audio")
+	}
+}
+
+func TestAudioArgsLoudnorm(t *testing.T) {
+	m, err := parseLoudnorm(testLoudnormOutput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.InputI != "-27.61" || m.TargetOffset != "0.58" {
+		t.Errorf("unexpected measurement: %+v", m)
+	}
+
+	opt := audioJobOptions{Track: new(int), Loudnorm: &loudnormOptions{I: float(-16), TP: float(-1.5), LRA: float(11)}}
+	measure, err := loudnormArgs("in.mp4", opt, testAudioProbe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "-loglevel info -progress pipe:1 -i in.mp4 -map 0:1 -vn -sn -dn -af loudnorm=I=-16:TP=-1.5:LRA=11:print_format=json -f null -"
+	if got := strings.Join(measure, " "); !strings.HasSuffix(got, want) {
+		t.Errorf("got %s, want suffix %s", got, want)
+	}
+
+	args, err := audioArgs("in.mp4", "out.m4a", opt, testAudioProbe, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "-c:a aac -ar 44100 -af loudnorm=I=-16:TP=-1.5:LRA=11:measured_I=-27.61:measured_TP=-4.47:measured_LRA=18.06:measured_thresh=-39.20:offset=0.58:linear=true -y out.m4a"
+	if got := strings.Join(args, " "); !strings.HasSuffix(got, want) {
+		t.Errorf("got %s, want suffix %s", got, want)
+	}
+
+	opt.Audio.Codec = "copy"
+	if _, err := audioArgs("in.mp4", "out.m4a", opt, testAudioProbe, m); err == nil {
+		t.Error("expected error for loudnorm with codec copy")
+	}
+}
+
+func float(v float64) *float64 {
+	return &v
+}
+
+func TestLoudnormTargets(t *testing.T) {
+	tests := []struct {
+		opt  loudnormOptions
+		want string
+		err  bool
+	}{
+		{loudnormOptions{}, "loudnorm=I=-24:TP=-2:LRA=7", false},
+		{loudnormOptions{TP: float(0)}, "loudnorm=I=-24:TP=0:LRA=7", false},
+		{loudnormOptions{I: float(-5), LRA: float(50)}, "loudnorm=I=-5:TP=-2:LRA=50", false},
+		{loudnormOptions{I: float(0)}, "", true},
+		{loudnormOptions{TP: float(1)}, "", true},
+		{loudnormOptions{LRA: float(0)}, "", true},
+	}
+	for _, tt := range tests {
+		if err := tt.opt.validate(); (err != nil) != tt.err {
+			t.Errorf("%+v: got %v", tt.opt, err)
+			continue
+		}
+		if !tt.err && tt.opt.filter() != tt.want {
+			t.Errorf("got %s, want %s", tt.opt.filter(), tt.want)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package ffmpeg
+
+import (
+	"errors"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/alfg/ffmpegd/protocol"
+)
+
+// Name fragments of hardware accelerated codecs.
+var hardwareCodecs = []string{"nvenc", "cuvid", "qsv", "vaapi", "videotoolbox", "amf", "v4l2m2m", "mediacodec", "vulkan", "d3d11va", "dxva2", "mf", "omx", "rkmpp"}
+
+var (
+	capsMu sync.Mutex
+	caps   *protocol.Capabilities
+)
+
+// LoadCapabilities runs ffmpeg to list its capabilities, and caches them to
+// validate payloads against.
+func LoadCapabilities() (*protocol.Capabilities, error) {
+	c := &protocol.Capabilities{}
+	lists := []struct {
+		flag  string
+		parse func(*protocol.Capabilities, string)
+	}{
+		{"-encoders", func(c *protocol.Capabilities, out string) { c.Encoders = parseCodecs(out) }},
+		{"-decoders", func(c *protocol.Capabilities, out string) { c.Decoders = parseCodecs(out) }},
+		{"-filters", func(c *protocol.Capabilities, out string) { c.Filters = parseFilters(out) }},
+		{"-muxers", func(c *protocol.Capabilities, out string) { c.Muxers = parseFormats(out) }},
+		{"-pix_fmts", func(c *protocol.Capabilities, out string) { c.PixFmts = parsePixFmts(out) }},
+		{"-protocols", func(c *protocol.Capabilities, out string) { c.InputProtocols, c.OutputProtocols = parseProtocols(out) }},
+	}
+	for _, l := range lists {
+		out, err := exec.Command(ffmpegCmd, "-hide_banner", l.flag).Output()
+		if err != nil {
+			return nil, errors.New("ffmpeg " + l.flag + ": " + err.Error())
+		}
+		l.parse(c, string(out))
+	}
+
+	capsMu.Lock()
+	caps = c
+	capsMu.Unlock()
+	return c, nil
+}
+
+// loadedCapabilities returns the cached capabilities, or nil if they haven't
+// been loaded.
+func loadedCapabilities() *protocol.Capabilities {
+	capsMu.Lock()
+	defer capsMu.Unlock()
+	return caps
+}
+
+// hasEncoder reports whether ffmpeg is built with an encoder.
+func hasEncoder(c *protocol.Capabilities, name string) bool {
+	for _, e := range c.Encoders {
+		if e.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckCapabilities returns an error if an ffmpeg argv, such as one returned
+// by Command, uses a codec, filter, muxer, pixel format or protocol ffmpeg
+// isn't built with. Commands are only checked once LoadCapabilities has run.
+func CheckCapabilities(argv []string) error {
+	c := loadedCapabilities()
+	if c == nil || len(argv) == 0 {
+		return nil
+	}
+	if m := missing(c, argv[1:]); len(m) > 0 {
+		return errors.New(strings.Join(m, ", "))
+	}
+	return nil
+}
+
+// missing lists what the ffmpeg arguments use that ffmpeg isn't built with.
+func missing(c *protocol.Capabilities, args []string) []string {
+	out := []string{}
+	add := func(s string) {
+		if !contains(out, s) {
+			out = append(out, s)
+		}
+	}
+
+	for i := 0; i < len(args)-1; i++ {
+		flag, value := args[i], args[i+1]
+		switch {
+		case isCodecFlag(flag):
+			if value != "copy" && !hasEncoder(c, value) {
+				add("encoder " + value + " is not available")
+			}
+		case flag == "-vf" || flag == "-af" || flag == "-filter_complex" || flag == "-lavfi":
+			for _, name := range filterNames(value) {
+				if !contains(c.Filters, name) {
+					add("filter " + name + " is not available")
+				}
+			}
+		case flag == "-pix_fmt":
+			if !contains(c.PixFmts, value) {
+				add("pixel format " + value + " is not available")
+			}
+		case flag == "-f":
+			// Formats set before an input are demuxers.
+			if argIndex(args[i:], "-i") < 0 && !contains(c.Muxers, value) {
+				add("muxer " + value + " is not available")
+			}
+		case flag == "-i":
+			if p := urlScheme(value); p != "" && !contains(c.InputProtocols, p) {
+				add("input protocol " + p + " is not available")
+			}
+		}
+	}
+	if p := urlScheme(args[len(args)-1]); p != "" && !contains(c.OutputProtocols, p) {
+		add("output protocol " + p + " is not available")
+	}
+	return out
+}
+
+// isCodecFlag reports whether flag sets an output codec, e.g. -c:v or -c:a:0.
+func isCodecFlag(flag string) bool {
+	switch flag {
+	case "-c", "-codec", "-vcodec", "-acodec", "-scodec":
+		return true
+	}
+	return strings.HasPrefix(flag, "-c:") || strings.HasPrefix(flag, "-codec:")
+}
+
+// filterNames returns the names of the filters in a filter graph.
+func filterNames(graph string) []string {
+	names := []string{}
+	for _, f := range splitFilterGraph(graph) {
+		// Strip the input pad labels.
+		for strings.HasPrefix(f, "[") {
+			i := strings.Index(f, "]")
+			if i < 0 {
+				break
+			}
+			f = strings.TrimSpace(f[i+1:])
+		}
+		if i := strings.IndexAny(f, "=[@"); i >= 0 {
+			f = f[:i]
+		}
+		if f != "" && !contains(names, f) {
+			names = append(names, f)
+		}
+	}
+	return names
+}
+
+// splitFilterGraph splits a filter graph into filters at unquoted and
+// unescaped commas and semicolons.
+func splitFilterGraph(graph string) []string {
+	filters := []string{}
+	var cur strings.Builder
+	quoted := false
+	for i := 0; i < len(graph); i++ {
+		ch := graph[i]
+		switch {
+		case ch == '\\' && i+1 < len(graph):
+			cur.WriteByte(ch)
+			i++
+			ch = graph[i]
+		case ch == '\'':
+			quoted = !quoted
+		case (ch == ',' || ch == ';') && !quoted:
+			filters = append(filters, strings.TrimSpace(cur.String()))
+			cur.Reset()
+			continue
+		}
+		cur.WriteByte(ch)
+	}
+	return append(filters, strings.TrimSpace(cur.String()))
+}
+
+// urlScheme returns the protocol of a URL, or "" for a file path.
+func urlScheme(path string) string {
+	i := strings.Index(path, "://")
+	if i <= 0 {
+		return ""
+	}
+	return path[:i]
+}
+
+// parseCodecs parses the output of ffmpeg -encoders or -decoders, listed
+// after a ------ line as "V....D name  Description".
+func parseCodecs(out string) []*protocol.Codec {
+	codecs := []*protocol.Codec{}
+	for _, line := range listLines(out, "------") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields[0]) < 1 {
+			continue
+		}
+		c := &protocol.Codec{Name: fields[1], Description: strings.Join(fields[2:], " ")}
+		switch fields[0][0] {
+		case 'V':
+			c.Type = "video"
+		case 'A':
+			c.Type = "audio"
+		case 'S':
+			c.Type = "subtitle"
+		}
+		for _, hw := range hardwareCodecs {
+			if strings.HasSuffix(c.Name, "_"+hw) {
+				c.Hardware = true
+			}
+		}
+		codecs = append(codecs, c)
+	}
+	return codecs
+}
+
+// parseFilters parses the output of ffmpeg -filters, listed as
+// " TSC name  V->V  Description".
+func parseFilters(out string) []string {
+	filters := []string{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 2 && strings.Contains(fields[2], "->") {
+			filters = append(filters, fields[1])
+		}
+	}
+	sort.Strings(filters)
+	return filters
+}
+
+// parseFormats parses the output of ffmpeg -muxers, listed after a -- line as
+// " E name  Description".
+func parseFormats(out string) []string {
+	formats := []string{}
+	for _, line := range listLines(out, "--") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		for _, name := range strings.Split(fields[1], ",") {
+			if !contains(formats, name) {
+				formats = append(formats, name)
+			}
+		}
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+// parsePixFmts parses the output of ffmpeg -pix_fmts, listed after a -----
+// line as "IO... name  components  bits  depths".
+func parsePixFmts(out string) []string {
+	formats := []string{}
+	for _, line := range listLines(out, "-----") {
+		if fields := strings.Fields(line); len(fields) > 1 {
+			formats = append(formats, fields[1])
+		}
+	}
+	return formats
+}
+
+// parseProtocols parses the output of ffmpeg -protocols, listed under Input:
+// and Output: headings.
+func parseProtocols(out string) ([]string, []string) {
+	input, output := []string{}, []string{}
+	var list *[]string
+	for _, line := range strings.Split(out, "\n") {
+		switch strings.TrimSpace(line) {
+		case "":
+		case "Input:":
+			list = &input
+		case "Output:":
+			list = &output
+		default:
+			if list != nil {
+				*list = append(*list, strings.TrimSpace(line))
+			}
+		}
+	}
+	return input, output
+}
+
+// listLines returns the lines after the separator line ending a list header.
+func listLines(out, separator string) []string {
+	lines := strings.Split(out, "\n")
+	for i, line := range lines {
+		if strings.TrimSpace(line) == separator {
+			return lines[i+1:]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package ffmpeg
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/alfg/ffmpegd/protocol"
+)
+
+const encodersOutput = `Encoders:
+ V..... = Video
+ A..... = Audio
+ S..... = Subtitle
+ .F.... = Frame-level multithreading
+ ..S... = Slice-level multithreading
+ ...X.. = Codec is experimental
+ ....B. = Supports draw_horiz_band
+ .....D = Supports direct rendering method 1
+ ------
+ V....D libx264              libx264 H.264 / AVC / MPEG-4 AVC / MPEG-4 part 10 (codec h264)
+ V....D h264_nvenc           NVIDIA NVENC H.264 encoder (codec h264)
+ A....D aac                  AAC (Advanced Audio Coding)
+ S..... mov_text             3GPP Timed Text subtitle
+`
+
+const filtersOutput = `Filters:
+  T.. = Timeline support
+  .S. = Slice threading
+  ..C = Command support
+  A = Audio input/output
+  V = Video input/output
+  N = Dynamic number and/or type of input/output
+  | = Source or sink filter
+ ... acontrast         A->A       Simple audio dynamic range compression/expansion filter.
+ TSC scale             V->V       Scale the input video size and/or convert the image format.
+ ... split             V->N       Pass on the input to N video outputs.
+ T.C volume            A->A       Change input volume.
+`
+
+const muxersOutput = `File formats:
+ D. = Demuxing supported
+ .E = Muxing supported
+ --
+  E hls             Apple HTTP Live Streaming
+  E mp4             MP4 (MPEG-4 Part 14)
+  E null            raw null video
+`
+
+const pixFmtsOutput = `Pixel formats:
+I.... = Supported Input  format for conversion
+.O... = Supported Output format for conversion
+FLAGS NAME            NB_COMPONENTS BITS_PER_PIXEL BIT_DEPTHS
+-----
+IO... yuv420p                3             12      8-8-8
+IO... yuv420p10le            3             15      10-10-10
+`
+
+const protocolsOutput = `Supported file protocols:
+Input:
+  file
+  http
+  rtmp
+Output:
+  file
+  rtmp
+`
+
+func TestParseCapabilities(t *testing.T) {
+	codecs := parseCodecs(encodersOutput)
+	want := []*protocol.Codec{
+		{Name: "libx264", Type: "video", Description: "libx264 H.264 / AVC / MPEG-4 AVC / MPEG-4 part 10 (codec h264)"},
+		{Name: "h264_nvenc", Type: "video", Description: "NVIDIA NVENC H.264 encoder (codec h264)", Hardware: true},
+		{Name: "aac", Type: "audio", Description: "AAC (Advanced Audio Coding)"},
+		{Name: "mov_text", Type: "subtitle", Description: "3GPP Timed Text subtitle"},
+	}
+	if !reflect.DeepEqual(codecs, want) {
+		t.Errorf("got codecs %+v", codecs)
+	}
+
+	if got := parseFilters(filtersOutput); !reflect.DeepEqual(got, []string{"acontrast", "scale", "split", "volume"}) {
+		t.Errorf("got filters %v", got)
+	}
+	if got := parseFormats(muxersOutput); !reflect.DeepEqual(got, []string{"hls", "mp4", "null"}) {
+		t.Errorf("got muxers %v", got)
+	}
+	if got := parsePixFmts(pixFmtsOutput); !reflect.DeepEqual(got, []string{"yuv420p", "yuv420p10le"}) {
+		t.Errorf("got pixel formats %v", got)
+	}
+	input, output := parseProtocols(protocolsOutput)
+	if !reflect.DeepEqual(input, []string{"file", "http", "rtmp"}) || !reflect.DeepEqual(output, []string{"file", "rtmp"}) {
+		t.Errorf("got protocols %v, %v", input, output)
+	}
+}
+
+func TestCapabilitiesMissing(t *testing.T) {
+	c := &protocol.Capabilities{
+		Encoders:        parseCodecs(encodersOutput),
+		Filters:         parseFilters(filtersOutput),
+		Muxers:          parseFormats(muxersOutput),
+		PixFmts:         parsePixFmts(pixFmtsOutput),
+		OutputProtocols: []string{"file", "rtmp"},
+		InputProtocols:  []string{"file", "http", "rtmp"},
+	}
+
+	args := []string{"-f", "concat", "-i", "list.txt", "-c:v", "libx264", "-vf", "scale=1280:-2,split=2",
+		"-c:a", "copy", "-af", "volume=0.50", "-pix_fmt", "yuv420p", "-y", "out.mp4"}
+	if got := missing(c, args); len(got) != 0 {
+		t.Errorf("expected nothing missing, got %v", got)
+	}
+
+	args = []string{"-i", "srt://host:9000", "-c:v", "libx265", "-vf", "[0:v]zscale=t=linear,drawtext=text='a\\, b',scale=1280:-2",
+		"-c:a", "libopus", "-pix_fmt", "p010le", "-f", "dash", "-y", "s3://bucket/out.mpd"}
+	want := []string{
+		"input protocol srt is not available",
+		"encoder libx265 is not available",
+		"filter zscale is not available",
+		"filter drawtext is not available",
+		"encoder libopus is not available",
+		"pixel format p010le is not available",
+		"muxer dash is not available",
+		"output protocol s3 is not available",
+	}
+	if got := missing(c, args); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestFilterNames(t *testing.T) {
+	graph := "[0:v]scale=640:-2[a];[a][1:v]overlay=10:10,drawtext=text='x, y; z':fontsize=24[out];[out]null@end"
+	want := []string{"scale", "overlay", "drawtext", "null"}
+	if got := filterNames(graph); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestCheckCapabilities(t *testing.T) {
+	capsMu.Lock()
+	old := caps
+	caps = &protocol.Capabilities{
+		Encoders: parseCodecs(encodersOutput),
+		Filters:  append(parseFilters(filtersOutput), "removegrain"),
+		Muxers:   parseFormats(muxersOutput),
+	}
+	capsMu.Unlock()
+	t.Cleanup(func() {
+		capsMu.Lock()
+		caps = old
+		capsMu.Unlock()
+	})
+
+	argv, _, err := Command(testFile, "out.mp4", `{"video":{"codec":"libx264"},"audio":{"codec":"aac"}}`, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckCapabilities(argv); err != nil {
+		t.Error(err)
+	}
+	argv, _, err = Command(testFile, "out.mp4", `{"video":{"codec":"libx265"},"audio":{"codec":"aac"}}`, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckCapabilities(argv); err == nil || err.Error() != "encoder libx265 is not available" {
+		t.Errorf("got %v", err)
+	}
+}
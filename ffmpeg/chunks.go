@@ -0,0 +1,353 @@
+package ffmpeg
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Chunk defaults.
+	chunkDuration = 60
+	chunkWorkers  = 4
+
+	// Times a failed chunk is encoded before the job fails.
+	chunkAttempts = 2
+
+	// Chunks start just before their keyframe, so timestamps rounded by
+	// ffprobe don't drop or repeat the frame at the boundary.
+	chunkMargin = 0.001
+
+	// Manifest of the chunk ranges and which are encoded, kept in the chunk
+	// directory so a failed job can resume.
+	chunkManifestFile = "chunks.json"
+
+	aggregateInterval = time.Millisecond * 500
+)
+
+// chunkOptions splits the input at keyframes and encodes the video in
+// parallel. Zero values use the defaults.
+type chunkOptions struct {
+	Duration float64 `json:"duration"` // Target seconds per chunk.
+	Workers  int     `json:"workers"`  // Chunks encoded at once.
+}
+
+// chunkManifest records the chunks of an encode.
+type chunkManifest struct {
+	Input   string  `json:"input"`
+	Payload string  `json:"payload"`
+	Chunks  []chunk `json:"chunks"`
+}
+
+// chunk is a range of the input encoded to its own file.
+type chunk struct {
+	Start    float64 `json:"start"`
+	Duration float64 `json:"duration"`
+	Frames   int     `json:"frames"`
+	Done     bool    `json:"done"`
+}
+
+// isChunked reports whether the options encode in chunks. Chunks need a
+// single output with video encoded on its own.
+func isChunked(opt *ffmpegOptions) bool {
+	if opt.Chunks == nil || isTwoPass(opt) || opt.Video.Codec == "copy" {
+		return false
+	}
+	return len(opt.Raw) == 0 && len(opt.Outputs) == 0 &&
+		opt.Format.Container != "hls" && opt.Format.Container != "dash" &&
+		!opt.Streams.isSet() && !opt.Subtitle.isSet()
+}
+
+// chunkDir returns the directory chunks of an output are written to.
+func chunkDir(output string) string {
+	return filepath.Join(filepath.Dir(output), "."+filepath.Base(output)+".chunks")
+}
+
+// runChunked encodes the video in chunks across a pool of ffmpeg processes,
+// then joins them without re-encoding and adds the audio. Encoded chunks are
+// kept if the job fails, and only the rest are encoded when it's rerun.
+func (f *FFmpeg) runChunked(input, output, data string, options *ffmpegOptions) error {
+	dir := chunkDir(output)
+	m, err := loadChunks(dir, input, data)
+	if err != nil {
+		return err
+	}
+
+	start, end, err := clipRange(input, options.Format)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		keyframes, err := FFProbe{}.Keyframes(input)
+		if err != nil {
+			return err
+		}
+		duration := options.Chunks.Duration
+		if duration <= 0 {
+			duration = chunkDuration
+		}
+		m = &chunkManifest{Input: input, Payload: data, Chunks: chunkRanges(keyframes, start, end, duration)}
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		if err := m.save(dir); err != nil {
+			return err
+		}
+	}
+
+	// Build the video encode once, then seek it to each chunk. Faststart is
+	// set when the chunks are joined.
+	faststart := options.Video.FastStart
+	options.Format.Clip = false
+	options.Video.FastStart = false
+	args, err := buildArgs(input, filepath.Join(dir, "chunk.mkv"), options)
+	if err != nil {
+		return err
+	}
+	options.Video.FastStart = faststart
+
+	workers := options.Chunks.Workers
+	if workers <= 0 {
+		workers = chunkWorkers
+	}
+
+	done := make(chan struct{})
+	go f.aggregateProgress(m, done)
+	var failed []error
+	for attempt := 0; attempt < chunkAttempts; attempt++ {
+		if failed = f.encodeChunks(dir, args, m, workers); len(failed) == 0 {
+			break
+		}
+	}
+	close(done)
+	if f.cancelled() {
+		return ErrCancelled
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d chunks failed, rerun the job to resume: %v", len(failed), len(m.Chunks), failed[0])
+	}
+
+	// Join the chunks and add the audio.
+	list := filepath.Join(dir, "chunks.ffconcat")
+	concat := concatOptions{}
+	for i := range m.Chunks {
+		concat.Inputs = append(concat.Inputs, concatInput{Input: chunkPath(dir, i)})
+	}
+	if err := writeConcatList(list, concat); err != nil {
+		return err
+	}
+	if err := f.run(chunkMuxArgs(list, input, output, start, end, options)); err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// encodeChunks encodes the chunks that aren't done with a pool of workers,
+// returning the errors of chunks that failed.
+func (f *FFmpeg) encodeChunks(dir string, args []string, m *chunkManifest, workers int) []error {
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	failed := []error{}
+
+	for n := 0; n < workers; n++ {
+		w := &FFmpeg{}
+		f.mu.Lock()
+		f.workers = append(f.workers, w)
+		f.mu.Unlock()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				c := m.Chunks[i]
+				chunkArgs := sampleArgs(args, sample{Start: c.Start, Duration: c.Duration})
+				chunkArgs[len(chunkArgs)-1] = chunkPath(dir, i)
+
+				err := w.run(chunkArgs)
+
+				// Move the worker's frames to the chunk in one step, so
+				// aggregateProgress doesn't count them twice.
+				frames := w.CurrentProgress().Frame
+				f.mu.Lock()
+				if err != nil {
+					failed = append(failed, fmt.Errorf("chunk %d: %v", i, err))
+				} else {
+					m.Chunks[i].Frames = frames
+					m.Chunks[i].Done = true
+					if err := m.save(dir); err != nil {
+						failed = append(failed, err)
+					}
+				}
+				w.resetProgress()
+				f.mu.Unlock()
+			}
+		}()
+	}
+
+	for i, c := range m.Chunks {
+		if c.Done || f.cancelled() {
+			continue
+		}
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.workers = nil
+	return failed
+}
+
+// aggregateProgress sums the progress of encoded chunks and the workers into
+// f.Progress until done is closed.
+func (f *FFmpeg) aggregateProgress(m *chunkManifest, done chan struct{}) {
+	ticker := time.NewTicker(aggregateInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			f.mu.Lock()
+			frames, outTime, fps, speed := 0, 0.0, 0.0, 0.0
+			for _, c := range m.Chunks {
+				if c.Done {
+					frames += c.Frames
+					outTime += c.Duration * 1e6
+				}
+			}
+			for _, w := range f.workers {
+				p := w.CurrentProgress()
+				frames += p.Frame
+				outTime += float64(p.OutTimeMS)
+				fps += p.FPS
+				s, _ := strconv.ParseFloat(strings.TrimSuffix(p.Speed, "x"), 64)
+				speed += s
+			}
+			f.Progress.Frame = frames
+			f.Progress.OutTimeMS = int(outTime)
+			f.Progress.FPS = math.Round(fps*100) / 100
+			f.Progress.Speed = fmt.Sprintf("%.2fx", speed)
+			f.mu.Unlock()
+		}
+	}
+}
+
+// chunkRanges splits the range from start to end at the first keyframe after
+// every duration seconds. A short last chunk is joined to the one before.
+func chunkRanges(keyframes []float64, start, end, duration float64) []chunk {
+	chunks := []chunk{}
+	from := start
+	for _, k := range keyframes {
+		if k-from < duration || end-k < duration/4 {
+			continue
+		}
+		at := k - chunkMargin
+		chunks = append(chunks, chunk{Start: from, Duration: roundSeconds(at - from)})
+		from = at
+	}
+	return append(chunks, chunk{Start: from, Duration: roundSeconds(end - from)})
+}
+
+// chunkMuxArgs builds the ffmpeg arguments joining the chunks with the audio
+// of the input range.
+func chunkMuxArgs(list, input, output string, start, end float64, opt *ffmpegOptions) []string {
+	args := []string{
+		"-hide_banner",
+		"-loglevel", "error",
+		"-progress", "pipe:1",
+		"-f", "concat",
+		"-safe", "0",
+		"-i", list,
+	}
+	if start > 0 {
+		args = append(args, "-ss", formatSeconds(start))
+	}
+	args = append(args, "-t", formatSeconds(roundSeconds(end-start)), "-i", input)
+	args = append(args, "-map", "0:v:0", "-map", "1:a?", "-c:v", "copy")
+
+	args = append(args, setAudioFlags(opt.Audio)...)
+	if af := setAudioFilters(opt.Audio, opt.Filter); af != "" {
+		args = append(args, "-af", af)
+	}
+	if opt.Video.FastStart {
+		args = append(args, "-movflags", "faststart")
+	}
+	return append(args, "-y", output)
+}
+
+// clipRange returns the range of the input to encode, in seconds.
+func clipRange(input string, format formatOptions) (float64, float64, error) {
+	probe, err := FFProbe{}.Run(input)
+	if err != nil {
+		return 0, 0, err
+	}
+	start, end := 0.0, probe.Duration()
+	if format.Clip {
+		if format.StartTime != "" {
+			if start, err = parseTimestamp(format.StartTime); err != nil {
+				return 0, 0, err
+			}
+		}
+		if format.StopTime != "" {
+			if end, err = parseTimestamp(format.StopTime); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+	if end <= start {
+		return 0, 0, fmt.Errorf("cannot split input, duration is unknown")
+	}
+	return start, end, nil
+}
+
+// loadChunks loads the manifest of a previous run of the same encode, or
+// returns nil if there isn't one. Chunks without a file are encoded again.
+func loadChunks(dir, input, data string) (*chunkManifest, error) {
+	b, err := os.ReadFile(filepath.Join(dir, chunkManifestFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m := &chunkManifest{}
+	if err := json.Unmarshal(b, m); err != nil || m.Input != input || m.Payload != data || len(m.Chunks) == 0 {
+		return nil, nil
+	}
+	for i := range m.Chunks {
+		if _, err := os.Stat(chunkPath(dir, i)); err != nil {
+			m.Chunks[i].Done = false
+		}
+	}
+	return m, nil
+}
+
+// save writes the manifest to the chunk directory.
+func (m *chunkManifest) save(dir string) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, chunkManifestFile), b, 0644)
+}
+
+func chunkPath(dir string, i int) string {
+	return filepath.Join(dir, fmt.Sprintf("chunk_%04d.mkv", i))
+}
+
+func roundSeconds(s float64) float64 {
+	return math.Round(s*1e6) / 1e6
+}
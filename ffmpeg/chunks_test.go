@@ -0,0 +1,76 @@
+package ffmpeg
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestChunkRanges(t *testing.T) {
+	keyframes := []float64{0, 20, 40, 60, 80, 100, 120, 140, 160, 180}
+
+	// Chunks split at the first keyframe after each 50 seconds, and the short
+	// last chunk is joined to the one before.
+	got := chunkRanges(keyframes, 0, 190, 50)
+	want := []chunk{{Start: 0, Duration: 59.999}, {Start: 59.999, Duration: 60}, {Start: 119.999, Duration: 70.001}}
+	if len(got) != len(want) {
+		t.Fatalf("got %v", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+
+	// Only keyframes in the clip range are used.
+	got = chunkRanges(keyframes, 30, 110, 30)
+	if len(got) != 3 || got[0] != (chunk{Start: 30, Duration: 29.999}) || got[2] != (chunk{Start: 99.999, Duration: 10.001}) {
+		t.Errorf("got %v", got)
+	}
+
+	// Inputs shorter than a chunk are encoded whole.
+	got = chunkRanges(keyframes, 0, 45, 60)
+	if len(got) != 1 || got[0] != (chunk{Start: 0, Duration: 45}) {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestParseKeyframes(t *testing.T) {
+	out := "2.002000,__\n0.000000,K_\n\n4.004000,K_\n3.003000,_D\n"
+	got := parseKeyframes(out)
+	if len(got) != 2 || got[0] != 0 || got[1] != 4.004 {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestChunkMuxArgs(t *testing.T) {
+	opt := &ffmpegOptions{
+		Video: videoOptions{Codec: "libx264", FastStart: true},
+		Audio: audioOptions{Codec: "aac", Quality: "128k", Volume: "50"},
+	}
+	got := strings.Join(chunkMuxArgs("chunks.ffconcat", "in.mp4", "out.mp4", 30, 110, opt), " ")
+	want := "-hide_banner -loglevel error -progress pipe:1 -f concat -safe 0 -i chunks.ffconcat " +
+		"-ss 30 -t 80 -i in.mp4 -map 0:v:0 -map 1:a? -c:v copy -c:a aac -b:a 128k -af volume=0.50 " +
+		"-movflags faststart -y out.mp4"
+	if got != want {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestIsChunked(t *testing.T) {
+	tests := []struct {
+		opt  ffmpegOptions
+		want bool
+	}{
+		{ffmpegOptions{Chunks: &chunkOptions{}}, true},
+		{ffmpegOptions{}, false},
+		{ffmpegOptions{Chunks: &chunkOptions{}, Video: videoOptions{Codec: "copy"}}, false},
+		{ffmpegOptions{Chunks: &chunkOptions{}, Video: videoOptions{Pass: "2"}}, false},
+		{ffmpegOptions{Chunks: &chunkOptions{}, Format: formatOptions{Container: "hls"}}, false},
+		{ffmpegOptions{Chunks: &chunkOptions{}, Outputs: []outputOptions{{}}}, false},
+	}
+	for i, tt := range tests {
+		if got := isChunked(&tt.opt); got != tt.want {
+			t.Errorf("%d: got %v, want %v", i, got, tt.want)
+		}
+	}
+}
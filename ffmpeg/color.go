@@ -0,0 +1,162 @@
+package ffmpeg
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Tonemapping algorithms supported by the tonemap filter.
+var tonemapAlgorithms = map[string]bool{
+	"none":     true,
+	"clip":     true,
+	"linear":   true,
+	"gamma":    true,
+	"reinhard": true,
+	"hable":    true,
+	"mobius":   true,
+}
+
+const tonemapAlgorithm = "hable"
+
+// colorOptions converts or tags the output colors.
+type colorOptions struct {
+	Tonemap   bool   `json:"tonemap"`   // Tonemap HDR inputs to SDR. SDR inputs are unchanged.
+	Algorithm string `json:"algorithm"` // hable, mobius, reinhard, clip, linear, gamma or none.
+	KeepHDR   bool   `json:"keep_hdr"`  // Keep HDR10 metadata when encoding HDR inputs with libx265.
+	Primaries string `json:"primaries"` // Output color_primaries, e.g. bt709 or bt2020.
+	Transfer  string `json:"transfer"`  // Output color_trc, e.g. bt709, smpte2084 or arib-std-b67.
+	Space     string `json:"space"`     // Output colorspace, e.g. bt709 or bt2020nc.
+	Range     string `json:"range"`     // Output color_range: tv or pc.
+
+	tonemap bool // Set if the input is HDR and tonemapped.
+}
+
+// needsProbe reports whether the options depend on the input colors.
+func (o colorOptions) needsProbe() bool {
+	return o.Tonemap || o.KeepHDR
+}
+
+// isHDR reports whether the video uses an HDR transfer function.
+func (s *stream) isHDR() bool {
+	return s.ColorTransfer == "smpte2084" || s.ColorTransfer == "arib-std-b67"
+}
+
+// setColor sets the tonemapping, output color tags and x265 HDR metadata for
+// the probed input.
+func setColor(opt *videoOptions, probe *FFProbeResponse) {
+	video := probe.videoStream()
+	if video == nil || !video.isHDR() {
+		return
+	}
+	c := &opt.Color
+
+	// Tonemap to SDR and tag the output as BT.709.
+	if c.Tonemap {
+		c.tonemap = true
+		c.Primaries = defaultString(c.Primaries, "bt709")
+		c.Transfer = defaultString(c.Transfer, "bt709")
+		c.Space = defaultString(c.Space, "bt709")
+		c.Range = defaultString(c.Range, "tv")
+		return
+	}
+
+	// Keep the input colors and HDR10 metadata.
+	if c.KeepHDR && opt.Codec == "libx265" {
+		c.Primaries = defaultString(c.Primaries, video.ColorPrimaries)
+		c.Transfer = defaultString(c.Transfer, video.ColorTransfer)
+		c.Space = defaultString(c.Space, video.ColorSpace)
+		c.Range = defaultString(c.Range, video.ColorRange)
+		if opt.PixelFormat == "" || opt.PixelFormat == "auto" {
+			opt.PixelFormat = "yuv420p10le"
+		}
+
+		params := x265HDRParams(c, video)
+		if opt.CodecOptions != "" {
+			params = append([]string{opt.CodecOptions}, params...)
+		}
+		opt.CodecOptions = strings.Join(params, ":")
+	}
+}
+
+// setTonemap returns the zscale and tonemap filters converting HDR to SDR.
+func setTonemap(opt colorOptions) string {
+	algorithm := opt.Algorithm
+	if !tonemapAlgorithms[algorithm] {
+		algorithm = tonemapAlgorithm
+	}
+	return "zscale=t=linear:npl=100,format=gbrpf32le,zscale=p=bt709," +
+		"tonemap=tonemap=" + algorithm + ":desat=0," +
+		"zscale=t=bt709:m=bt709:r=tv,format=yuv420p"
+}
+
+// setColorFlags tags the output colors.
+func setColorFlags(opt colorOptions) []string {
+	args := []string{}
+	if opt.Primaries != "" {
+		args = append(args, "-color_primaries", opt.Primaries)
+	}
+	if opt.Transfer != "" {
+		args = append(args, "-color_trc", opt.Transfer)
+	}
+	if opt.Space != "" {
+		args = append(args, "-colorspace", opt.Space)
+	}
+	if opt.Range != "" {
+		args = append(args, "-color_range", opt.Range)
+	}
+	return args
+}
+
+// x265HDRParams returns the x265 params signalling HDR10, with the mastering
+// display and content light levels of the input if it has them.
+func x265HDRParams(opt *colorOptions, video *stream) []string {
+	params := []string{"hdr-opt=1", "repeat-headers=1"}
+	if opt.Primaries != "" {
+		params = append(params, "colorprim="+opt.Primaries)
+	}
+	if opt.Transfer != "" {
+		params = append(params, "transfer="+opt.Transfer)
+	}
+	if opt.Space != "" {
+		params = append(params, "colormatrix="+opt.Space)
+	}
+
+	for _, d := range video.SideDataList {
+		switch d.SideDataType {
+		case "Mastering display metadata":
+			// Chromaticities are in 0.00002 units, luminance in 0.0001 cd/m2.
+			params = append(params, fmt.Sprintf("master-display=G(%d,%d)B(%d,%d)R(%d,%d)WP(%d,%d)L(%d,%d)",
+				scaleRational(d.GreenX, 50000), scaleRational(d.GreenY, 50000),
+				scaleRational(d.BlueX, 50000), scaleRational(d.BlueY, 50000),
+				scaleRational(d.RedX, 50000), scaleRational(d.RedY, 50000),
+				scaleRational(d.WhitePointX, 50000), scaleRational(d.WhitePointY, 50000),
+				scaleRational(d.MaxLuminance, 10000), scaleRational(d.MinLuminance, 10000)))
+		case "Content light level metadata":
+			params = append(params, fmt.Sprintf("max-cll=%d,%d", d.MaxContent, d.MaxAverage))
+		}
+	}
+	return params
+}
+
+// scaleRational converts a rational such as 34000/50000 into units of
+// 1/scale.
+func scaleRational(r string, scale int) int {
+	parts := strings.SplitN(r, "/", 2)
+	num, _ := strconv.ParseFloat(parts[0], 64)
+	den := 1.0
+	if len(parts) == 2 {
+		den, _ = strconv.ParseFloat(parts[1], 64)
+	}
+	if den == 0 {
+		return 0
+	}
+	return int(num/den*float64(scale) + 0.5)
+}
+
+func defaultString(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
@@ -0,0 +1,70 @@
+package ffmpeg
+
+import (
+	"strings"
+	"testing"
+)
+
+var testHDRProbe = &FFProbeResponse{
+	Streams: []stream{{
+		CodecType:      "video",
+		ColorRange:     "tv",
+		ColorSpace:     "bt2020nc",
+		ColorTransfer:  "smpte2084",
+		ColorPrimaries: "bt2020",
+		SideDataList: []sideData{
+			{
+				SideDataType: "Mastering display metadata",
+				RedX:         "34000/50000", RedY: "16000/50000",
+				GreenX: "13250/50000", GreenY: "34500/50000",
+				BlueX: "7500/50000", BlueY: "3000/50000",
+				WhitePointX: "15635/50000", WhitePointY: "16450/50000",
+				MinLuminance: "50/10000", MaxLuminance: "10000000/10000",
+			},
+			{SideDataType: "Content light level metadata", MaxContent: 1000, MaxAverage: 400},
+		},
+	}},
+}
+
+func TestSetColorTonemap(t *testing.T) {
+	opt := videoOptions{Codec: "libx264", Color: colorOptions{Tonemap: true, Algorithm: "mobius"}}
+	setColor(&opt, testHDRProbe)
+
+	vf := setVideoFilters(opt, filterOptions{Denoise: "none", Deinterlace: "none"})
+	want := "zscale=t=linear:npl=100,format=gbrpf32le,zscale=p=bt709,tonemap=tonemap=mobius:desat=0,zscale=t=bt709:m=bt709:r=tv,format=yuv420p"
+	if vf != want {
+		t.Errorf("got %s, want %s", vf, want)
+	}
+
+	flags := strings.Join(setVideoFlags(opt), " ")
+	if !strings.Contains(flags, "-color_primaries bt709 -color_trc bt709 -colorspace bt709 -color_range tv") {
+		t.Errorf("missing color tags: %s", flags)
+	}
+
+	// SDR inputs are unchanged.
+	sdr := &FFProbeResponse{Streams: []stream{{CodecType: "video", ColorTransfer: "bt709"}}}
+	opt = videoOptions{Color: colorOptions{Tonemap: true}}
+	setColor(&opt, sdr)
+	if opt.Color.tonemap || len(setColorFlags(opt.Color)) > 0 {
+		t.Errorf("unexpected color options for SDR input: %+v", opt.Color)
+	}
+}
+
+func TestSetColorKeepHDR(t *testing.T) {
+	opt := videoOptions{Codec: "libx265", CodecOptions: "aq-mode=3", Color: colorOptions{KeepHDR: true}}
+	setColor(&opt, testHDRProbe)
+
+	want := "aq-mode=3:hdr-opt=1:repeat-headers=1:colorprim=bt2020:transfer=smpte2084:colormatrix=bt2020nc:" +
+		"master-display=G(13250,34500)B(7500,3000)R(34000,16000)WP(15635,16450)L(10000000,50):max-cll=1000,400"
+	if opt.CodecOptions != want {
+		t.Errorf("got %s, want %s", opt.CodecOptions, want)
+	}
+	if opt.PixelFormat != "yuv420p10le" {
+		t.Errorf("got pixel format %s", opt.PixelFormat)
+	}
+
+	flags := strings.Join(setVideoFlags(opt), " ")
+	if !strings.Contains(flags, "-color_primaries bt2020 -color_trc smpte2084 -colorspace bt2020nc -color_range tv -x265-params "+want) {
+		t.Errorf("unexpected flags: %s", flags)
+	}
+}
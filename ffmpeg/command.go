@@ -0,0 +1,246 @@
+package ffmpeg
+
+import (
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Characters that don't need quoting in a POSIX shell.
+var shellSafe = regexp.MustCompile(`^[A-Za-z0-9_\-+=/.,:@%]+$`)
+
+// Command returns the ffmpeg argv generated for a payload without running
+// ffmpeg, along with warnings about options that won't behave as expected.
+// The collision policy is applied to outputs written in place as Run does.
+func Command(input, output, data, policy string) ([]string, []string, error) {
+	options, err := decodeOptions(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	options.noOverwrite = !overwrites(input, output, data, policy)
+
+	// Two-pass encodes show the second pass.
+	twoPass := isTwoPass(options)
+	if twoPass && options.Video.Pass == "size" {
+		if _, err := setTargetBitrate(input, options); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := dropMissingAudio(input, options); err != nil {
+		return nil, nil, err
+	}
+	args, err := buildArgs(input, output, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	if twoPass {
+		args = passArgs(args, options.Video.Codec, 2, passLogFile)
+	}
+
+	options, err = decodeOptions(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	argv := append([]string{ffmpegCmd}, args...)
+	warnings := validateOptions(input, output, options)
+	if c := loadedCapabilities(); c != nil {
+		warnings = append(warnings, missing(c, args)...)
+	}
+	return argv, warnings, nil
+}
+
+// ShellQuote joins argv into a string that can be pasted into a POSIX shell.
+func ShellQuote(argv []string) string {
+	quoted := make([]string, len(argv))
+	for i, arg := range argv {
+		if shellSafe.MatchString(arg) {
+			quoted[i] = arg
+		} else {
+			quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+// validateOptions returns warnings for options that are ignored or will cause
+// ffmpeg to fail.
+func validateOptions(input, output string, opt *ffmpegOptions) []string {
+	warnings := []string{}
+
+	if len(opt.Raw) > 0 {
+		return append(warnings, "raw options are set, all other options are ignored")
+	}
+
+	if (opt.Streams.isSet() || opt.Subtitle.isSet()) && (len(opt.Outputs) > 0 || opt.Format.Container == "hls" || opt.Format.Container == "dash") {
+		warnings = append(warnings, "streams and subtitle options are ignored with multiple outputs, hls and dash")
+	}
+
+	if opt.Quality != nil {
+		if _, err := qualityMetrics(opt.Quality.Metrics); err != nil {
+			warnings = append(warnings, err.Error()+", quality will not be measured")
+		}
+	}
+
+	if opt.Chunks != nil && !isChunked(opt) {
+		warnings = append(warnings, "chunks are ignored with multiple outputs, hls, dash, 2 pass, video codec copy, streams and subtitle options")
+	} else if opt.Chunks != nil {
+		warnings = append(warnings, "chunked encoding runs an ffmpeg process per chunk and joins them, which is not included in the command")
+	}
+
+	if len(opt.Outputs) > 0 {
+		return append(warnings, validateOutputs(input, opt)...)
+	}
+
+	if input == output {
+		warnings = append(warnings, "output is the same file as input")
+	}
+
+	// Container.
+	ext := strings.TrimPrefix(filepath.Ext(output), ".")
+	if opt.Format.Container == "hls" {
+		if ext != "" && ext != "m3u8" {
+			warnings = append(warnings, "hls output should be a directory or an .m3u8 playlist")
+		}
+	} else if opt.Format.Container == "dash" {
+		if ext != "" && ext != "mpd" {
+			warnings = append(warnings, "dash output should be a directory or an .mpd manifest")
+		}
+	} else if opt.Format.Container != "" && ext != "" && ext != opt.Format.Container {
+		warnings = append(warnings, "output extension ."+ext+" does not match container "+opt.Format.Container)
+	}
+
+	// Clip.
+	if opt.Format.Clip && opt.Format.StartTime == "" && opt.Format.StopTime == "" {
+		warnings = append(warnings, "clip is enabled but no start or stop time is set")
+	}
+
+	// Rate control.
+	if opt.Video.Crf != 0 && opt.Video.Pass != "crf" {
+		warnings = append(warnings, "crf is only applied when pass is \"crf\"")
+	}
+
+	if opt.Video.Pass == "2" || opt.Video.Pass == "size" {
+		if opt.Format.Container == "hls" || opt.Format.Container == "dash" {
+			warnings = append(warnings, "2 pass encoding is not supported for "+opt.Format.Container)
+		} else {
+			warnings = append(warnings, "2 pass encoding runs a first pass with -pass 1 that is not included in the command")
+		}
+	}
+	if opt.Video.Pass == "2" && (opt.Video.Bitrate == "" || opt.Video.Bitrate == "0") {
+		warnings = append(warnings, "2 pass encoding requires a bitrate")
+	}
+	if opt.Video.TargetSize != "" && opt.Video.Pass != "size" {
+		warnings = append(warnings, "target_size is only applied when pass is \"size\"")
+	}
+	if opt.Video.Pass == "size" {
+		if opt.Video.Bitrate != "" && opt.Video.Bitrate != "0" {
+			warnings = append(warnings, "bitrate is computed from target_size and is ignored")
+		}
+		if opt.Video.Codec == "copy" {
+			warnings = append(warnings, "target_size cannot be used with video codec copy")
+		}
+	}
+
+	if (opt.Format.Container == "hls" || opt.Format.Container == "dash") && opt.Video.FastStart {
+		warnings = append(warnings, "faststart is ignored for "+opt.Format.Container)
+	}
+
+	// Codec params.
+	if opt.Video.CodecOptions != "" && opt.Video.Codec != "libx264" && opt.Video.Codec != "libx265" {
+		warnings = append(warnings, "codec_options are only applied to libx264 and libx265")
+	}
+
+	// Color.
+	if opt.Video.Color.Tonemap && opt.Video.Codec == "copy" {
+		warnings = append(warnings, "tonemap cannot be used with video codec copy")
+	}
+	if opt.Video.Color.Tonemap && opt.Video.Color.KeepHDR {
+		warnings = append(warnings, "keep_hdr is ignored when tonemapping")
+	} else if opt.Video.Color.KeepHDR && opt.Video.Codec != "libx265" {
+		warnings = append(warnings, "keep_hdr is only applied with libx265")
+	}
+
+	// Scale.
+	if opt.Video.Size == "custom" && (opt.Video.Width == "" || opt.Video.Height == "") {
+		warnings = append(warnings, "custom size requires both width and height")
+	}
+
+	// Geometry.
+	if opt.Filter.Crop == "auto" {
+		warnings = append(warnings, "crop is detected when the job runs and is not included in the command")
+	}
+	switch opt.Filter.Rotate {
+	case "", "0", "90", "180", "270", "-90", "-180", "-270":
+	default:
+		warnings = append(warnings, "rotate must be 90, 180 or 270 and is ignored")
+	}
+	if _, ok := padRatio(opt.Filter.Pad); opt.Filter.Pad != "" && !ok {
+		warnings = append(warnings, "pad must be an aspect ratio such as 16:9 and is ignored")
+	}
+
+	// Overlays.
+	if opt.Filter.Watermark != nil && opt.Filter.Watermark.Image == "" {
+		warnings = append(warnings, "watermark is set without an image and is ignored")
+	}
+
+	// Filters can't be used when copying streams.
+	if opt.Video.Codec == "copy" && setVideoFilters(opt.Video, opt.Filter) != "" {
+		warnings = append(warnings, "video filters cannot be used with video codec copy")
+	}
+
+	if opt.Video.Codec == "copy" && (opt.Subtitle.BurnIn != nil || opt.Subtitle.BurnInFile != "") {
+		warnings = append(warnings, "subtitles cannot be burned in with video codec copy")
+	}
+
+	if opt.Audio.Codec == "copy" && setAudioFilters(opt.Audio, opt.Filter) != "" {
+		warnings = append(warnings, "audio filters cannot be used with audio codec copy")
+	}
+
+	// Subtitles.
+	container := opt.Format.Container
+	if container == "" {
+		container = ext
+	}
+	if opt.Streams.Subtitles == "copy" && (container == "mp4" || container == "mov" || container == "webm") {
+		warnings = append(warnings, "copied subtitles may not be supported by "+container+", use \"auto\" to convert them")
+	}
+
+	return warnings
+}
+
+// validateOutputs returns warnings for a multi-output job.
+func validateOutputs(input string, opt *ffmpegOptions) []string {
+	warnings := []string{}
+	seen := map[string]bool{}
+
+	for i, o := range opt.Outputs {
+		n := strconv.Itoa(i)
+
+		// Packaged renditions are written to the job output instead.
+		if opt.Format.Container != "hls" && opt.Format.Container != "dash" {
+			if o.Output == "" {
+				warnings = append(warnings, "outputs["+n+"] has no output path")
+			}
+			if o.Output == input {
+				warnings = append(warnings, "outputs["+n+"] is the same file as input")
+			}
+			if seen[o.Output] {
+				warnings = append(warnings, "outputs["+n+"] writes to the same file as another output")
+			}
+			seen[o.Output] = true
+		}
+
+		if o.Video.Crf != 0 && o.Video.Pass != "crf" {
+			warnings = append(warnings, "outputs["+n+"] crf is only applied when pass is \"crf\"")
+		}
+		if o.Video.Pass == "2" || o.Video.Pass == "size" {
+			warnings = append(warnings, "outputs["+n+"] 2 pass encoding is not supported with multiple outputs")
+		}
+		if o.Audio.Codec == "copy" && setAudioFilters(o.Audio, o.Filter) != "" {
+			warnings = append(warnings, "outputs["+n+"] audio filters cannot be used with audio codec copy")
+		}
+	}
+	return warnings
+}
@@ -0,0 +1,44 @@
+package ffmpeg
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCommand(t *testing.T) {
+	argv, warnings, err := Command(testFile, "out.mp4", testPayload, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := strings.Join(argv, " ")
+	if !strings.HasPrefix(cmd, "ffmpeg -hide_banner") {
+		t.Errorf("unexpected command: %s", cmd)
+	}
+	if !strings.Contains(cmd, "-i "+testFile+" -c:v libx264") {
+		t.Errorf("unexpected command: %s", cmd)
+	}
+	if !strings.HasSuffix(cmd, "-y out.mp4") {
+		t.Errorf("unexpected command: %s", cmd)
+	}
+
+	// testPayload sets crf without pass "crf".
+	if len(warnings) != 1 {
+		t.Errorf("unexpected warnings: %v", warnings)
+	}
+}
+
+func TestCommandInvalidPayload(t *testing.T) {
+	_, _, err := Command(testFile, "out.mp4", "{", "")
+	if err == nil {
+		t.Error()
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	got := ShellQuote([]string{"ffmpeg", "-i", "my file's.mp4", "-vf", "scale=-1:720", ""})
+	want := `ffmpeg -i 'my file'\''s.mp4' -vf scale=-1:720 ''`
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
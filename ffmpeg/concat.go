@@ -0,0 +1,363 @@
+package ffmpeg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// concatOptions struct passed into FFmpeg.RunConcat.
+type concatOptions struct {
+	Inputs []concatInput `json:"inputs"` // Sources in output order.
+	Mode   string        `json:"mode"`   // auto, copy or encode. Auto copies if the codecs match.
+	Video  videoOptions  `json:"video"`  // Used when encoding.
+	Audio  audioOptions  `json:"audio"`  // Used when encoding.
+}
+
+// concatInput is an input, or a range of one.
+type concatInput struct {
+	Input     string `json:"input"`     // Defaults to the job input.
+	StartTime string `json:"startTime"` // In point.
+	StopTime  string `json:"stopTime"`  // Out point.
+}
+
+// RunConcat concatenates the inputs. Inputs with matching codecs are stream
+// copied with the concat demuxer, others are encoded with the concat filter.
+func (f *FFmpeg) RunConcat(input, output, data string) error {
+	opt, err := decodeConcatOptions(input, data)
+	if err != nil {
+		return err
+	}
+	probes, err := probeConcatInputs(opt)
+	if err != nil {
+		return err
+	}
+
+	streamCopy, err := concatCopy(opt, probes)
+	if err != nil {
+		return err
+	}
+	if !streamCopy {
+		args, err := concatFilterArgs(output, opt, probes)
+		if err != nil {
+			return err
+		}
+		return f.run(args)
+	}
+
+	dir, err := os.MkdirTemp("", "ffmpegd-concat")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	list := filepath.Join(dir, "list.txt")
+	if err := writeConcatList(list, opt); err != nil {
+		return err
+	}
+	return f.run(concatCopyArgs(list, output))
+}
+
+// ConcatCommand returns the ffmpeg argv of a concat job without running it.
+// Stream copies read a list of the inputs written when the job runs, shown
+// here as list.txt.
+func ConcatCommand(input, output, data string) ([]string, error) {
+	opt, err := decodeConcatOptions(input, data)
+	if err != nil {
+		return nil, err
+	}
+	probes, err := probeConcatInputs(opt)
+	if err != nil {
+		return nil, err
+	}
+
+	streamCopy, err := concatCopy(opt, probes)
+	if err != nil {
+		return nil, err
+	}
+	args := concatCopyArgs("list.txt", output)
+	if !streamCopy {
+		if args, err = concatFilterArgs(output, opt, probes); err != nil {
+			return nil, err
+		}
+	}
+	return append([]string{ffmpegCmd}, args...), nil
+}
+
+// ConcatProbe probes the concat inputs, returning the probe of the first input
+// with the total duration and size of the concatenated ranges.
+func ConcatProbe(input, data string) (*FFProbeResponse, error) {
+	opt, err := decodeConcatOptions(input, data)
+	if err != nil {
+		return nil, err
+	}
+	probes, err := probeConcatInputs(opt)
+	if err != nil {
+		return nil, err
+	}
+
+	var duration float64
+	var size int64
+	for _, in := range opt.Inputs {
+		d, err := rangeDuration(in, probes[in.Input])
+		if err != nil {
+			return nil, err
+		}
+		duration += d
+	}
+	for _, p := range probes {
+		s, _ := strconv.ParseInt(p.Format.Size, 10, 64)
+		size += s
+	}
+
+	probe := *probes[opt.Inputs[0].Input]
+	probe.Format.Duration = formatSeconds(duration)
+	probe.Format.Size = strconv.FormatInt(size, 10)
+	return &probe, nil
+}
+
+// decodeConcatOptions decodes the payload, defaulting inputs to the job input.
+func decodeConcatOptions(input, data string) (concatOptions, error) {
+	opt := concatOptions{}
+	if data != "" {
+		if err := json.Unmarshal([]byte(data), &opt); err != nil {
+			return opt, err
+		}
+	}
+	if len(opt.Inputs) == 0 {
+		return opt, errors.New("concat requires a list of inputs")
+	}
+
+	for i := range opt.Inputs {
+		if opt.Inputs[i].Input == "" {
+			opt.Inputs[i].Input = input
+		}
+		if opt.Inputs[i].Input == "" {
+			return opt, errors.New("inputs[" + strconv.Itoa(i) + "] has no input")
+		}
+	}
+
+	switch opt.Mode {
+	case "", "auto", "copy", "encode":
+	default:
+		return opt, errors.New("unknown concat mode: " + opt.Mode)
+	}
+	return opt, nil
+}
+
+// probeConcatInputs probes each distinct input.
+func probeConcatInputs(opt concatOptions) (map[string]*FFProbeResponse, error) {
+	probes := map[string]*FFProbeResponse{}
+	for _, in := range opt.Inputs {
+		if probes[in.Input] != nil {
+			continue
+		}
+		p, err := FFProbe{}.Run(in.Input)
+		if err != nil {
+			return nil, err
+		}
+		probes[in.Input] = p
+	}
+	return probes, nil
+}
+
+// concatCopy reports whether the inputs are stream copied, which requires
+// matching codecs.
+func concatCopy(opt concatOptions, probes map[string]*FFProbeResponse) (bool, error) {
+	if opt.Mode == "encode" {
+		return false, nil
+	}
+	if opt.Mode == "" || opt.Mode == "auto" {
+		if opt.Video.Codec != "" && opt.Video.Codec != "copy" || opt.Audio.Codec != "" && opt.Audio.Codec != "copy" {
+			return false, nil
+		}
+	}
+
+	match := true
+	first := streamsSignature(probes[opt.Inputs[0].Input])
+	for _, in := range opt.Inputs[1:] {
+		if streamsSignature(probes[in.Input]) != first {
+			match = false
+			break
+		}
+	}
+
+	if opt.Mode == "copy" && !match {
+		return false, errors.New("inputs have different codecs and cannot be stream copied")
+	}
+	return match, nil
+}
+
+// streamsSignature describes the codec parameters that must match for the
+// concat demuxer.
+func streamsSignature(probe *FFProbeResponse) string {
+	sig := []string{}
+	for _, s := range probe.Streams {
+		switch s.CodecType {
+		case "video":
+			if s.Disposition.AttachedPic == 0 {
+				sig = append(sig, fmt.Sprintf("v:%s:%dx%d:%s", s.CodecName, s.Width, s.Height, s.PixFmt))
+			}
+		case "audio":
+			sig = append(sig, fmt.Sprintf("a:%s:%s:%d", s.CodecName, s.SampleRate, s.Channels))
+		}
+	}
+	return strings.Join(sig, ",")
+}
+
+// writeConcatList writes a concat demuxer script with the in and out point
+// of each input.
+func writeConcatList(path string, opt concatOptions) error {
+	var b strings.Builder
+	b.WriteString("ffconcat version 1.0\n")
+	for _, in := range opt.Inputs {
+		abs, err := filepath.Abs(in.Input)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&b, "file '%s'\n", strings.ReplaceAll(abs, "'", `'\''`))
+		if in.StartTime != "" {
+			fmt.Fprintf(&b, "inpoint %s\n", in.StartTime)
+		}
+		if in.StopTime != "" {
+			fmt.Fprintf(&b, "outpoint %s\n", in.StopTime)
+		}
+	}
+	return os.WriteFile(path, []byte(b.String()), 0644)
+}
+
+// concatCopyArgs builds the ffmpeg arguments to stream copy a concat list.
+func concatCopyArgs(list, output string) []string {
+	return []string{
+		"-hide_banner",
+		"-loglevel", "error",
+		"-progress", "pipe:1",
+		"-f", "concat",
+		"-safe", "0",
+		"-i", list,
+		"-map", "0",
+		"-c", "copy",
+		"-y", output,
+	}
+}
+
+// concatFilterArgs builds the ffmpeg arguments to encode the inputs through
+// the concat filter. Video is scaled and padded to the size of the first
+// input. Video or audio is dropped unless every input has that stream type.
+func concatFilterArgs(output string, opt concatOptions, probes map[string]*FFProbeResponse) ([]string, error) {
+	if opt.Video.Codec == "copy" || opt.Audio.Codec == "copy" {
+		return nil, errors.New("the concat filter cannot be used with codec copy")
+	}
+
+	args := []string{
+		"-hide_banner",
+		"-loglevel", "error",
+		"-progress", "pipe:1",
+	}
+
+	video, audio := true, true
+	for _, in := range opt.Inputs {
+		if probes[in.Input].videoStream() == nil {
+			video = false
+		}
+		if len(probes[in.Input].audioStreams()) == 0 {
+			audio = false
+		}
+	}
+	if !video && !audio {
+		return nil, errors.New("inputs have no common stream type to concatenate")
+	}
+
+	first := probes[opt.Inputs[0].Input]
+	width, height := 0, 0
+	if v := first.videoStream(); v != nil {
+		width, height = v.Width, v.Height
+	}
+	sampleRate := defaultSampleRate
+	if a := first.audioStreams(); len(a) > 0 && a[0].SampleRate != "" {
+		sampleRate = a[0].SampleRate
+	}
+
+	graph := []string{}
+	pads := ""
+	for i, in := range opt.Inputs {
+		if in.StartTime != "" {
+			args = append(args, "-ss", in.StartTime)
+		}
+		if in.StopTime != "" {
+			args = append(args, "-to", in.StopTime)
+		}
+		args = append(args, "-i", in.Input)
+
+		n := strconv.Itoa(i)
+		if video {
+			graph = append(graph, fmt.Sprintf("[%s:v:0]scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,setsar=1[v%s]",
+				n, width, height, width, height, n))
+			pads += "[v" + n + "]"
+		}
+		if audio {
+			graph = append(graph, "["+n+":a:0]aresample="+sampleRate+"[a"+n+"]")
+			pads += "[a" + n + "]"
+		}
+	}
+
+	concat := fmt.Sprintf("%sconcat=n=%d:v=%d:a=%d", pads, len(opt.Inputs), boolInt(video), boolInt(audio))
+	maps := []string{}
+	if video {
+		concat += "[v]"
+		maps = append(maps, "-map", "[v]")
+	}
+	if audio {
+		concat += "[a]"
+		maps = append(maps, "-map", "[a]")
+	}
+	graph = append(graph, concat)
+
+	args = append(args, "-filter_complex", strings.Join(graph, ";"))
+	args = append(args, maps...)
+	args = append(args, setVideoFlags(opt.Video)...)
+	args = append(args, setAudioFlags(opt.Audio)...)
+	return append(args, "-y", output), nil
+}
+
+// rangeDuration returns the length of an input range in seconds.
+func rangeDuration(in concatInput, probe *FFProbeResponse) (float64, error) {
+	start, stop := 0.0, probe.Duration()
+	var err error
+	if in.StartTime != "" {
+		if start, err = parseTimestamp(in.StartTime); err != nil {
+			return 0, err
+		}
+	}
+	if in.StopTime != "" {
+		if stop, err = parseTimestamp(in.StopTime); err != nil {
+			return 0, err
+		}
+	}
+	return math.Max(stop-start, 0), nil
+}
+
+// parseTimestamp parses seconds or [HH:]MM:SS[.m] into seconds.
+func parseTimestamp(s string) (float64, error) {
+	var seconds float64
+	for _, part := range strings.Split(s, ":") {
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return 0, errors.New("invalid timestamp: " + s)
+		}
+		seconds = seconds*60 + v
+	}
+	return seconds, nil
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,140 @@
+package ffmpeg
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testConcatProbes = map[string]*FFProbeResponse{
+	"a.mp4": {
+		Streams: []stream{
+			{CodecType: "video", CodecName: "h264", Width: 1920, Height: 1080, PixFmt: "yuv420p"},
+			{CodecType: "audio", CodecName: "aac", SampleRate: "48000", Channels: 2},
+		},
+		Format: format{Duration: "60"},
+	},
+	"b.mp4": {
+		Streams: []stream{
+			{CodecType: "video", CodecName: "h264", Width: 1920, Height: 1080, PixFmt: "yuv420p"},
+			{CodecType: "audio", CodecName: "aac", SampleRate: "48000", Channels: 2},
+		},
+		Format: format{Duration: "30"},
+	},
+	"c.mkv": {
+		Streams: []stream{
+			{CodecType: "video", CodecName: "hevc", Width: 1280, Height: 720, PixFmt: "yuv420p10le"},
+		},
+		Format: format{Duration: "10"},
+	},
+}
+
+func TestDecodeConcatOptions(t *testing.T) {
+	opt, err := decodeConcatOptions("a.mp4", `{"inputs":[{"startTime":"5","stopTime":"10"},{"input":"b.mp4"},{"startTime":"00:00:20"}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opt.Inputs[0].Input != "a.mp4" || opt.Inputs[1].Input != "b.mp4" || opt.Inputs[2].Input != "a.mp4" {
+		t.Errorf("unexpected inputs: %+v", opt.Inputs)
+	}
+
+	for _, data := range []string{`{}`, `{"inputs":[{}],"mode":"fast"}`} {
+		if _, err := decodeConcatOptions("a.mp4", data); err == nil {
+			t.Errorf("expected error for %s", data)
+		}
+	}
+	if _, err := decodeConcatOptions("", `{"inputs":[{}]}`); err == nil {
+		t.Error("expected error for input without a path")
+	}
+}
+
+func TestConcatCopy(t *testing.T) {
+	tests := []struct {
+		opt  concatOptions
+		want bool
+	}{
+		{concatOptions{Inputs: []concatInput{{Input: "a.mp4"}, {Input: "b.mp4"}}}, true},
+		{concatOptions{Inputs: []concatInput{{Input: "a.mp4"}, {Input: "c.mkv"}}}, false},
+		{concatOptions{Inputs: []concatInput{{Input: "a.mp4"}, {Input: "b.mp4"}}, Mode: "encode"}, false},
+		{concatOptions{Inputs: []concatInput{{Input: "a.mp4"}, {Input: "b.mp4"}}, Video: videoOptions{Codec: "libx264"}}, false},
+	}
+	for _, tt := range tests {
+		got, err := concatCopy(tt.opt, testConcatProbes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%+v: got %v, want %v", tt.opt, got, tt.want)
+		}
+	}
+
+	opt := concatOptions{Inputs: []concatInput{{Input: "a.mp4"}, {Input: "c.mkv"}}, Mode: "copy"}
+	if _, err := concatCopy(opt, testConcatProbes); err == nil {
+		t.Error("expected error copying mismatched codecs")
+	}
+}
+
+func TestWriteConcatList(t *testing.T) {
+	list := filepath.Join(t.TempDir(), "list.txt")
+	opt := concatOptions{Inputs: []concatInput{
+		{Input: "/media/a.mp4", StartTime: "5", StopTime: "10"},
+		{Input: "/media/it's.mp4"},
+	}}
+	if err := writeConcatList(list, opt); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "ffconcat version 1.0\nfile '/media/a.mp4'\ninpoint 5\noutpoint 10\nfile '/media/it'\\''s.mp4'\n"
+	if string(b) != want {
+		t.Errorf("got %q, want %q", b, want)
+	}
+}
+
+func TestConcatFilterArgs(t *testing.T) {
+	opt := concatOptions{
+		Inputs: []concatInput{{Input: "a.mp4", StopTime: "5"}, {Input: "c.mkv"}},
+		Video:  videoOptions{Codec: "libx264"},
+	}
+	args, err := concatFilterArgs("out.mp4", opt, testConcatProbes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "-to 5 -i a.mp4 -i c.mkv -filter_complex " +
+		"[0:v:0]scale=1920:1080:force_original_aspect_ratio=decrease,pad=1920:1080:(ow-iw)/2:(oh-ih)/2,setsar=1[v0];" +
+		"[1:v:0]scale=1920:1080:force_original_aspect_ratio=decrease,pad=1920:1080:(ow-iw)/2:(oh-ih)/2,setsar=1[v1];" +
+		"[v0][v1]concat=n=2:v=1:a=0[v] -map [v] -c:v libx264 -y out.mp4"
+	if got := strings.Join(args, " "); !strings.HasSuffix(got, want) {
+		t.Errorf("got %s, want suffix %s", got, want)
+	}
+}
+
+func TestRangeDuration(t *testing.T) {
+	tests := []struct {
+		in   concatInput
+		want float64
+	}{
+		{concatInput{}, 60},
+		{concatInput{StartTime: "50"}, 10},
+		{concatInput{StartTime: "00:00:10.5", StopTime: "1:00"}, 49.5},
+		{concatInput{StartTime: "30", StopTime: "20"}, 0},
+	}
+	for _, tt := range tests {
+		got, err := rangeDuration(tt.in, testConcatProbes["a.mp4"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%+v: got %v, want %v", tt.in, got, tt.want)
+		}
+	}
+
+	if _, err := parseTimestamp("1:xx"); err == nil {
+		t.Error("expected error for invalid timestamp")
+	}
+}
@@ -0,0 +1,249 @@
+package ffmpeg
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"os"
+	"path/filepath"
+)
+
+// CRF search defaults.
+const (
+	crfSearchTarget         = 95
+	crfSearchMin            = 16
+	crfSearchMax            = 40
+	crfSearchSamples        = 4
+	crfSearchSampleDuration = 10
+)
+
+// crfSearchOptions sets the quality target and sampling of a CRF search.
+// Zero values use the defaults.
+type crfSearchOptions struct {
+	Target         float64 `json:"target"`          // VMAF score to meet.
+	MinCrf         int     `json:"min_crf"`         // Lowest CRF tried.
+	MaxCrf         int     `json:"max_crf"`         // Highest CRF tried.
+	Samples        int     `json:"samples"`         // Number of samples spread across the input.
+	SampleDuration float64 `json:"sample_duration"` // Seconds.
+	Model          string  `json:"model"`           // libvmaf model version.
+}
+
+// CRFSearch is the CRF chosen by a CRF search.
+type CRFSearch struct {
+	CRF    int        `json:"crf"`
+	Target float64    `json:"target"`
+	VMAF   float64    `json:"vmaf"` // Mean VMAF of the samples at the CRF.
+	Met    bool       `json:"met"`  // False if no CRF met the target, and the lowest was chosen.
+	Probes []CRFProbe `json:"probes"`
+}
+
+// CRFProbe is the result of encoding the samples at one CRF.
+type CRFProbe struct {
+	CRF     int     `json:"crf"`
+	VMAF    float64 `json:"vmaf"`
+	Bitrate int64   `json:"bitrate"` // Bits per second.
+	Size    int64   `json:"size"`    // Bytes, of all samples.
+	Step    int     `json:"step"`    // Probe number, from 1.
+	Steps   int     `json:"steps"`   // Most probes the search can take.
+}
+
+// sample is a range of the input in seconds.
+type sample struct {
+	Start    float64
+	Duration float64
+}
+
+// SearchCRF binary searches for the highest CRF whose samples meet the VMAF
+// target, calling report with each probe. Requires ffmpeg built with libvmaf.
+func (f *FFmpeg) SearchCRF(input, output, data string, probe *FFProbeResponse, report func(CRFProbe)) (*CRFSearch, error) {
+	options, err := decodeOptions(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(options.Raw) > 0 || len(options.Outputs) > 0 || options.Format.Container == "hls" || options.Format.Container == "dash" {
+		return nil, errors.New("crf search requires a single output without raw options")
+	}
+	opt, err := crfSearchDefaults(options.CRFSearch)
+	if err != nil {
+		return nil, err
+	}
+	if !hasFilter("libvmaf") {
+		return nil, errors.New("crf search requires ffmpeg built with libvmaf")
+	}
+
+	// Detect the crop once for every sample.
+	crop := ""
+	if needsCropDetect(options) {
+		if crop, err = f.detectCrop(input); err != nil {
+			return nil, err
+		}
+	}
+
+	samples, err := crfSamples(options.Format, opt, probe)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := os.MkdirTemp("", "ffmpegd-crf")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	ext := filepath.Ext(output)
+	if ext == "" {
+		ext = ".mkv"
+	}
+
+	search := &CRFSearch{CRF: opt.MinCrf, Target: opt.Target, Probes: []CRFProbe{}}
+	steps := bits.Len(uint(opt.MaxCrf - opt.MinCrf + 1))
+	lo, hi := opt.MinCrf, opt.MaxCrf
+	for lo <= hi {
+		crf := (lo + hi) / 2
+		p := CRFProbe{CRF: crf, Step: len(search.Probes) + 1, Steps: steps}
+
+		var duration float64
+		for i, s := range samples {
+			if f.cancelled() {
+				return nil, ErrCancelled
+			}
+
+			// Encode the sample at the CRF, without audio or subtitles.
+			sopt, err := decodeOptions(data)
+			if err != nil {
+				return nil, err
+			}
+			if crop != "" {
+				setDetectedCrop(sopt, crop)
+			}
+			sopt.Format.Clip = false
+			sopt.Video.Pass = "crf"
+			sopt.Video.Crf = crf
+			sopt.Video.FastStart = false
+
+			path := filepath.Join(dir, fmt.Sprintf("crf%d_%d%s", crf, i, ext))
+			args, err := buildArgs(input, path, sopt)
+			if err != nil {
+				return nil, err
+			}
+			if err := f.run(sampleArgs(args, s)); err != nil {
+				return nil, err
+			}
+
+			q, err := f.runQuality(input, path, qualityOptions{
+				Metrics:   []string{"vmaf"},
+				Model:     opt.Model,
+				StartTime: formatSeconds(s.Start),
+				StopTime:  formatSeconds(s.Start + s.Duration),
+			}, probe)
+			if err != nil {
+				return nil, err
+			}
+			if q.VMAF == nil {
+				return nil, errors.New("libvmaf returned no scores for sample")
+			}
+
+			info, err := os.Stat(path)
+			if err != nil {
+				return nil, err
+			}
+			p.Size += info.Size()
+			p.VMAF += q.VMAF.Mean * s.Duration
+			duration += s.Duration
+		}
+		p.VMAF = roundScore(p.VMAF / duration)
+		p.Bitrate = int64(float64(p.Size) * 8 / duration)
+		search.Probes = append(search.Probes, p)
+		if report != nil {
+			report(p)
+		}
+
+		// VMAF falls as CRF rises, so keep the highest CRF that meets the target.
+		if p.VMAF >= opt.Target {
+			search.CRF, search.VMAF, search.Met = crf, p.VMAF, true
+			lo = crf + 1
+		} else {
+			hi = crf - 1
+		}
+	}
+
+	// Nothing met the target, so the search ended at the lowest CRF.
+	if !search.Met {
+		for _, p := range search.Probes {
+			if p.CRF == search.CRF {
+				search.VMAF = p.VMAF
+			}
+		}
+	}
+	return search, nil
+}
+
+// crfSearchDefaults fills in the unset options and checks the CRF range.
+func crfSearchDefaults(o *crfSearchOptions) (crfSearchOptions, error) {
+	opt := crfSearchOptions{}
+	if o != nil {
+		opt = *o
+	}
+	if opt.Target == 0 {
+		opt.Target = crfSearchTarget
+	}
+	if opt.MinCrf == 0 {
+		opt.MinCrf = crfSearchMin
+	}
+	if opt.MaxCrf == 0 {
+		opt.MaxCrf = crfSearchMax
+	}
+	if opt.Samples <= 0 {
+		opt.Samples = crfSearchSamples
+	}
+	if opt.SampleDuration <= 0 {
+		opt.SampleDuration = crfSearchSampleDuration
+	}
+	if opt.MinCrf < 0 || opt.MaxCrf > 63 || opt.MinCrf > opt.MaxCrf {
+		return opt, fmt.Errorf("invalid crf range %d to %d", opt.MinCrf, opt.MaxCrf)
+	}
+	return opt, nil
+}
+
+// crfSamples spreads the samples evenly across the input, or its clip range.
+// An input too short to sample is used whole.
+func crfSamples(format formatOptions, opt crfSearchOptions, probe *FFProbeResponse) ([]sample, error) {
+	start, duration := 0.0, probe.Duration()
+	if format.Clip {
+		var err error
+		if format.StartTime != "" {
+			if start, err = parseTimestamp(format.StartTime); err != nil {
+				return nil, err
+			}
+		}
+		clip := concatInput{StartTime: format.StartTime, StopTime: format.StopTime}
+		if duration, err = rangeDuration(clip, probe); err != nil {
+			return nil, err
+		}
+	}
+	if duration <= 0 {
+		return nil, errors.New("cannot sample input, duration is unknown")
+	}
+
+	if duration <= float64(opt.Samples)*opt.SampleDuration {
+		return []sample{{Start: start, Duration: duration}}, nil
+	}
+
+	samples := []sample{}
+	for i := 0; i < opt.Samples; i++ {
+		center := start + duration*float64(i+1)/float64(opt.Samples+1)
+		s := math.Max(center-opt.SampleDuration/2, start)
+		samples = append(samples, sample{Start: math.Round(s*1000) / 1000, Duration: opt.SampleDuration})
+	}
+	return samples, nil
+}
+
+// sampleArgs seeks the input to the sample and encodes only its video.
+func sampleArgs(args []string, s sample) []string {
+	i := argIndex(args, "-i")
+	out := append([]string{}, args[:i]...)
+	out = append(out, "-ss", formatSeconds(s.Start), "-t", formatSeconds(s.Duration))
+	out = append(out, args[i:len(args)-1]...)
+	return append(out, "-an", "-sn", args[len(args)-1])
+}
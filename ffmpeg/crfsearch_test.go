@@ -0,0 +1,63 @@
+package ffmpeg
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCRFSamples(t *testing.T) {
+	probe := &FFProbeResponse{Format: format{Duration: "500"}}
+	opt, err := crfSearchDefaults(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	samples, err := crfSamples(formatOptions{}, opt, probe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []sample{{95, 10}, {195, 10}, {295, 10}, {395, 10}}
+	if len(samples) != len(want) {
+		t.Fatalf("got %v", samples)
+	}
+	for i := range want {
+		if samples[i] != want[i] {
+			t.Errorf("got %v, want %v", samples, want)
+		}
+	}
+
+	// Samples are taken from the clip range.
+	clip := formatOptions{Clip: true, StartTime: "00:01:40", StopTime: "00:03:20"}
+	samples, _ = crfSamples(clip, crfSearchOptions{Samples: 1, SampleDuration: 20}, probe)
+	if len(samples) != 1 || samples[0] != (sample{140, 20}) {
+		t.Errorf("got %v", samples)
+	}
+
+	// Short inputs are sampled whole.
+	short := &FFProbeResponse{Format: format{Duration: "30"}}
+	samples, _ = crfSamples(formatOptions{}, opt, short)
+	if len(samples) != 1 || samples[0] != (sample{0, 30}) {
+		t.Errorf("got %v", samples)
+	}
+}
+
+func TestCRFSearchDefaults(t *testing.T) {
+	opt, err := crfSearchDefaults(&crfSearchOptions{Target: 93, MaxCrf: 51})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opt.Target != 93 || opt.MinCrf != 16 || opt.MaxCrf != 51 || opt.Samples != 4 || opt.SampleDuration != 10 {
+		t.Errorf("unexpected options: %+v", opt)
+	}
+	if _, err := crfSearchDefaults(&crfSearchOptions{MinCrf: 30, MaxCrf: 20}); err == nil {
+		t.Error("expected error for an invalid crf range")
+	}
+}
+
+func TestSampleArgs(t *testing.T) {
+	args := []string{"-hide_banner", "-i", "in.mp4", "-c:v", "libx264", "-crf", "28", "-c:a", "aac", "-y", "crf28_0.mp4"}
+	got := strings.Join(sampleArgs(args, sample{95, 10}), " ")
+	if got != "-hide_banner -ss 95 -t 10 -i in.mp4 -c:v libx264 -crf 28 -c:a aac -y -an -sn crf28_0.mp4" {
+		t.Errorf("got %s", got)
+	}
+}
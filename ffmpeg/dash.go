@@ -0,0 +1,86 @@
+package ffmpeg
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+const (
+	dashManifest        = "manifest.mpd"
+	dashSegmentDuration = 4
+	dashAdaptationSets  = "id=0,streams=v id=1,streams=a"
+)
+
+type dashOptions struct {
+	SegmentDuration int    `json:"segment_duration"` // Seconds.
+	AdaptationSets  string `json:"adaptation_sets"`  // Defaults to separate video and audio sets.
+}
+
+// dashPaths returns the output directory and the manifest path for a DASH
+// output. The output may be a directory or the path of the manifest.
+func dashPaths(output string) (string, string) {
+	if filepath.Ext(output) == ".mpd" {
+		return filepath.Dir(output), output
+	}
+	return output, filepath.Join(output, dashManifest)
+}
+
+// setDASHFlags sets the dash muxer flags and manifest output. Segments use
+// templates relative to the manifest.
+func setDASHFlags(opt dashOptions, output string) []string {
+	_, manifest := dashPaths(output)
+
+	duration := opt.SegmentDuration
+	if duration <= 0 {
+		duration = dashSegmentDuration
+	}
+
+	sets := opt.AdaptationSets
+	if sets == "" {
+		sets = dashAdaptationSets
+	}
+
+	return []string{
+		"-f", "dash",
+		"-seg_duration", strconv.Itoa(duration),
+		"-use_template", "1",
+		"-use_timeline", "1",
+		"-adaptation_sets", sets,
+		"-init_seg_name", "init-$RepresentationID$.m4s",
+		"-media_seg_name", "chunk-$RepresentationID$-$Number%05d$.m4s",
+		manifest,
+	}
+}
+
+// setDASHRepresentations compiles multiple outputs into DASH representations
+// from a single decode.
+func setDASHRepresentations(opt *ffmpegOptions, output string) []string {
+	args, _ := setRenditions(opt)
+	return append(args, setDASHFlags(opt.Format.DASH, output)...)
+}
+
+// prepareDASH creates the output directory.
+func prepareDASH(output string) error {
+	dir, _ := dashPaths(output)
+	return os.MkdirAll(dir, 0755)
+}
+
+// dashFiles lists the manifest and segments written to a DASH output
+// directory.
+func dashFiles(output string) ([]string, error) {
+	dir, _ := dashPaths(output)
+	patterns := []string{"*.mpd", "init-*.m4s", "chunk-*.m4s"}
+
+	files := []string{}
+	for _, p := range patterns {
+		matches, err := filepath.Glob(filepath.Join(dir, p))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	sort.Strings(files)
+	return files, nil
+}
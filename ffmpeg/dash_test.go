@@ -0,0 +1,49 @@
+package ffmpeg
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseOptionsDASH(t *testing.T) {
+	payload := `{"format":{"container":"dash","dash":{"segment_duration":2}},"video":{"codec":"libx264"},"audio":{"codec":"aac"},"filter":{"denoise":"none","deinterlace":"none"}}`
+	args, err := parseOptions(testFile, "out.mpd", payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := strings.Join(args, " ")
+
+	want := "-c:v libx264 -c:a aac -y -f dash -seg_duration 2 -use_template 1 -use_timeline 1 -adaptation_sets id=0,streams=v id=1,streams=a"
+	if !strings.Contains(cmd, want) {
+		t.Errorf("got %s, want %s", cmd, want)
+	}
+	if !strings.HasSuffix(cmd, " out.mpd") {
+		t.Errorf("unexpected manifest: %s", cmd)
+	}
+}
+
+func TestParseOptionsDASHRepresentations(t *testing.T) {
+	payload := `{
+		"format": {"container": "dash"},
+		"outputs": [
+			{"video": {"codec": "libx264", "size": "720", "bitrate": "3M"}, "audio": {"codec": "aac"}},
+			{"video": {"codec": "libx264", "size": "480", "bitrate": "1M"}, "audio": {"codec": "none"}}
+		]
+	}`
+	args, err := parseOptions(testFile, "out", payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := strings.Join(args, " ")
+
+	parts := []string{
+		"-map [v0] -map 0:a:0 -map [v1] -c:v:0 libx264 -b:v:0 3M -c:a:0 aac -c:v:1 libx264 -b:v:1 1M -y -f dash",
+		filepath.Join("out", "manifest.mpd"),
+	}
+	for _, p := range parts {
+		if !strings.Contains(cmd, p) {
+			t.Errorf("missing %q: %s", p, cmd)
+		}
+	}
+}
@@ -7,10 +7,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	"os/exec"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -19,11 +21,19 @@ const (
 	updateInterval = time.Second * 5
 )
 
+// ErrCancelled is returned by Run when the job is cancelled.
+var ErrCancelled = errors.New("cancelled")
+
 // FFmpeg struct.
 type FFmpeg struct {
 	Progress    progress
+	LogWriter   io.Writer // Receives ffmpeg stderr output, if set.
+	Collision   string    // Collision policy. Unless it's overwrite, outputs written in place aren't replaced.
 	cmd         *exec.Cmd
 	isCancelled bool
+
+	mu      sync.Mutex // Guards cmd, isCancelled, workers and Progress.
+	workers []*FFmpeg  // Processes encoding chunks in parallel.
 }
 
 type progress struct {
@@ -51,22 +61,36 @@ type ffmpegOptions struct {
 	Audio  audioOptions  `json:"audio"`
 	Filter filterOptions `json:"filter"`
 
+	Streams  streamOptions   `json:"streams"`  // Stream selection and metadata.
+	Subtitle subtitleOptions `json:"subtitle"` // Sidecar and burned in subtitles.
+
+	Outputs []outputOptions `json:"outputs"` // Multiple outputs from one decode.
+
+	Quality   *qualityOptions   `json:"quality"`    // Measure the outputs against the input.
+	CRFSearch *crfSearchOptions `json:"crf_search"` // Used by crf_search jobs.
+	Chunks    *chunkOptions     `json:"chunks"`     // Encode the video in parallel chunks.
+
 	Raw []string `json:"raw"` // Raw flag options.
+
+	noOverwrite bool // Run ffmpeg with -n instead of -y.
 }
 
 type formatOptions struct {
-	Container string `json:"container"`
-	Clip      bool   `json:"clip"`
-	StartTime string `json:"startTime"`
-	StopTime  string `json:"stopTime"`
+	Container string      `json:"container"`
+	Clip      bool        `json:"clip"`
+	StartTime string      `json:"startTime"`
+	StopTime  string      `json:"stopTime"`
+	HLS       hlsOptions  `json:"hls"`  // Used when container is hls.
+	DASH      dashOptions `json:"dash"` // Used when container is dash.
 }
 
 type videoOptions struct {
 	Codec        string `json:"codec"`
 	Preset       string `json:"preset"`
-	Pass         string `json:"pass"`
+	Pass         string `json:"pass"` // 1, 2, crf, or size to fit target_size in two passes.
 	Crf          int    `json:"crf"`
 	Bitrate      string `json:"bitrate"`
+	TargetSize   string `json:"target_size"` // Output size for pass "size", e.g. 25MB or 8MiB.
 	MinRate      string `json:"minrate"`
 	MaxRate      string `json:"maxrate"`
 	BufSize      string `json:"bufsize"`
@@ -85,6 +109,8 @@ type videoOptions struct {
 	Aspect       string `json:"aspect"`
 	Scaling      string `json:"scaling"`
 	CodecOptions string `json:"codec_options"`
+
+	Color colorOptions `json:"color"` // Tonemapping and output color tags.
 }
 
 type audioOptions struct {
@@ -107,53 +133,191 @@ type filterOptions struct {
 	Saturation  string `json:"saturation"`
 	Gamma       string `json:"gamma"`
 	Acontrast   string `json:"acontrast"`
+
+	Crop   string `json:"crop"`   // w:h:x:y, w:h centered, or auto to detect black bars.
+	Rotate string `json:"rotate"` // Clockwise degrees: 90, 180 or 270.
+	HFlip  bool   `json:"hflip"`
+	VFlip  bool   `json:"vflip"`
+	Pad    string `json:"pad"` // Aspect ratio to pad to, e.g. 16:9.
+
+	Watermark *watermarkOptions `json:"watermark"` // Image overlay.
+	Text      []textOptions     `json:"text"`      // Text overlays.
+
+	burnIn string // Subtitles filter, set from the subtitle options.
 }
 
 // Run runs the ffmpeg encoder with options.
 func (f *FFmpeg) Run(input, output, data string) error {
 
+	// Decode JSON get options list from data.
+	options, err := decodeOptions(data)
+	if err != nil {
+		return err
+	}
+	options.noOverwrite = !overwrites(input, output, data, f.Collision)
+
+	// Detect black bars to crop in a pre-pass.
+	if needsCropDetect(options) {
+		crop, err := f.detectCrop(input)
+		if err != nil {
+			return err
+		}
+		setDetectedCrop(options, crop)
+	}
+
+	// Two-pass encodes run ffmpeg once per pass.
+	if isTwoPass(options) {
+		return f.runTwoPass(input, output, options)
+	}
+
+	// Chunked encodes split the video across parallel ffmpeg processes.
+	if isChunked(options) {
+		return f.runChunked(input, output, data, options)
+	}
+
+	if err := dropMissingAudio(input, options); err != nil {
+		return err
+	}
+
 	// Parse options and add to args slice.
-	args := parseOptions(input, output, data)
+	args, err := buildArgs(input, output, options)
+	if err != nil {
+		return err
+	}
+
+	// Single rendition HLS resumes after its last complete segment.
+	if isHLSResumable(options) {
+		return f.runHLS(input, output, data, args, options)
+	}
+
+	// Create output directories and files ffmpeg expects to exist.
+	if err := prepareOutput(output, options); err != nil {
+		return err
+	}
+	defer removeHLSKeyInfo(options, output)
+
+	return f.run(args)
+}
+
+// run executes ffmpeg with args, updating progress until it exits.
+func (f *FFmpeg) run(args []string) error {
+	_, err := f.runStderr(args)
+	return err
+}
+
+// runStderr runs ffmpeg like run, returning its stderr output.
+func (f *FFmpeg) runStderr(args []string) (string, error) {
+	return f.execute(args, f.LogWriter)
+}
+
+// runAnalysis runs an analysis pass, returning its stderr output without
+// copying it to LogWriter. Analysis passes log at info level, often a line
+// per frame.
+func (f *FFmpeg) runAnalysis(args []string) (string, error) {
+	return f.execute(args, nil)
+}
+
+// execute runs ffmpeg, copying its stderr output to log if set. Returns
+// ErrCancelled without starting ffmpeg if the job was cancelled between steps.
+func (f *FFmpeg) execute(args []string, log io.Writer) (string, error) {
+	f.mu.Lock()
+	if f.isCancelled {
+		f.mu.Unlock()
+		return "", ErrCancelled
+	}
 
 	// Execute command.
-	f.cmd = exec.Command(ffmpegCmd, args...)
-	// fmt.Println("generated output: ", f.cmd.String())
-	stdout, _ := f.cmd.StdoutPipe()
+	cmd := exec.Command(ffmpegCmd, args...)
+	stdout, _ := cmd.StdoutPipe()
 
 	// Capture stderr (if any).
 	var stderr bytes.Buffer
-	f.cmd.Stderr = &stderr
-	err := f.cmd.Start()
+	cmd.Stderr = &stderr
+	if log != nil {
+		cmd.Stderr = io.MultiWriter(&stderr, log)
+	}
+	f.cmd = cmd
+	quit := make(chan struct{})
+	f.Progress.quit = quit
+	err := cmd.Start()
+	f.mu.Unlock()
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	// Send progress updates.
-	go f.trackProgress()
+	go f.trackProgress(quit)
 
 	// Update progress struct.
 	f.updateProgress(stdout)
 
-	err = f.cmd.Wait()
+	err = cmd.Wait()
 	if err != nil {
-		if f.isCancelled {
-			return errors.New("cancelled")
-		}
 		f.finish()
-		return errors.New(stderr.String())
+		if f.cancelled() {
+			return "", ErrCancelled
+		}
+		return "", errors.New(stderr.String())
 	}
 	f.finish()
-	return nil
+	return stderr.String(), nil
 }
 
-// Cancel stops an FFmpeg job from running.
+// Cancel stops an FFmpeg job from running. Steps that haven't started yet
+// return ErrCancelled.
 func (f *FFmpeg) Cancel() {
 	fmt.Println("killing ffmpeg process")
+	f.cancel()
+	fmt.Println("killed ffmpeg process")
+}
+
+func (f *FFmpeg) cancel() {
+	f.mu.Lock()
 	f.isCancelled = true
-	if err := f.cmd.Process.Kill(); err != nil {
+	workers := f.workers
+	f.kill()
+	f.mu.Unlock()
+
+	for _, w := range workers {
+		w.cancel()
+	}
+}
+
+// kill kills the running process. Must be called with f.mu held.
+func (f *FFmpeg) kill() {
+	if f.cmd == nil || f.cmd.Process == nil {
+		return
+	}
+	if err := f.cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
 		fmt.Println("failed to kill process: ", err)
 	}
-	fmt.Println("killed ffmpeg process")
+}
+
+// cancelled reports whether Cancel was called.
+func (f *FFmpeg) cancelled() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.isCancelled
+}
+
+// String returns the generated ffmpeg command line.
+func (f *FFmpeg) String() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.cmd == nil {
+		return ""
+	}
+	return f.cmd.String()
+}
+
+// ExitCode returns the exit code of the ffmpeg process, or -1 if it has not exited.
+func (f *FFmpeg) ExitCode() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.cmd == nil || f.cmd.ProcessState == nil {
+		return -1
+	}
+	return f.cmd.ProcessState.ExitCode()
 }
 
 // Version gets the ffmpeg version.
@@ -180,7 +344,24 @@ func (f *FFmpeg) updateProgress(stdout io.ReadCloser) {
 	}
 }
 
+// CurrentProgress returns a copy of the progress, which is updated while
+// ffmpeg runs.
+func (f *FFmpeg) CurrentProgress() progress {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.Progress
+}
+
+// resetProgress clears the progress of a finished process.
+func (f *FFmpeg) resetProgress() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Progress.Frame, f.Progress.OutTimeMS, f.Progress.FPS, f.Progress.Speed = 0, 0, 0, ""
+}
+
 func (f *FFmpeg) setProgressParts(parts []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	for i := 0; i < len(parts); i++ {
 		progressSplit := strings.Split(parts[i], "=")
 		k := progressSplit[0]
@@ -220,13 +401,12 @@ func (f *FFmpeg) setProgressParts(parts []string) {
 	}
 }
 
-func (f *FFmpeg) trackProgress() {
-	f.Progress.quit = make(chan struct{})
+func (f *FFmpeg) trackProgress(quit chan struct{}) {
 	ticker := time.NewTicker(updateInterval)
 
 	for {
 		select {
-		case <-f.Progress.quit:
+		case <-quit:
 			ticker.Stop()
 			return
 		}
@@ -234,13 +414,25 @@ func (f *FFmpeg) trackProgress() {
 }
 
 func (f *FFmpeg) finish() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	close(f.Progress.quit)
 }
 
 // Parse options from JSON payload.
 // This should match the options mapped by:
 // https://github.com/alfg/ffmpeg-commander/blob/master/src/ffmpeg.js
-func parseOptions(input, output, data string) []string {
+func parseOptions(input, output, data string) ([]string, error) {
+	// Decode JSON get options list from data.
+	options, err := decodeOptions(data)
+	if err != nil {
+		return nil, err
+	}
+	return buildArgs(input, output, options)
+}
+
+// buildArgs builds the ffmpeg arguments from decoded options.
+func buildArgs(input, output string, options *ffmpegOptions) ([]string, error) {
 	args := []string{
 		"-hide_banner",
 		"-loglevel", "error", // Set loglevel to fail job on errors.
@@ -248,10 +440,23 @@ func parseOptions(input, output, data string) []string {
 		"-i", input,
 	}
 
-	// Decode JSON get options list from data.
-	options := &ffmpegOptions{}
-	if err := json.Unmarshal([]byte(data), &options); err != nil {
-		panic(err)
+	setText(input, &options.Filter)
+	for i := range options.Outputs {
+		setText(input, &options.Outputs[i].Filter)
+	}
+
+	// Probe the input for options that depend on its streams.
+	var probe *FFProbeResponse
+	if needsProbe(options) {
+		var err error
+		probe, err = FFProbe{}.Run(input)
+		if err != nil {
+			return nil, err
+		}
+		setColor(&options.Video, probe)
+		for i := range options.Outputs {
+			setColor(&options.Outputs[i].Video, probe)
+		}
 	}
 
 	// If raw options provided, add the list of raw options from ffmpeg presets.
@@ -260,20 +465,76 @@ func parseOptions(input, output, data string) []string {
 			args = append(args, strings.Split(v, " ")...)
 		}
 		args = append(args, output)
-		return args
+		return args, nil
 	}
 
-	// Set options from struct.
-	args = append(args, transformOptions(options)...)
+	// HLS sets its own muxer flags and playlist output.
+	if options.Format.Container == "hls" {
+		if len(options.Outputs) > 0 {
+			args = append(args, setHLSVariants(options, output)...)
+			return args, nil
+		}
+		options.Video.FastStart = false
+		args = append(args, transformOptions(options)...)
+		args = append(args, setHLSFlags(options.Format.HLS, output, 1)...)
+		return args, nil
+	}
 
-	// Set 2 pass output if option is set.
-	if options.Video.Pass == "2" {
-		args = append(args, set2Pass(&args)...)
+	// DASH sets its own muxer flags and manifest output.
+	if options.Format.Container == "dash" {
+		if len(options.Outputs) > 0 {
+			args = append(args, setDASHRepresentations(options, output)...)
+			return args, nil
+		}
+		options.Video.FastStart = false
+		args = append(args, transformOptions(options)...)
+		args = append(args, setDASHFlags(options.Format.DASH, output)...)
+		return args, nil
+	}
+
+	// Multiple outputs set their own output args.
+	if len(options.Outputs) > 0 {
+		args = append(args, setOutputs(options)...)
+		return args, nil
 	}
 
+	// Map streams and subtitles, probing the input to resolve selectors.
+	if options.Streams.isSet() || options.Subtitle.isSet() {
+		streams, err := setInputStreams(input, output, options, probe)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, streams...)
+	}
+
+	// Set options from struct.
+	args = append(args, transformOptions(options)...)
+
 	// Add output arg last.
 	args = append(args, output)
-	return args
+	return args, nil
+}
+
+// needsProbe reports whether building the arguments requires an input probe.
+func needsProbe(opt *ffmpegOptions) bool {
+	if opt.Streams.isSet() || opt.Subtitle.isSet() || opt.Video.Color.needsProbe() {
+		return true
+	}
+	for _, o := range opt.Outputs {
+		if o.Video.Color.needsProbe() {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeOptions decodes a JSON payload into ffmpegOptions.
+func decodeOptions(data string) (*ffmpegOptions, error) {
+	options := &ffmpegOptions{}
+	if err := json.Unmarshal([]byte(data), &options); err != nil {
+		return nil, err
+	}
+	return options, nil
 }
 
 func setFormatFlags(opt formatOptions) []string {
@@ -366,6 +627,9 @@ func setVideoFlags(opt videoOptions) []string {
 		args = append(args, []string{"-level", opt.Level}...)
 	}
 
+	// Color.
+	args = append(args, setColorFlags(opt.Color)...)
+
 	// Codec params.
 	if opt.CodecOptions != "" && (opt.Codec == "libx264" || opt.Codec == "libx265") {
 		p := strings.Replace(opt.Codec, "lib", "", 1)
@@ -378,6 +642,14 @@ func setVideoFlags(opt videoOptions) []string {
 func setVideoFilters(vopt videoOptions, opt filterOptions) string {
 	args := []string{}
 
+	// HDR to SDR.
+	if vopt.Color.tonemap {
+		args = append(args, setTonemap(vopt.Color))
+	}
+
+	// Crop, rotate, flip and pad.
+	args = append(args, setGeometry(opt)...)
+
 	// Speed.
 	if vopt.Speed != "" && vopt.Speed != "auto" {
 		args = append(args, []string{"setpts=" + vopt.Speed}...)
@@ -481,7 +753,22 @@ func setVideoFilters(vopt videoOptions, opt filterOptions) string {
 		args = append(args, []string{"eq=" + eqStr}...)
 	}
 
+	// Burned in subtitles.
+	if opt.burnIn != "" {
+		args = append(args, opt.burnIn)
+	}
+
+	// Text overlays.
+	for _, t := range opt.Text {
+		args = append(args, setDrawText(t))
+	}
+
 	argsStr := strings.Join(args, ",")
+
+	// Watermark.
+	if opt.Watermark != nil && opt.Watermark.Image != "" {
+		argsStr = setWatermark(argsStr, opt.Watermark)
+	}
 	return argsStr
 }
 
@@ -528,18 +815,6 @@ func setAudioFilters(opt audioOptions, filter filterOptions) string {
 	return argsStr
 }
 
-func set2Pass(args *[]string) []string {
-	op := "NUL &&" // Windows.
-	cpy := make([]string, len(*args))
-	copy(cpy, *args)
-
-	*args = append(*args, []string{"-pass 1", "-f null", op}...)
-	cpy = append([]string{"ffmpeg"}, cpy...)
-	cpy = append(cpy, []string{"-pass 2"}...)
-
-	return cpy
-}
-
 // transformOptions converts the ffmpegOptions{} struct and converts into
 // a slice of ffmpeg options to be passed to exec.Command arguments.
 func transformOptions(opt *ffmpegOptions) []string {
@@ -574,8 +849,17 @@ func transformOptions(opt *ffmpegOptions) []string {
 	}
 
 	extra := []string{
-		"-y",
+		overwriteFlag(opt),
 	}
 	args = append(args, extra...)
 	return args
 }
+
+// overwriteFlag returns -y to overwrite existing outputs, or -n to fail if
+// one exists.
+func overwriteFlag(opt *ffmpegOptions) string {
+	if opt.noOverwrite {
+		return "-n"
+	}
+	return "-y"
+}
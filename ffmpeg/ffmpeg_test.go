@@ -22,3 +22,14 @@ func TestFFmpegRunFail(t *testing.T) {
 		t.Error()
 	}
 }
+
+func TestCancelBetweenSteps(t *testing.T) {
+	f := &FFmpeg{}
+	f.Cancel()
+	if _, err := f.runStderr([]string{"-version"}); err != ErrCancelled {
+		t.Errorf("expected ErrCancelled, got %v", err)
+	}
+	if f.String() != "" {
+		t.Error("ffmpeg was started after cancel")
+	}
+}
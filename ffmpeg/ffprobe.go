@@ -5,6 +5,8 @@ import (
 	"errors"
 	"os/exec"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -18,6 +20,7 @@ func (f FFProbe) Run(input string) (*FFProbeResponse, error) {
 	args := []string{
 		"-i", input,
 		"-show_streams",
+		"-show_format",
 		"-print_format", "json",
 		"-v", "error",
 	}
@@ -39,6 +42,44 @@ func (f FFProbe) Run(input string) (*FFProbeResponse, error) {
 	return dat, nil
 }
 
+// Keyframes returns the timestamps of the keyframes in the input's first
+// video stream, in seconds. Packets are scanned without decoding.
+func (f FFProbe) Keyframes(input string) ([]float64, error) {
+	args := []string{
+		"-v", "error",
+		"-select_streams", "v:0",
+		"-show_entries", "packet=pts_time,flags",
+		"-of", "csv=p=0",
+		input,
+	}
+
+	out, err := exec.Command(ffprobeCmd, args...).Output()
+	if err != nil {
+		if e, ok := err.(*exec.ExitError); ok {
+			return nil, errors.New(strings.TrimSpace(string(e.Stderr)))
+		}
+		return nil, err
+	}
+	return parseKeyframes(string(out)), nil
+}
+
+// parseKeyframes returns the timestamps of keyframe packets, printed as
+// "pts_time,flags" lines.
+func parseKeyframes(out string) []float64 {
+	keyframes := []float64{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(strings.TrimSpace(line), ",")
+		if len(fields) < 2 || !strings.HasPrefix(fields[1], "K") {
+			continue
+		}
+		if t, err := strconv.ParseFloat(fields[0], 64); err == nil {
+			keyframes = append(keyframes, t)
+		}
+	}
+	sort.Float64s(keyframes)
+	return keyframes
+}
+
 // Version gets the ffprobe version.
 func (f *FFProbe) Version() (string, error) {
 	out, err := exec.Command(ffprobeCmd, "-version").Output()
@@ -51,9 +92,78 @@ func (f *FFProbe) Version() (string, error) {
 	return version, nil
 }
 
+// Duration returns the duration of the input in seconds, or 0 if unknown.
+func (p *FFProbeResponse) Duration() float64 {
+	d, _ := strconv.ParseFloat(p.Format.Duration, 64)
+	return d
+}
+
+// VideoSize returns the displayed size of the first video stream, or zero if
+// there is none.
+func (p *FFProbeResponse) VideoSize() (int, int) {
+	if s := p.videoStream(); s != nil {
+		return s.displaySize()
+	}
+	return 0, 0
+}
+
+// videoStream returns the first video stream, or nil if there is none.
+func (p *FFProbeResponse) videoStream() *stream {
+	for i := range p.Streams {
+		if p.Streams[i].CodecType == "video" {
+			return &p.Streams[i]
+		}
+	}
+	return nil
+}
+
+// Rotation returns the display rotation of the video in degrees, from the
+// display matrix side data or the rotate tag.
+func (s *stream) Rotation() int {
+	for _, d := range s.SideDataList {
+		if d.SideDataType == "Display Matrix" {
+			return d.Rotation
+		}
+	}
+	r, _ := strconv.Atoi(s.Tags.Rotate)
+	return r
+}
+
+// displaySize returns the size of the video as displayed, after ffmpeg
+// applies its rotation.
+func (s *stream) displaySize() (int, int) {
+	if r := s.Rotation() % 180; r == 90 || r == -90 {
+		return s.Height, s.Width
+	}
+	return s.Width, s.Height
+}
+
+// audioStreams returns the audio streams in input order.
+func (p *FFProbeResponse) audioStreams() []stream {
+	streams := []stream{}
+	for _, s := range p.Streams {
+		if s.CodecType == "audio" {
+			streams = append(streams, s)
+		}
+	}
+	return streams
+}
+
 // FFProbeResponse defines the response from ffprobe.
 type FFProbeResponse struct {
 	Streams []stream `json:"streams"`
+	Format  format   `json:"format"`
+}
+
+type format struct {
+	Filename       string `json:"filename"`
+	NbStreams      int    `json:"nb_streams"`
+	FormatName     string `json:"format_name"`
+	FormatLongName string `json:"format_long_name"`
+	StartTime      string `json:"start_time"`
+	Duration       string `json:"duration"`
+	Size           string `json:"size"`
+	BitRate        string `json:"bit_rate"`
 }
 
 type stream struct {
@@ -73,6 +183,12 @@ type stream struct {
 	SampleAspectRatio  string      `json:"sample_aspect_ratio"`
 	DisplayAspectRatio string      `json:"display_aspect_ratio"`
 	PixFmt             string      `json:"pix_fmt"`
+	ColorRange         string      `json:"color_range"`
+	ColorSpace         string      `json:"color_space"`
+	ColorTransfer      string      `json:"color_transfer"`
+	ColorPrimaries     string      `json:"color_primaries"`
+	SampleRate         string      `json:"sample_rate"`
+	Channels           int         `json:"channels"`
 	Level              int         `json:"level"`
 	ChromaLocation     string      `json:"chroma_location"`
 	Refs               int         `json:"refs"`
@@ -90,6 +206,30 @@ type stream struct {
 	NbFrames           string      `json:"nb_frames"`
 	Disposition        disposition `json:"disposition"`
 	Tags               tags        `json:"tags"`
+	SideDataList       []sideData  `json:"side_data_list"`
+}
+
+type sideData struct {
+	SideDataType string `json:"side_data_type"`
+
+	// Display matrix.
+	Rotation int `json:"rotation"`
+
+	// Mastering display metadata, as rationals.
+	RedX         string `json:"red_x"`
+	RedY         string `json:"red_y"`
+	GreenX       string `json:"green_x"`
+	GreenY       string `json:"green_y"`
+	BlueX        string `json:"blue_x"`
+	BlueY        string `json:"blue_y"`
+	WhitePointX  string `json:"white_point_x"`
+	WhitePointY  string `json:"white_point_y"`
+	MinLuminance string `json:"min_luminance"`
+	MaxLuminance string `json:"max_luminance"`
+
+	// Content light level metadata.
+	MaxContent int `json:"max_content"`
+	MaxAverage int `json:"max_average"`
 }
 
 type disposition struct {
@@ -110,4 +250,5 @@ type disposition struct {
 type tags struct {
 	Language    string `json:"language"`
 	HandlerName string `json:"handler_name"`
+	Rotate      string `json:"rotate"` // Set by older muxers instead of a display matrix.
 }
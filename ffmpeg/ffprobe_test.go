@@ -26,4 +26,8 @@ func TestFFProbeRun(t *testing.T) {
 	if probe.Streams[0].Height != 534 {
 		t.Error()
 	}
+
+	if probe.Format.NbStreams != 2 {
+		t.Error()
+	}
 }
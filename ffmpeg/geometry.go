@@ -0,0 +1,150 @@
+package ffmpeg
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Matches the crop suggested on each cropdetect log line.
+var cropDetectPattern = regexp.MustCompile(`crop=(\d+:\d+:\d+:\d+)`)
+
+// Matches a pad aspect ratio, e.g. 16:9, 4/3 or 2.35.
+var aspectPattern = regexp.MustCompile(`^(\d+(?:\.\d+)?)(?:[:/](\d+(?:\.\d+)?))?$`)
+
+// Seconds of video sampled by the cropdetect pre-pass.
+const cropDetectDuration = 60
+
+// setGeometry returns the crop, rotate, flip and pad filters. ffmpeg applies
+// the input's rotation first, so they are relative to the displayed video.
+func setGeometry(opt filterOptions) []string {
+	args := []string{}
+
+	// Crop. An undetected auto crop is skipped.
+	if opt.Crop != "" && opt.Crop != "auto" {
+		args = append(args, "crop="+opt.Crop)
+	}
+
+	// Rotate.
+	switch opt.Rotate {
+	case "90", "-270":
+		args = append(args, "transpose=clock")
+	case "180", "-180":
+		args = append(args, "hflip", "vflip")
+	case "270", "-90":
+		args = append(args, "transpose=cclock")
+	}
+
+	// Flip.
+	if opt.HFlip {
+		args = append(args, "hflip")
+	}
+	if opt.VFlip {
+		args = append(args, "vflip")
+	}
+
+	// Pad to aspect ratio.
+	if ratio, ok := padRatio(opt.Pad); ok {
+		args = append(args, fmt.Sprintf(
+			"pad=w='trunc(max(iw,ih*%[1]s)/2)*2':h='trunc(max(ih,iw/(%[1]s))/2)*2':x=(ow-iw)/2:y=(oh-ih)/2", ratio))
+	}
+
+	return args
+}
+
+// padRatio returns the pad aspect ratio as an expression.
+func padRatio(aspect string) (string, bool) {
+	m := aspectPattern.FindStringSubmatch(aspect)
+	if m == nil {
+		return "", false
+	}
+	if m[2] == "" {
+		return m[1], true
+	}
+	return m[1] + "/" + m[2], true
+}
+
+// needsCropDetect reports whether any output crops automatically.
+func needsCropDetect(opt *ffmpegOptions) bool {
+	if opt.Filter.Crop == "auto" {
+		return true
+	}
+	for _, o := range opt.Outputs {
+		if o.Filter.Crop == "auto" {
+			return true
+		}
+	}
+	return false
+}
+
+// setDetectedCrop replaces auto crops with the detected crop.
+func setDetectedCrop(opt *ffmpegOptions, crop string) {
+	if opt.Filter.Crop == "auto" {
+		opt.Filter.Crop = crop
+	}
+	for i := range opt.Outputs {
+		if opt.Outputs[i].Filter.Crop == "auto" {
+			opt.Outputs[i].Filter.Crop = crop
+		}
+	}
+}
+
+// detectCrop runs cropdetect over a sample of the input and returns the crop
+// removing its black bars, or "" if there are none.
+func (f *FFmpeg) detectCrop(input string) (string, error) {
+	probe, err := FFProbe{}.Run(input)
+	if err != nil {
+		return "", err
+	}
+	video := probe.videoStream()
+	if video == nil {
+		return "", errors.New("input has no video stream to crop")
+	}
+
+	// Skip the start, which is often a black or faded intro.
+	args := []string{
+		"-hide_banner",
+		"-loglevel", "info",
+		"-ss", formatSeconds(probe.Duration() * 0.1),
+		"-i", input,
+		"-t", strconv.Itoa(cropDetectDuration),
+		"-map", "0:v:0",
+		"-vf", "cropdetect=round=2",
+		"-f", "null", "-",
+	}
+	stderr, err := f.runAnalysis(args)
+	if err != nil {
+		return "", err
+	}
+	if f.cancelled() {
+		return "", ErrCancelled
+	}
+
+	crop := parseCropDetect(stderr)
+	if crop == "" {
+		return "", errors.New("cropdetect found no crop")
+	}
+
+	// Nothing to crop if it covers the displayed video.
+	w, h := video.displaySize()
+	if crop == fmt.Sprintf("%d:%d:0:0", w, h) {
+		return "", nil
+	}
+	return crop, nil
+}
+
+// parseCropDetect returns the crop suggested most often by cropdetect, which
+// ignores fades and dark scenes.
+func parseCropDetect(stderr string) string {
+	counts := map[string]int{}
+	best := ""
+	for _, m := range cropDetectPattern.FindAllStringSubmatch(stderr, -1) {
+		counts[m[1]]++
+		if counts[m[1]] > counts[best] || counts[m[1]] == counts[best] && strings.Compare(m[1], best) < 0 {
+			best = m[1]
+		}
+	}
+	return best
+}
@@ -0,0 +1,78 @@
+package ffmpeg
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSetGeometry(t *testing.T) {
+	tests := []struct {
+		opt  filterOptions
+		want string
+	}{
+		{filterOptions{Crop: "1920:800:0:140"}, "crop=1920:800:0:140"},
+		{filterOptions{Crop: "auto"}, ""},
+		{filterOptions{Rotate: "90", HFlip: true}, "transpose=clock,hflip"},
+		{filterOptions{Rotate: "-90"}, "transpose=cclock"},
+		{filterOptions{Rotate: "180"}, "hflip,vflip"},
+		{filterOptions{Rotate: "45", VFlip: true}, "vflip"},
+		{filterOptions{Pad: "16:9"}, "pad=w='trunc(max(iw,ih*16/9)/2)*2':h='trunc(max(ih,iw/(16/9))/2)*2':x=(ow-iw)/2:y=(oh-ih)/2"},
+		{filterOptions{Pad: "2.35"}, "pad=w='trunc(max(iw,ih*2.35)/2)*2':h='trunc(max(ih,iw/(2.35))/2)*2':x=(ow-iw)/2:y=(oh-ih)/2"},
+		{filterOptions{Pad: "wide"}, ""},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(setGeometry(tt.opt), ","); got != tt.want {
+			t.Errorf("%+v: got %s, want %s", tt.opt, got, tt.want)
+		}
+	}
+
+	// Geometry comes before scaling.
+	vf := setVideoFilters(videoOptions{Size: "720"}, filterOptions{Crop: "1920:800:0:140", Denoise: "none", Deinterlace: "none"})
+	if vf != "crop=1920:800:0:140,scale=-1:720" {
+		t.Errorf("unexpected filters: %s", vf)
+	}
+}
+
+func TestParseCropDetect(t *testing.T) {
+	stderr := `[Parsed_cropdetect_0 @ 0x1] x1:0 x2:1919 y1:0 y2:1079 w:1920 h:1080 x:0 y:0 pts:0 t:0.000000 crop=1920:1080:0:0
+[Parsed_cropdetect_0 @ 0x1] x1:0 x2:1919 y1:138 y2:941 w:1920 h:800 x:0 y:140 pts:1 t:0.041667 crop=1920:800:0:140
+[Parsed_cropdetect_0 @ 0x1] x1:0 x2:1919 y1:138 y2:941 w:1920 h:800 x:0 y:140 pts:2 t:0.083333 crop=1920:800:0:140
+`
+	if got := parseCropDetect(stderr); got != "1920:800:0:140" {
+		t.Errorf("got %s", got)
+	}
+	if got := parseCropDetect("no crop here"); got != "" {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestSetDetectedCrop(t *testing.T) {
+	opt := &ffmpegOptions{
+		Filter:  filterOptions{Crop: "auto"},
+		Outputs: []outputOptions{{Filter: filterOptions{Crop: "auto"}}, {Filter: filterOptions{Crop: "100:100"}}},
+	}
+	if !needsCropDetect(opt) {
+		t.Fatal("expected crop detection")
+	}
+	setDetectedCrop(opt, "1920:800:0:140")
+	if opt.Filter.Crop != "1920:800:0:140" || opt.Outputs[0].Filter.Crop != "1920:800:0:140" || opt.Outputs[1].Filter.Crop != "100:100" {
+		t.Errorf("unexpected crops: %+v", opt)
+	}
+}
+
+func TestDisplaySize(t *testing.T) {
+	tests := []struct {
+		s    stream
+		w, h int
+	}{
+		{stream{Width: 1920, Height: 1080}, 1920, 1080},
+		{stream{Width: 1920, Height: 1080, SideDataList: []sideData{{SideDataType: "Display Matrix", Rotation: -90}}}, 1080, 1920},
+		{stream{Width: 1920, Height: 1080, Tags: tags{Rotate: "270"}}, 1080, 1920},
+		{stream{Width: 1920, Height: 1080, Tags: tags{Rotate: "180"}}, 1920, 1080},
+	}
+	for _, tt := range tests {
+		if w, h := tt.s.displaySize(); w != tt.w || h != tt.h {
+			t.Errorf("got %dx%d, want %dx%d", w, h, tt.w, tt.h)
+		}
+	}
+}
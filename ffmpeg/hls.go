@@ -0,0 +1,176 @@
+package ffmpeg
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	hlsPlaylist        = "index.m3u8"
+	hlsMasterPlaylist  = "master.m3u8"
+	hlsKeyFile         = "enc.key"
+	hlsKeyInfoFile     = "enc.keyinfo"
+	hlsSegmentDuration = 6
+)
+
+type hlsOptions struct {
+	SegmentDuration int    `json:"segment_duration"` // Seconds.
+	PlaylistType    string `json:"playlist_type"`    // vod or event.
+	SegmentType     string `json:"segment_type"`     // ts or fmp4.
+	Encrypt         bool   `json:"encrypt"`          // AES-128 encrypt segments.
+	KeyURI          string `json:"key_uri"`          // Key URI written to playlists.
+	KeyDir          string `json:"key_dir"`          // Private directory the key is written to.
+}
+
+// hlsPaths returns the output directory and the playlist path for an HLS
+// output. The output may be a directory or the path of the playlist.
+func hlsPaths(output string, variants int) (string, string) {
+	if filepath.Ext(output) == ".m3u8" {
+		return filepath.Dir(output), output
+	}
+	if variants > 1 {
+		return output, filepath.Join(output, hlsMasterPlaylist)
+	}
+	return output, filepath.Join(output, hlsPlaylist)
+}
+
+// setHLSFlags sets the hls muxer flags and playlist output. Multiple variants
+// are written as stream_N playlists alongside a master playlist.
+func setHLSFlags(opt hlsOptions, output string, variants int) []string {
+	dir, playlist := hlsPaths(output, variants)
+
+	duration := opt.SegmentDuration
+	if duration <= 0 {
+		duration = hlsSegmentDuration
+	}
+
+	playlistType := "vod"
+	if opt.PlaylistType == "event" {
+		playlistType = "event"
+	}
+
+	segmentType, ext := "mpegts", ".ts"
+	if opt.SegmentType == "fmp4" {
+		segmentType, ext = "fmp4", ".m4s"
+	}
+
+	args := []string{
+		"-f", "hls",
+		"-hls_time", strconv.Itoa(duration),
+		"-hls_playlist_type", playlistType,
+		"-hls_segment_type", segmentType,
+	}
+
+	if opt.Encrypt {
+		args = append(args, "-hls_key_info_file", filepath.Join(hlsKeyDir(opt, output, variants), hlsKeyInfoFile))
+	}
+
+	// Single rendition.
+	if variants <= 1 {
+		args = append(args, "-hls_segment_filename", filepath.Join(dir, "segment_%03d"+ext))
+		return append(args, playlist)
+	}
+
+	// Multiple renditions with a master playlist.
+	args = append(args,
+		"-master_pl_name", filepath.Base(playlist),
+		"-hls_segment_filename", filepath.Join(dir, "stream_%v_%03d"+ext),
+	)
+	return append(args, filepath.Join(dir, "stream_%v.m3u8"))
+}
+
+// setHLSVariants compiles multiple outputs into HLS renditions from a single
+// decode, listed in a master playlist.
+func setHLSVariants(opt *ffmpegOptions, output string) []string {
+	args, streamMap := setRenditions(opt)
+	args = append(args, "-var_stream_map", strings.Join(streamMap, " "))
+	return append(args, setHLSFlags(opt.Format.HLS, output, len(opt.Outputs))...)
+}
+
+// hlsKeyDir returns the directory the key of an encrypted HLS output is
+// written to, so it isn't published next to the segments it protects.
+// Defaults to a directory in the system temp directory named after the
+// output directory.
+func hlsKeyDir(opt hlsOptions, output string, variants int) string {
+	if opt.KeyDir != "" {
+		return opt.KeyDir
+	}
+	dir, _ := hlsPaths(output, variants)
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = abs
+	}
+	sum := sha256.Sum256([]byte(dir))
+	return filepath.Join(os.TempDir(), "ffmpegd-hls-"+hex.EncodeToString(sum[:8]))
+}
+
+// prepareHLS creates the output directory and, if encrypting, a random
+// AES-128 key and the key info file read by the hls muxer in the private key
+// directory.
+func prepareHLS(opt hlsOptions, output string, variants int) error {
+	dir, _ := hlsPaths(output, variants)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	if !opt.Encrypt {
+		return nil
+	}
+
+	keyDir := hlsKeyDir(opt, output, variants)
+	if err := os.MkdirAll(keyDir, 0700); err != nil {
+		return err
+	}
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	keyPath := filepath.Join(keyDir, hlsKeyFile)
+	if err := os.WriteFile(keyPath, key, 0600); err != nil {
+		return err
+	}
+
+	uri := opt.KeyURI
+	if uri == "" {
+		uri = hlsKeyFile
+	}
+	keyInfo := uri + "\n" + keyPath + "\n"
+	return os.WriteFile(filepath.Join(keyDir, hlsKeyInfoFile), []byte(keyInfo), 0600)
+}
+
+// removeHLSKeyInfo removes the key info file of an encrypted HLS output once
+// it's muxed, leaving the key.
+func removeHLSKeyInfo(opt *ffmpegOptions, output string) {
+	if opt.Format.Container == "hls" && opt.Format.HLS.Encrypt {
+		os.Remove(filepath.Join(hlsKeyDir(opt.Format.HLS, output, len(opt.Outputs)), hlsKeyInfoFile))
+	}
+}
+
+// hlsFiles lists the playlists and segments written to an HLS output
+// directory.
+func hlsFiles(output string, variants int) ([]string, error) {
+	dir, _ := hlsPaths(output, variants)
+	patterns := []string{"*.m3u8", "segment_*", "stream_*", "init*.mp4"}
+
+	files := []string{}
+	seen := map[string]bool{}
+	for _, p := range patterns {
+		matches, err := filepath.Glob(filepath.Join(dir, p))
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range matches {
+			if !seen[m] {
+				seen[m] = true
+				files = append(files, m)
+			}
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
@@ -0,0 +1,126 @@
+package ffmpeg
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseOptionsHLS(t *testing.T) {
+	payload := `{"format":{"container":"hls","hls":{"segment_duration":4,"segment_type":"fmp4"}},"video":{"codec":"libx264","faststart":true},"audio":{"codec":"aac"},"filter":{"denoise":"none","deinterlace":"none"}}`
+	args, err := parseOptions(testFile, "out", payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := strings.Join(args, " ")
+
+	want := "-c:v libx264 -c:a aac -y -f hls -hls_time 4 -hls_playlist_type vod -hls_segment_type fmp4 -hls_segment_filename out/segment_%03d.m4s out/index.m3u8"
+	if !strings.HasSuffix(cmd, want) {
+		t.Errorf("got %s, want suffix %s", cmd, want)
+	}
+}
+
+func TestParseOptionsHLSVariants(t *testing.T) {
+	payload := `{
+		"format": {"container": "hls"},
+		"outputs": [
+			{"video": {"codec": "libx264", "size": "720", "bitrate": "3M"}, "audio": {"codec": "aac", "quality": "128k"}},
+			{"video": {"codec": "libx264", "size": "480", "bitrate": "1M"}, "audio": {"codec": "aac", "quality": "96k"}}
+		]
+	}`
+	args, err := parseOptions(testFile, "out", payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := strings.Join(args, " ")
+
+	parts := []string{
+		"-map [v0] -map 0:a:0 -map [v1] -map 0:a:0",
+		"-c:v:0 libx264 -b:v:0 3M -c:a:0 aac -b:a:0 128k",
+		"-c:v:1 libx264 -b:v:1 1M -c:a:1 aac -b:a:1 96k",
+		`-var_stream_map v:0,a:0 v:1,a:1`,
+		"-master_pl_name master.m3u8 -hls_segment_filename out/stream_%v_%03d.ts out/stream_%v.m3u8",
+	}
+	for _, p := range parts {
+		if !strings.Contains(cmd, p) {
+			t.Errorf("missing %q: %s", p, cmd)
+		}
+	}
+
+	outputs, err := Outputs("out", payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outputs) != 1 || outputs[0] != filepath.Join("out", "master.m3u8") {
+		t.Errorf("unexpected outputs: %v", outputs)
+	}
+}
+
+func TestPrepareHLSEncrypt(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "hls")
+	keyDir := filepath.Join(t.TempDir(), "keys")
+	opt := hlsOptions{Encrypt: true, KeyURI: "https://example.com/key", KeyDir: keyDir}
+	if err := prepareHLS(opt, dir, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := os.ReadFile(filepath.Join(keyDir, hlsKeyFile))
+	if err != nil || len(key) != 16 {
+		t.Errorf("unexpected key: %v %v", key, err)
+	}
+	if info, err := os.Stat(filepath.Join(keyDir, hlsKeyFile)); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("unexpected key mode: %v %v", info, err)
+	}
+
+	info, err := os.ReadFile(filepath.Join(keyDir, hlsKeyInfoFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "https://example.com/key\n" + filepath.Join(keyDir, hlsKeyFile) + "\n"
+	if string(info) != want {
+		t.Errorf("got %q, want %q", info, want)
+	}
+
+	// Nothing is written to the published output directory.
+	if files, err := hlsFiles(dir, 1); err != nil || len(files) != 0 {
+		t.Errorf("got %v, %v", files, err)
+	}
+	options := &ffmpegOptions{Format: formatOptions{Container: "hls", HLS: opt}}
+	removeHLSKeyInfo(options, dir)
+	if _, err := os.Stat(filepath.Join(keyDir, hlsKeyInfoFile)); !os.IsNotExist(err) {
+		t.Error("key info was not removed")
+	}
+
+	// Without a key directory, the key is written outside the output.
+	if d := hlsKeyDir(hlsOptions{}, dir, 1); d == dir || filepath.Dir(d) != os.TempDir() {
+		t.Errorf("got key dir %s", d)
+	}
+}
+
+func TestRenditionsWithoutAudio(t *testing.T) {
+	payload := `{
+		"format": {"container": "hls"},
+		"outputs": [
+			{"video": {"codec": "libx264", "size": "720"}, "audio": {"codec": "aac"}},
+			{"video": {"codec": "libx264", "size": "480"}, "audio": {"codec": "aac"}}
+		]
+	}`
+	opt, err := decodeOptions(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setRenditionAudio(opt, &FFProbeResponse{Streams: []stream{{CodecType: "video"}}})
+	args, streamMap := setRenditions(opt)
+	cmd := strings.Join(args, " ")
+	if strings.Contains(cmd, "0:a") || strings.Join(streamMap, " ") != "v:0 v:1" {
+		t.Errorf("got %s, %v", cmd, streamMap)
+	}
+
+	// Inputs with audio keep it.
+	opt, _ = decodeOptions(payload)
+	setRenditionAudio(opt, &FFProbeResponse{Streams: []stream{{CodecType: "video"}, {CodecType: "audio"}}})
+	if _, streamMap := setRenditions(opt); strings.Join(streamMap, " ") != "v:0,a:0 v:1,a:1" {
+		t.Errorf("got %v", streamMap)
+	}
+}
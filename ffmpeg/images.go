@@ -0,0 +1,298 @@
+package ffmpeg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Matches the frame number in an image sequence pattern, e.g. %04d.
+var framePattern = regexp.MustCompile(`%\d*d`)
+
+// Image job types.
+const (
+	JobPoster     = "poster"     // Single frame at a timestamp.
+	JobThumbnails = "thumbnails" // A frame every interval.
+	JobSprite     = "sprite"     // Tiled sprite sheet with a WebVTT thumbnails track.
+	JobPreview    = "preview"    // Animated GIF or WebP.
+)
+
+const (
+	imageWidth       = 320
+	spriteTileWidth  = 160
+	spriteColumns    = 10
+	imageCount       = 10
+	previewFrameRate = 2
+	thumbnailPattern = "thumb_%04d.jpg"
+)
+
+// imageOptions struct passed into FFmpeg.RunImages.
+type imageOptions struct {
+	Timestamp string  `json:"timestamp"`  // Poster position, e.g. "5.5" or "00:01:30". Defaults to 10% in.
+	Interval  float64 `json:"interval"`   // Seconds between frames.
+	Count     int     `json:"count"`      // Frames spaced evenly across the input, if no interval is set.
+	Width     int     `json:"width"`      // Frame width. Height keeps the aspect ratio.
+	Columns   int     `json:"columns"`    // Sprite sheet columns.
+	FrameRate int     `json:"frame_rate"` // Preview playback frame rate.
+}
+
+// RunImages runs a poster, thumbnails, sprite or preview job. The input probe
+// is used to space frames evenly across its duration.
+func (f *FFmpeg) RunImages(typ, input, output, data string, probe *FFProbeResponse) error {
+	opt, err := decodeImageOptions(data)
+	if err != nil {
+		return err
+	}
+
+	args, err := imageArgs(typ, input, output, opt, probe)
+	if err != nil {
+		return err
+	}
+
+	if typ == JobThumbnails {
+		if err := os.MkdirAll(filepath.Dir(thumbnailPath(output)), 0755); err != nil {
+			return err
+		}
+	}
+
+	if err := f.run(args); err != nil {
+		return err
+	}
+
+	if typ == JobSprite {
+		return writeSpriteVTT(output, opt, probe)
+	}
+	return nil
+}
+
+// ImageCommand returns the ffmpeg argv of an image job without running it.
+func ImageCommand(typ, input, output, data string) ([]string, error) {
+	opt, err := decodeImageOptions(data)
+	if err != nil {
+		return nil, err
+	}
+	probe, err := FFProbe{}.Run(input)
+	if err != nil {
+		return nil, err
+	}
+	args, err := imageArgs(typ, input, output, opt, probe)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{ffmpegCmd}, args...), nil
+}
+
+func decodeImageOptions(data string) (imageOptions, error) {
+	opt := imageOptions{}
+	if data != "" {
+		if err := json.Unmarshal([]byte(data), &opt); err != nil {
+			return opt, err
+		}
+	}
+	return opt, nil
+}
+
+// ImageFiles lists the files written by an image job.
+func ImageFiles(typ, output string) ([]string, error) {
+	switch typ {
+	case JobThumbnails:
+		pattern := framePattern.ReplaceAllString(thumbnailPath(output), "*")
+		files, err := filepath.Glob(pattern)
+		sort.Strings(files)
+		return files, err
+	case JobSprite:
+		return []string{output, spriteVTTPath(output)}, nil
+	}
+	return []string{output}, nil
+}
+
+// imageArgs builds the ffmpeg arguments for an image job.
+func imageArgs(typ, input, output string, opt imageOptions, probe *FFProbeResponse) ([]string, error) {
+	args := []string{
+		"-hide_banner",
+		"-loglevel", "error",
+		"-progress", "pipe:1",
+	}
+	duration := probe.Duration()
+
+	switch typ {
+	case JobPoster:
+		ts := opt.Timestamp
+		if ts == "" {
+			ts = formatSeconds(duration * 0.1)
+		}
+		args = append(args, "-ss", ts, "-i", input, "-frames:v", "1")
+		if opt.Width > 0 {
+			args = append(args, "-vf", "scale="+strconv.Itoa(opt.Width)+":-2")
+		}
+
+	case JobThumbnails:
+		step, err := frameStep(opt, duration)
+		if err != nil {
+			return nil, err
+		}
+		vf := "fps=1/" + formatSeconds(step)
+		if opt.Width > 0 {
+			vf += ",scale=" + strconv.Itoa(opt.Width) + ":-2"
+		}
+		args = append(args, "-i", input, "-vf", vf)
+		output = thumbnailPath(output)
+
+	case JobSprite:
+		step, err := frameStep(opt, duration)
+		if err != nil {
+			return nil, err
+		}
+		w, h, err := tileSize(opt, probe)
+		if err != nil {
+			return nil, err
+		}
+		cols, rows := spriteGrid(opt, duration, step)
+		vf := fmt.Sprintf("fps=1/%s,scale=%d:%d,tile=%dx%d", formatSeconds(step), w, h, cols, rows)
+		args = append(args, "-i", input, "-vf", vf, "-frames:v", "1")
+
+	case JobPreview:
+		count := opt.Count
+		if count <= 0 {
+			count = imageCount
+		}
+		if duration <= 0 {
+			return nil, errors.New("input duration is unknown")
+		}
+		width := opt.Width
+		if width <= 0 {
+			width = imageWidth
+		}
+		rate := opt.FrameRate
+		if rate <= 0 {
+			rate = previewFrameRate
+		}
+
+		vf := fmt.Sprintf("fps=%s,scale=%d:-2:flags=lanczos,setpts=N/(%d*TB)",
+			formatSeconds(float64(count)/duration), width, rate)
+		if strings.ToLower(filepath.Ext(output)) == ".webp" {
+			args = append(args, "-i", input, "-vf", vf, "-c:v", "libwebp")
+		} else {
+			vf += ",split[a][b];[a]palettegen[p];[b][p]paletteuse"
+			args = append(args, "-i", input, "-vf", vf)
+		}
+		args = append(args, "-frames:v", strconv.Itoa(count), "-loop", "0", "-an")
+
+	default:
+		return nil, errors.New("unknown image job type: " + typ)
+	}
+
+	return append(args, "-y", output), nil
+}
+
+// frameStep returns the seconds between frames, from the interval or by
+// spacing the frame count evenly across the duration.
+func frameStep(opt imageOptions, duration float64) (float64, error) {
+	if opt.Interval > 0 {
+		return opt.Interval, nil
+	}
+	if duration <= 0 {
+		return 0, errors.New("input duration is unknown, set an interval")
+	}
+
+	count := opt.Count
+	if count <= 0 {
+		count = imageCount
+	}
+	return duration / float64(count), nil
+}
+
+// tileSize returns the sprite tile size, scaled to the tile width with the
+// displayed aspect ratio and an even height.
+func tileSize(opt imageOptions, probe *FFProbeResponse) (int, int, error) {
+	video := probe.videoStream()
+	if video == nil || video.Width == 0 {
+		return 0, 0, errors.New("input has no video stream")
+	}
+
+	w := opt.Width
+	if w <= 0 {
+		w = spriteTileWidth
+	}
+	width, height := video.displaySize()
+	h := int(math.Round(float64(w)*float64(height)/float64(width)/2)) * 2
+	return w, h, nil
+}
+
+// spriteGrid returns the columns and rows needed to fit every frame.
+func spriteGrid(opt imageOptions, duration, step float64) (int, int) {
+	frames := int(math.Ceil(duration / step))
+	if frames < 1 {
+		frames = 1
+	}
+
+	cols := opt.Columns
+	if cols <= 0 {
+		cols = spriteColumns
+	}
+	if frames < cols {
+		cols = frames
+	}
+	rows := int(math.Ceil(float64(frames) / float64(cols)))
+	return cols, rows
+}
+
+// writeSpriteVTT writes a WebVTT thumbnails track mapping each interval of the
+// input to its tile in the sprite sheet.
+func writeSpriteVTT(output string, opt imageOptions, probe *FFProbeResponse) error {
+	duration := probe.Duration()
+	step, err := frameStep(opt, duration)
+	if err != nil {
+		return err
+	}
+	w, h, err := tileSize(opt, probe)
+	if err != nil {
+		return err
+	}
+	cols, rows := spriteGrid(opt, duration, step)
+
+	var b strings.Builder
+	b.WriteString("WEBVTT\n")
+	sprite := filepath.Base(output)
+	for i := 0; i < cols*rows; i++ {
+		start := float64(i) * step
+		if start >= duration {
+			break
+		}
+		end := math.Min(start+step, duration)
+		x, y := (i%cols)*w, (i/cols)*h
+
+		fmt.Fprintf(&b, "\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n",
+			vttTimestamp(start), vttTimestamp(end), sprite, x, y, w, h)
+	}
+	return os.WriteFile(spriteVTTPath(output), []byte(b.String()), 0644)
+}
+
+// thumbnailPath returns the numbered output pattern for thumbnails. The output
+// may be a pattern containing %d or a directory.
+func thumbnailPath(output string) string {
+	if strings.Contains(output, "%") {
+		return output
+	}
+	return filepath.Join(output, thumbnailPattern)
+}
+
+func spriteVTTPath(output string) string {
+	return strings.TrimSuffix(output, filepath.Ext(output)) + ".vtt"
+}
+
+func formatSeconds(s float64) string {
+	return strconv.FormatFloat(s, 'f', -1, 64)
+}
+
+func vttTimestamp(s float64) string {
+	ms := int(math.Round(s * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
@@ -0,0 +1,75 @@
+package ffmpeg
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testImageProbe = &FFProbeResponse{
+	Streams: []stream{{CodecType: "video", Width: 1280, Height: 534}},
+	Format:  format{Duration: "100"},
+}
+
+func TestImageArgs(t *testing.T) {
+	tests := []struct {
+		typ    string
+		opt    imageOptions
+		output string
+		want   string
+	}{
+		{JobPoster, imageOptions{}, "poster.jpg", "-ss 10 -i in.mp4 -frames:v 1 -y poster.jpg"},
+		{JobPoster, imageOptions{Timestamp: "00:00:05", Width: 640}, "poster.jpg", "-ss 00:00:05 -i in.mp4 -frames:v 1 -vf scale=640:-2 -y poster.jpg"},
+		{JobThumbnails, imageOptions{Interval: 5}, "thumbs", "-i in.mp4 -vf fps=1/5 -y " + filepath.Join("thumbs", "thumb_%04d.jpg")},
+		{JobSprite, imageOptions{Count: 20, Columns: 5}, "sprite.jpg", "-i in.mp4 -vf fps=1/5,scale=160:66,tile=5x4 -frames:v 1 -y sprite.jpg"},
+		{JobPreview, imageOptions{}, "preview.gif", "-i in.mp4 -vf fps=0.1,scale=320:-2:flags=lanczos,setpts=N/(2*TB),split[a][b];[a]palettegen[p];[b][p]paletteuse -frames:v 10 -loop 0 -an -y preview.gif"},
+		{JobPreview, imageOptions{Count: 5, FrameRate: 4}, "preview.webp", "-i in.mp4 -vf fps=0.05,scale=320:-2:flags=lanczos,setpts=N/(4*TB) -c:v libwebp -frames:v 5 -loop 0 -an -y preview.webp"},
+	}
+
+	for _, tt := range tests {
+		args, err := imageArgs(tt.typ, "in.mp4", tt.output, tt.opt, testImageProbe)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := strings.Join(args, " ")
+		if !strings.HasSuffix(got, tt.want) {
+			t.Errorf("%s: got %s, want suffix %s", tt.typ, got, tt.want)
+		}
+	}
+}
+
+func TestImageArgsUnknownDuration(t *testing.T) {
+	probe := &FFProbeResponse{Streams: testImageProbe.Streams}
+	_, err := imageArgs(JobThumbnails, "in.mp4", "thumbs", imageOptions{}, probe)
+	if err == nil {
+		t.Error()
+	}
+}
+
+func TestWriteSpriteVTT(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "sprite.jpg")
+	opt := imageOptions{Interval: 40, Columns: 2}
+	if err := writeSpriteVTT(output, opt, testImageProbe); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(filepath.Dir(output), "sprite.vtt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `WEBVTT
+
+00:00:00.000 --> 00:00:40.000
+sprite.jpg#xywh=0,0,160,66
+
+00:00:40.000 --> 00:01:20.000
+sprite.jpg#xywh=160,0,160,66
+
+00:01:20.000 --> 00:01:40.000
+sprite.jpg#xywh=0,66,160,66
+`
+	if string(b) != want {
+		t.Errorf("got %s, want %s", b, want)
+	}
+}
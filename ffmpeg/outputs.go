@@ -0,0 +1,284 @@
+package ffmpeg
+
+import (
+	"strconv"
+	"strings"
+)
+
+// outputOptions is a single output of a multi-output job, such as one
+// rendition of an ABR ladder.
+type outputOptions struct {
+	Output string        `json:"output"`
+	Video  videoOptions  `json:"video"`
+	Audio  audioOptions  `json:"audio"`
+	Filter filterOptions `json:"filter"`
+}
+
+// Outputs returns the output paths of a job. For a single output job this is
+// the output passed in.
+func Outputs(output, data string) ([]string, error) {
+	options, err := decodeOptions(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(options.Raw) > 0 {
+		return []string{output}, nil
+	}
+
+	// Packaged outputs return the playlist.
+	switch options.Format.Container {
+	case "hls":
+		_, playlist := hlsPaths(output, len(options.Outputs))
+		return []string{playlist}, nil
+	case "dash":
+		_, manifest := dashPaths(output)
+		return []string{manifest}, nil
+	}
+
+	if len(options.Outputs) == 0 {
+		return []string{output}, nil
+	}
+
+	outputs := []string{}
+	for _, o := range options.Outputs {
+		outputs = append(outputs, o.Output)
+	}
+	return outputs, nil
+}
+
+// OutputFiles lists every file written by a job with a packaged container
+// such as HLS or DASH, after it has run. Returns nil for other jobs.
+func OutputFiles(output, data string) ([]string, error) {
+	options, err := decodeOptions(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(options.Raw) > 0 {
+		return nil, nil
+	}
+
+	switch options.Format.Container {
+	case "hls":
+		return hlsFiles(output, len(options.Outputs))
+	case "dash":
+		return dashFiles(output)
+	}
+	return nil, nil
+}
+
+// multipleOutputs returns the paths of a payload's multiple outputs, or nil
+// if it doesn't set them. HLS variants and DASH representations are written
+// to the job output instead.
+func multipleOutputs(data string) []string {
+	options, err := decodeOptions(data)
+	if err != nil || len(options.Raw) > 0 || options.Format.Container == "hls" || options.Format.Container == "dash" {
+		return nil
+	}
+	var paths []string
+	for _, o := range options.Outputs {
+		paths = append(paths, o.Output)
+	}
+	return paths
+}
+
+// prepareOutput creates anything ffmpeg expects to exist before it writes the
+// outputs.
+func prepareOutput(output string, opt *ffmpegOptions) error {
+	if len(opt.Raw) > 0 {
+		return nil
+	}
+
+	switch opt.Format.Container {
+	case "hls":
+		return prepareHLS(opt.Format.HLS, output, len(opt.Outputs))
+	case "dash":
+		return prepareDASH(output)
+	}
+	return nil
+}
+
+// setOutputs compiles multiple outputs into a single ffmpeg invocation. The
+// source video is decoded once and split in a -filter_complex graph, with each
+// output's filters applied to its own branch.
+func setOutputs(opt *ffmpegOptions) []string {
+	args, labels := splitVideo(opt.Outputs)
+
+	// Map and set flags for each output.
+	for i, o := range opt.Outputs {
+		args = append(args, "-map", labels[i], "-map", "0:a?")
+
+		// Clip options apply to every output.
+		if opt.Format.Clip {
+			args = append(args, setFormatFlags(opt.Format)...)
+		}
+
+		args = append(args, setVideoFlags(o.Video)...)
+		args = append(args, setAudioFlags(o.Audio)...)
+
+		af := setAudioFilters(o.Audio, o.Filter)
+		if af != "" {
+			args = append(args, "-af", af)
+		}
+
+		args = append(args, overwriteFlag(opt), o.Output)
+	}
+
+	return args
+}
+
+// splitVideo builds a -filter_complex graph splitting the source video into a
+// filtered branch per output. Returns the graph args and the stream each
+// output should map, which is the source video for outputs that copy it.
+func splitVideo(outputs []outputOptions) ([]string, []string) {
+	labels := make([]string, len(outputs))
+
+	// Outputs that copy video are mapped from the source instead of the graph.
+	filtered := []int{}
+	for i, o := range outputs {
+		if o.Video.Codec == "copy" {
+			labels[i] = "0:v:0"
+		} else {
+			filtered = append(filtered, i)
+		}
+	}
+
+	// Split the source video into a branch per filtered output.
+	graph := []string{}
+	if len(filtered) > 1 {
+		split := "[0:v]split=" + strconv.Itoa(len(filtered))
+		for _, i := range filtered {
+			split += "[s" + strconv.Itoa(i) + "]"
+		}
+		graph = append(graph, split)
+	}
+
+	for _, i := range filtered {
+		o := outputs[i]
+		in := "[0:v]"
+		if len(filtered) > 1 {
+			in = "[s" + strconv.Itoa(i) + "]"
+		}
+		chain := uniqueLabels(setVideoFilters(o.Video, normalizeFilters(o.Filter)), i)
+		if chain == "" {
+			chain = "null"
+		}
+		labels[i] = "[v" + strconv.Itoa(i) + "]"
+		graph = append(graph, in+chain+labels[i])
+	}
+
+	if len(graph) == 0 {
+		return []string{}, labels
+	}
+	return []string{"-filter_complex", strings.Join(graph, ";")}, labels
+}
+
+// setRenditions maps each output as a rendition of a single packaged output,
+// such as HLS variants or DASH representations, with flags scoped to the
+// rendition's streams. Returns the args and each rendition's streams in
+// var_stream_map form, e.g. "v:0,a:0". Renditions with audio codec "none"
+// have no audio.
+func setRenditions(opt *ffmpegOptions) ([]string, []string) {
+	args, labels := splitVideo(opt.Outputs)
+
+	// Map video and audio for each rendition.
+	streamMap := []string{}
+	audio := 0
+	for i, o := range opt.Outputs {
+		args = append(args, "-map", labels[i])
+		m := "v:" + strconv.Itoa(i)
+		if o.Audio.Codec != "none" {
+			args = append(args, "-map", "0:a:0")
+			m += ",a:" + strconv.Itoa(audio)
+			audio++
+		}
+		streamMap = append(streamMap, m)
+	}
+
+	if opt.Format.Clip {
+		args = append(args, setFormatFlags(opt.Format)...)
+	}
+
+	audio = 0
+	for i, o := range opt.Outputs {
+		args = append(args, streamFlags(setVideoFlags(o.Video), "v", i)...)
+		if o.Audio.Codec == "none" {
+			continue
+		}
+		args = append(args, streamFlags(setAudioFlags(o.Audio), "a", audio)...)
+
+		af := setAudioFilters(o.Audio, o.Filter)
+		if af != "" {
+			args = append(args, "-filter:a:"+strconv.Itoa(audio), af)
+		}
+		audio++
+	}
+
+	return append(args, overwriteFlag(opt)), streamMap
+}
+
+// dropMissingAudio probes the input of HLS or DASH renditions that map audio,
+// and drops the audio of every rendition if the input has none. Their
+// -map 0:a:0 would otherwise fail the encode.
+func dropMissingAudio(input string, opt *ffmpegOptions) error {
+	if len(opt.Outputs) == 0 || (opt.Format.Container != "hls" && opt.Format.Container != "dash") {
+		return nil
+	}
+	for _, o := range opt.Outputs {
+		if o.Audio.Codec != "none" {
+			probe, err := FFProbe{}.Run(input)
+			if err != nil {
+				return err
+			}
+			setRenditionAudio(opt, probe)
+			return nil
+		}
+	}
+	return nil
+}
+
+// setRenditionAudio sets the audio codec of every rendition to "none" if the
+// input has no audio stream.
+func setRenditionAudio(opt *ffmpegOptions, probe *FFProbeResponse) {
+	if len(probe.audioStreams()) > 0 {
+		return
+	}
+	for i := range opt.Outputs {
+		opt.Outputs[i].Audio.Codec = "none"
+	}
+}
+
+// streamFlags scopes flag/value pairs to the i-th output stream of a type,
+// e.g. -c:v to -c:v:1 and -crf to -crf:v:1.
+func streamFlags(args []string, typ string, i int) []string {
+	scoped := []string{}
+	index := strconv.Itoa(i)
+
+	for n := 0; n+1 < len(args); n += 2 {
+		flag, value := args[n], args[n+1]
+		switch {
+		case flag == "-movflags":
+			continue // mp4 muxer only.
+		case flag == "-rematrix_maxval":
+			// Resampler option, applies to all streams.
+		case strings.HasSuffix(flag, ":"+typ):
+			flag += ":" + index
+		default:
+			flag += ":" + typ + ":" + index
+		}
+		scoped = append(scoped, flag, value)
+	}
+	return scoped
+}
+
+// normalizeFilters treats omitted denoise and deinterlace options as "none".
+func normalizeFilters(opt filterOptions) filterOptions {
+	if opt.Denoise == "" {
+		opt.Denoise = "none"
+	}
+	if opt.Deinterlace == "" {
+		opt.Deinterlace = "none"
+	}
+	return opt
+}
@@ -0,0 +1,56 @@
+package ffmpeg
+
+import (
+	"strings"
+	"testing"
+)
+
+const testOutputsPayload = `{
+	"outputs": [
+		{"output": "1080p.mp4", "video": {"codec": "libx264", "size": "1080"}, "audio": {"codec": "aac"}},
+		{"output": "720p.mp4", "video": {"codec": "libx264", "size": "720"}, "audio": {"codec": "aac"}},
+		{"output": "source.mkv", "video": {"codec": "copy"}, "audio": {"codec": "copy"}}
+	]
+}`
+
+func TestParseOptionsOutputs(t *testing.T) {
+	args, err := parseOptions(testFile, "", testOutputsPayload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := strings.Join(args, " ")
+
+	graph := "-filter_complex [0:v]split=2[s0][s1];[s0]scale=-1:1080[v0];[s1]scale=-1:720[v1]"
+	if !strings.Contains(cmd, graph) {
+		t.Errorf("missing filter graph: %s", cmd)
+	}
+
+	outputs := []string{
+		"-map [v0] -map 0:a? -c:v libx264 -c:a aac -y 1080p.mp4",
+		"-map [v1] -map 0:a? -c:v libx264 -c:a aac -y 720p.mp4",
+		"-map 0:v:0 -map 0:a? -c:v copy -c:a copy -y source.mkv",
+	}
+	for _, o := range outputs {
+		if !strings.Contains(cmd, o) {
+			t.Errorf("missing output %q: %s", o, cmd)
+		}
+	}
+}
+
+func TestOutputs(t *testing.T) {
+	outputs, err := Outputs("", testOutputsPayload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outputs) != 3 || outputs[1] != "720p.mp4" {
+		t.Errorf("unexpected outputs: %v", outputs)
+	}
+
+	outputs, err = Outputs("out.mp4", testPayload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outputs) != 1 || outputs[0] != "out.mp4" {
+		t.Errorf("unexpected outputs: %v", outputs)
+	}
+}
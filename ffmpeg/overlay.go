@@ -0,0 +1,134 @@
+package ffmpeg
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+// Matches a link label in a filtergraph.
+var graphLabel = regexp.MustCompile(`\[(\w+)\]`)
+
+const (
+	overlayPosition = "bottom-right"
+	overlayMargin   = 0.02 // Of the video width.
+	textSize        = 0.05 // Of the video height.
+	textColor       = "white"
+)
+
+// watermarkOptions overlays an image. Sizes are relative to the video.
+type watermarkOptions struct {
+	Image    string  `json:"image"`    // Image file.
+	Position string  `json:"position"` // top-left, top-right, bottom-left, bottom-right or center.
+	Margin   float64 `json:"margin"`   // Distance from the edges, as a fraction of the video width.
+	Opacity  float64 `json:"opacity"`  // 0 to 1.
+	Scale    float64 `json:"scale"`    // Image width as a fraction of the video width. Defaults to the image size.
+}
+
+// textOptions draws text over the video.
+type textOptions struct {
+	Text     string  `json:"text"`     // Static text.
+	Source   string  `json:"source"`   // text, timecode or filename.
+	Font     string  `json:"font"`     // Font file. Defaults to the fontconfig default.
+	Size     float64 `json:"size"`     // Font size as a fraction of the video height.
+	Color    string  `json:"color"`    // Font color, e.g. white or #ffcc00@0.8.
+	Box      bool    `json:"box"`      // Draw a translucent box behind the text.
+	Position string  `json:"position"` // top-left, top-right, bottom-left, bottom-right or center.
+	Margin   float64 `json:"margin"`   // Distance from the edges, as a fraction of the video width.
+}
+
+// setText sets the text of filename overlays from the input.
+func setText(input string, opt *filterOptions) {
+	for i := range opt.Text {
+		if opt.Text[i].Source == "filename" {
+			opt.Text[i].Text = filepath.Base(input)
+		}
+	}
+}
+
+// setDrawText returns a drawtext filter for a text overlay.
+func setDrawText(opt textOptions) string {
+	filter := "drawtext="
+	if opt.Font != "" {
+		filter += "fontfile=" + escapeFilterValue(opt.Font) + ":"
+	}
+
+	if opt.Source == "timecode" {
+		filter += "text=" + escapeFilterValue("%{pts:hms}")
+	} else {
+		filter += "expansion=none:text=" + escapeFilterValue(opt.Text)
+	}
+
+	size := opt.Size
+	if size <= 0 {
+		size = textSize
+	}
+	color := opt.Color
+	if color == "" {
+		color = textColor
+	}
+	filter += fmt.Sprintf(":fontsize=h*%g:fontcolor=%s", size, escapeFilterValue(color))
+
+	if opt.Box {
+		filter += ":box=1:boxcolor=black@0.5:boxborderw=8"
+	}
+
+	x, y := overlayXY(opt.Position, opt.Margin, "w", "h", "tw", "th")
+	return filter + ":x=" + x + ":y=" + y
+}
+
+// setWatermark overlays a watermark image on the video filter chain. The image
+// is read with the movie source so the graph still has a single input and can
+// be used with -vf.
+func setWatermark(chain string, opt *watermarkOptions) string {
+	if chain == "" {
+		chain = "null"
+	}
+
+	wm := "movie=filename=" + escapeFilterValue(opt.Image) + ",format=rgba"
+	if opt.Opacity > 0 && opt.Opacity < 1 {
+		wm += fmt.Sprintf(",colorchannelmixer=aa=%g", opt.Opacity)
+	}
+
+	graph := chain + "[main];" + wm + "[wm];"
+	if opt.Scale > 0 {
+		graph += fmt.Sprintf("[wm][main]scale2ref=w=main_w*%g:h=ow/a[wms][mains];[mains][wms]", opt.Scale)
+	} else {
+		graph += "[main][wm]"
+	}
+
+	x, y := overlayXY(opt.Position, opt.Margin, "main_w", "main_h", "overlay_w", "overlay_h")
+	return graph + "overlay=x=" + x + ":y=" + y
+}
+
+// overlayXY returns the x and y expressions placing an overlay of size ow by
+// oh at a position in a video of size w by h.
+func overlayXY(position string, margin float64, w, h, ow, oh string) (string, string) {
+	if margin <= 0 {
+		margin = overlayMargin
+	}
+	m := w + "*" + strconv.FormatFloat(margin, 'f', -1, 64)
+
+	left, top := m, m
+	right := w + "-" + ow + "-" + m
+	bottom := h + "-" + oh + "-" + m
+
+	switch position {
+	case "top-left":
+		return left, top
+	case "top-right":
+		return right, top
+	case "bottom-left":
+		return left, bottom
+	case "center":
+		return "(" + w + "-" + ow + ")/2", "(" + h + "-" + oh + ")/2"
+	}
+	return right, bottom
+}
+
+// uniqueLabels suffixes the link labels in a filter chain, so chains for
+// several outputs can share one filtergraph.
+func uniqueLabels(chain string, n int) string {
+	return graphLabel.ReplaceAllString(chain, "[${1}_"+strconv.Itoa(n)+"]")
+}
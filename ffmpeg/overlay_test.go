@@ -0,0 +1,67 @@
+package ffmpeg
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSetDrawText(t *testing.T) {
+	tests := []struct {
+		opt  textOptions
+		want string
+	}{
+		{
+			textOptions{Text: "Draft: v2"},
+			`drawtext=expansion=none:text=Draft\\: v2:fontsize=h*0.05:fontcolor=white:x=w-tw-w*0.02:y=h-th-w*0.02`,
+		},
+		{
+			textOptions{Source: "timecode", Font: "/fonts/mono.ttf", Size: 0.03, Box: true, Position: "top-left", Margin: 0.05},
+			`drawtext=fontfile=/fonts/mono.ttf:text=%{pts\\:hms}:fontsize=h*0.03:fontcolor=white:box=1:boxcolor=black@0.5:boxborderw=8:x=w*0.05:y=w*0.05`,
+		},
+	}
+	for _, tt := range tests {
+		if got := setDrawText(tt.opt); got != tt.want {
+			t.Errorf("got %s, want %s", got, tt.want)
+		}
+	}
+}
+
+func TestSetWatermark(t *testing.T) {
+	got := setWatermark("", &watermarkOptions{Image: "logo.png", Position: "top-right", Opacity: 0.5})
+	want := "null[main];movie=filename=logo.png,format=rgba,colorchannelmixer=aa=0.5[wm];[main][wm]overlay=x=main_w-overlay_w-main_w*0.02:y=main_w*0.02"
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	got = setWatermark("scale=-1:720", &watermarkOptions{Image: "logo.png", Scale: 0.1, Position: "center"})
+	want = "scale=-1:720[main];movie=filename=logo.png,format=rgba[wm];[wm][main]scale2ref=w=main_w*0.1:h=ow/a[wms][mains];[mains][wms]overlay=x=(main_w-overlay_w)/2:y=(main_h-overlay_h)/2"
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestParseOptionsOverlays(t *testing.T) {
+	payload := `{"filter": {"denoise": "none", "deinterlace": "none", "text": [{"source": "filename"}], "watermark": {"image": "logo.png"}}}`
+	args, err := parseOptions("/media/input.mp4", "out.mp4", payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := strings.Join(args, " ")
+	if !strings.Contains(cmd, "-vf drawtext=expansion=none:text=input.mp4:") || !strings.Contains(cmd, "[main];movie=filename=logo.png") {
+		t.Errorf("missing overlays: %s", cmd)
+	}
+
+	// Labels are unique per output in a shared filtergraph.
+	payload = `{"outputs": [
+		{"output": "a.mp4", "filter": {"watermark": {"image": "logo.png"}}},
+		{"output": "b.mp4", "filter": {"watermark": {"image": "logo.png"}}}
+	]}`
+	args, err = parseOptions("input.mp4", "", payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd = strings.Join(args, " ")
+	if !strings.Contains(cmd, "[s0]null[main_0];") || !strings.Contains(cmd, "[main_1][wm_1]overlay") {
+		t.Errorf("labels are not unique: %s", cmd)
+	}
+}
@@ -0,0 +1,388 @@
+package ffmpeg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Metrics measured if none are set.
+var defaultQualityMetrics = []string{"vmaf", "ssim", "psnr"}
+
+// Match the per-frame scores in the ssim and psnr stats files.
+var (
+	ssimPattern = regexp.MustCompile(`All:(\S+)`)
+	psnrPattern = regexp.MustCompile(`psnr_avg:(\S+)`)
+)
+
+// PSNR of identical frames, which is infinite.
+const maxPSNR = 100
+
+// qualityOptions struct passed into FFmpeg.RunQuality, or set on an encode to
+// measure its outputs.
+type qualityOptions struct {
+	Metrics   []string `json:"metrics"`   // vmaf, ssim and psnr. Defaults to all three.
+	Model     string   `json:"model"`     // libvmaf model version, e.g. vmaf_4k_v0.6.1.
+	Frames    bool     `json:"frames"`    // Include per-frame scores in the result.
+	StartTime string   `json:"startTime"` // Range of the input the output was encoded from.
+	StopTime  string   `json:"stopTime"`
+}
+
+// Quality is the result of a quality measurement.
+type Quality struct {
+	VMAF     *Score         `json:"vmaf,omitempty"`
+	SSIM     *Score         `json:"ssim,omitempty"`
+	PSNR     *Score         `json:"psnr,omitempty"` // dB.
+	Frames   []FrameQuality `json:"frames,omitempty"`
+	Warnings []string       `json:"warnings,omitempty"` // Metrics that were skipped.
+}
+
+// Score aggregates the per-frame scores of a metric.
+type Score struct {
+	Mean float64 `json:"mean"`
+	Min  float64 `json:"min"`
+	Max  float64 `json:"max"`
+}
+
+// FrameQuality is the scores of a single frame.
+type FrameQuality struct {
+	Frame int     `json:"frame"`
+	VMAF  float64 `json:"vmaf,omitempty"`
+	SSIM  float64 `json:"ssim,omitempty"`
+	PSNR  float64 `json:"psnr,omitempty"`
+}
+
+// vmafLog is the JSON log written by libvmaf.
+type vmafLog struct {
+	Frames []struct {
+		Metrics struct {
+			VMAF float64 `json:"vmaf"`
+		} `json:"metrics"`
+	} `json:"frames"`
+}
+
+// RunQuality measures the distorted output against the reference input,
+// scaling it to the reference size. VMAF is skipped with a warning if ffmpeg
+// is built without libvmaf.
+func (f *FFmpeg) RunQuality(reference, distorted, data string, probe *FFProbeResponse) (*Quality, error) {
+	opt, err := decodeQualityOptions(data)
+	if err != nil {
+		return nil, err
+	}
+	return f.runQuality(reference, distorted, opt, probe)
+}
+
+// QualityCommand returns the ffmpeg argv of a quality job without running it,
+// with the per-frame scores logged to the working directory.
+func QualityCommand(reference, distorted, data string) ([]string, error) {
+	opt, err := decodeQualityOptions(data)
+	if err != nil {
+		return nil, err
+	}
+	probe, err := FFProbe{}.Run(reference)
+	if err != nil {
+		return nil, err
+	}
+	video, metrics, _, err := qualityMetricsFor(opt, probe)
+	if err != nil {
+		return nil, err
+	}
+
+	logs := map[string]string{}
+	for _, m := range metrics {
+		logs[m] = m + ".log"
+	}
+	args := qualityArgs(reference, distorted, opt, metrics, video, logs)
+	return append([]string{ffmpegCmd}, args...), nil
+}
+
+func decodeQualityOptions(data string) (qualityOptions, error) {
+	opt := qualityOptions{}
+	if data != "" {
+		if err := json.Unmarshal([]byte(data), &opt); err != nil {
+			return opt, err
+		}
+	}
+	return opt, nil
+}
+
+// RunEncodeQuality measures an output of an encode against its input if the
+// encode payload sets quality options, and returns nil if it doesn't.
+func (f *FFmpeg) RunEncodeQuality(input, output, data string, probe *FFProbeResponse) (*Quality, error) {
+	options, err := decodeOptions(data)
+	if err != nil || options.Quality == nil {
+		return nil, err
+	}
+
+	// Compare against the clipped range of the input.
+	opt := *options.Quality
+	if options.Format.Clip && opt.StartTime == "" && opt.StopTime == "" {
+		opt.StartTime = options.Format.StartTime
+		opt.StopTime = options.Format.StopTime
+	}
+	return f.runQuality(input, output, opt, probe)
+}
+
+func (f *FFmpeg) runQuality(reference, distorted string, opt qualityOptions, probe *FFProbeResponse) (*Quality, error) {
+	video, metrics, warnings, err := qualityMetricsFor(opt, probe)
+	if err != nil {
+		return nil, err
+	}
+	q := &Quality{Warnings: warnings}
+	if len(metrics) == 0 {
+		return q, nil
+	}
+
+	dir, err := os.MkdirTemp("", "ffmpegd-quality")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	logs := map[string]string{}
+	for _, m := range metrics {
+		logs[m] = filepath.Join(dir, m+".log")
+	}
+
+	args := qualityArgs(reference, distorted, opt, metrics, video, logs)
+	if err := f.run(args); err != nil {
+		return nil, err
+	}
+
+	scores := map[string][]float64{}
+	for _, m := range metrics {
+		b, err := os.ReadFile(logs[m])
+		if err != nil {
+			return nil, err
+		}
+		if scores[m], err = parseQualityLog(m, b); err != nil {
+			return nil, err
+		}
+	}
+
+	q.VMAF = newScore(scores["vmaf"])
+	q.SSIM = newScore(scores["ssim"])
+	q.PSNR = newScore(scores["psnr"])
+	if opt.Frames {
+		q.Frames = frameQuality(scores)
+	}
+	return q, nil
+}
+
+// qualityMetricsFor returns the reference video stream and the metrics to
+// measure it with. VMAF is skipped with a warning if ffmpeg is built without
+// libvmaf.
+func qualityMetricsFor(opt qualityOptions, probe *FFProbeResponse) (*stream, []string, []string, error) {
+	video := probe.videoStream()
+	if video == nil {
+		return nil, nil, nil, errors.New("input has no video stream to compare")
+	}
+	metrics, err := qualityMetrics(opt.Metrics)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var warnings []string
+	if contains(metrics, "vmaf") && !hasFilter("libvmaf") {
+		metrics = remove(metrics, "vmaf")
+		warnings = append(warnings, "ffmpeg is built without libvmaf, vmaf was skipped")
+	}
+	return video, metrics, warnings, nil
+}
+
+// qualityArgs builds the ffmpeg arguments comparing the distorted input to the
+// reference with each metric, writing their per-frame scores to logs.
+func qualityArgs(reference, distorted string, opt qualityOptions, metrics []string, video *stream, logs map[string]string) []string {
+	args := []string{
+		"-hide_banner",
+		"-loglevel", "error",
+		"-progress", "pipe:1",
+		"-i", distorted,
+	}
+	if opt.StartTime != "" {
+		args = append(args, "-ss", opt.StartTime)
+	}
+	if opt.StopTime != "" {
+		args = append(args, "-to", opt.StopTime)
+	}
+	args = append(args, "-i", reference)
+
+	return append(args,
+		"-filter_complex", qualityGraph(opt, metrics, video, logs),
+		"-an", "-f", "null", "-")
+}
+
+// qualityGraph scales the distorted video to the reference and splits both
+// into a filter for each metric.
+func qualityGraph(opt qualityOptions, metrics []string, video *stream, logs map[string]string) string {
+	w, h := video.displaySize()
+	pixFmt := "yuv420p"
+	if strings.Contains(video.PixFmt, "10") {
+		pixFmt = "yuv420p10le"
+	}
+
+	dist := fmt.Sprintf("[0:v]scale=%d:%d:flags=bicubic,format=%s,setpts=PTS-STARTPTS", w, h, pixFmt)
+	ref := fmt.Sprintf("[1:v]format=%s,setpts=PTS-STARTPTS", pixFmt)
+	n := len(metrics)
+	if n > 1 {
+		dist += ",split=" + strconv.Itoa(n)
+		ref += ",split=" + strconv.Itoa(n)
+	}
+	for i := range metrics {
+		dist += fmt.Sprintf("[d%d]", i)
+		ref += fmt.Sprintf("[r%d]", i)
+	}
+
+	graph := []string{dist, ref}
+	for i, m := range metrics {
+		in := fmt.Sprintf("[d%d][r%d]", i, i)
+		switch m {
+		case "vmaf":
+			vmaf := in + "libvmaf=log_fmt=json:log_path=" + escapeFilterValue(logs[m]) + ":n_threads=" + strconv.Itoa(runtime.NumCPU())
+			if opt.Model != "" {
+				vmaf += ":model=version=" + escapeFilterValue(opt.Model)
+			}
+			graph = append(graph, vmaf)
+		case "ssim", "psnr":
+			graph = append(graph, in+m+"=stats_file="+escapeFilterValue(logs[m]))
+		}
+	}
+	return strings.Join(graph, ";")
+}
+
+// qualityMetrics returns the metrics to measure.
+func qualityMetrics(metrics []string) ([]string, error) {
+	if len(metrics) == 0 {
+		return append([]string{}, defaultQualityMetrics...), nil
+	}
+	out := []string{}
+	for _, m := range metrics {
+		m = strings.ToLower(m)
+		if !contains(defaultQualityMetrics, m) {
+			return nil, errors.New("unknown quality metric: " + m)
+		}
+		if !contains(out, m) {
+			out = append(out, m)
+		}
+	}
+	return out, nil
+}
+
+// parseQualityLog returns the per-frame scores from a metric's log.
+func parseQualityLog(metric string, b []byte) ([]float64, error) {
+	if metric == "vmaf" {
+		var log vmafLog
+		if err := json.Unmarshal(b, &log); err != nil {
+			return nil, fmt.Errorf("invalid libvmaf log: %v", err)
+		}
+		scores := []float64{}
+		for _, frame := range log.Frames {
+			scores = append(scores, frame.Metrics.VMAF)
+		}
+		return scores, nil
+	}
+
+	pattern := ssimPattern
+	if metric == "psnr" {
+		pattern = psnrPattern
+	}
+	scores := []float64{}
+	for _, line := range strings.Split(string(b), "\n") {
+		m := pattern.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		v, err := strconv.ParseFloat(m[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s score: %s", metric, m[1])
+		}
+		if metric == "psnr" && v > maxPSNR {
+			v = maxPSNR
+		}
+		scores = append(scores, v)
+	}
+	return scores, nil
+}
+
+// newScore aggregates per-frame scores, or returns nil if there are none.
+func newScore(scores []float64) *Score {
+	if len(scores) == 0 {
+		return nil
+	}
+	s := &Score{Min: math.Inf(1), Max: math.Inf(-1)}
+	for _, v := range scores {
+		s.Mean += v
+		s.Min = math.Min(s.Min, v)
+		s.Max = math.Max(s.Max, v)
+	}
+	s.Mean = roundScore(s.Mean / float64(len(scores)))
+	s.Min = roundScore(s.Min)
+	s.Max = roundScore(s.Max)
+	return s
+}
+
+// frameQuality zips the per-frame scores of each metric.
+func frameQuality(scores map[string][]float64) []FrameQuality {
+	n := 0
+	for _, s := range scores {
+		if len(s) > n {
+			n = len(s)
+		}
+	}
+	frames := make([]FrameQuality, n)
+	for i := range frames {
+		frames[i].Frame = i
+		if i < len(scores["vmaf"]) {
+			frames[i].VMAF = roundScore(scores["vmaf"][i])
+		}
+		if i < len(scores["ssim"]) {
+			frames[i].SSIM = roundScore(scores["ssim"][i])
+		}
+		if i < len(scores["psnr"]) {
+			frames[i].PSNR = roundScore(scores["psnr"][i])
+		}
+	}
+	return frames
+}
+
+func roundScore(v float64) float64 {
+	return math.Round(v*10000) / 10000
+}
+
+// hasFilter reports whether ffmpeg is built with a filter, loading the
+// capabilities if they haven't been.
+func hasFilter(name string) bool {
+	c := loadedCapabilities()
+	if c == nil {
+		var err error
+		if c, err = LoadCapabilities(); err != nil {
+			return false
+		}
+	}
+	return contains(c.Filters, name)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func remove(list []string, s string) []string {
+	out := []string{}
+	for _, v := range list {
+		if v != s {
+			out = append(out, v)
+		}
+	}
+	return out
+}
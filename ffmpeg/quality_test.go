@@ -0,0 +1,79 @@
+package ffmpeg
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestQualityArgs(t *testing.T) {
+	video := &stream{CodecType: "video", Width: 1920, Height: 1080, PixFmt: "yuv420p10le"}
+	logs := map[string]string{"vmaf": "/tmp/q/vmaf.log", "ssim": "/tmp/q/ssim.log"}
+	opt := qualityOptions{Model: "vmaf_4k_v0.6.1", StartTime: "10", StopTime: "20"}
+
+	args := strings.Join(qualityArgs("in.mp4", "out.mp4", opt, []string{"vmaf", "ssim"}, video, logs), " ")
+	want := "-hide_banner -loglevel error -progress pipe:1 -i out.mp4 -ss 10 -to 20 -i in.mp4 -filter_complex " +
+		"[0:v]scale=1920:1080:flags=bicubic,format=yuv420p10le,setpts=PTS-STARTPTS,split=2[d0][d1];" +
+		"[1:v]format=yuv420p10le,setpts=PTS-STARTPTS,split=2[r0][r1];" +
+		"[d0][r0]libvmaf=log_fmt=json:log_path=/tmp/q/vmaf.log:n_threads="
+	if !strings.HasPrefix(args, want) {
+		t.Errorf("got %s", args)
+	}
+	if !strings.HasSuffix(args, ":model=version=vmaf_4k_v0.6.1;[d1][r1]ssim=stats_file=/tmp/q/ssim.log -an -f null -") {
+		t.Errorf("got %s", args)
+	}
+
+	// A single metric isn't split.
+	graph := qualityGraph(qualityOptions{}, []string{"psnr"}, &stream{Width: 1280, Height: 720}, map[string]string{"psnr": "psnr.log"})
+	if graph != "[0:v]scale=1280:720:flags=bicubic,format=yuv420p,setpts=PTS-STARTPTS[d0];[1:v]format=yuv420p,setpts=PTS-STARTPTS[r0];[d0][r0]psnr=stats_file=psnr.log" {
+		t.Errorf("got %s", graph)
+	}
+}
+
+func TestQualityMetrics(t *testing.T) {
+	if m, _ := qualityMetrics(nil); strings.Join(m, ",") != "vmaf,ssim,psnr" {
+		t.Errorf("unexpected default metrics: %v", m)
+	}
+	if m, _ := qualityMetrics([]string{"SSIM", "ssim", "psnr"}); strings.Join(m, ",") != "ssim,psnr" {
+		t.Errorf("unexpected metrics: %v", m)
+	}
+	if _, err := qualityMetrics([]string{"butteraugli"}); err == nil {
+		t.Error("expected error for unknown metric")
+	}
+}
+
+func TestParseQualityLog(t *testing.T) {
+	vmaf := `{"version":"2.3.1","frames":[{"frameNum":0,"metrics":{"integer_motion":0.0,"vmaf":92.5}},{"frameNum":1,"metrics":{"vmaf":96.25}}],"pooled_metrics":{}}`
+	ssim := "n:1 Y:0.991 U:0.995 V:0.996 All:0.993 (21.54)\nn:2 Y:0.985 U:0.990 V:0.992 All:0.987 (18.86)\n"
+	psnr := "n:1 mse_avg:0.00 mse_y:0.00 psnr_avg:inf psnr_y:inf\nn:2 mse_avg:1.52 mse_y:1.80 psnr_avg:46.31 psnr_y:45.58\n"
+
+	scores := map[string][]float64{}
+	for metric, log := range map[string]string{"vmaf": vmaf, "ssim": ssim, "psnr": psnr} {
+		s, err := parseQualityLog(metric, []byte(log))
+		if err != nil {
+			t.Fatal(err)
+		}
+		scores[metric] = s
+	}
+
+	if s := newScore(scores["vmaf"]); *s != (Score{Mean: 94.375, Min: 92.5, Max: 96.25}) {
+		t.Errorf("unexpected vmaf: %+v", s)
+	}
+	if s := newScore(scores["ssim"]); *s != (Score{Mean: 0.99, Min: 0.987, Max: 0.993}) {
+		t.Errorf("unexpected ssim: %+v", s)
+	}
+	if s := newScore(scores["psnr"]); *s != (Score{Mean: 73.155, Min: 46.31, Max: 100}) {
+		t.Errorf("unexpected psnr: %+v", s)
+	}
+	if newScore(nil) != nil {
+		t.Error("expected no score without frames")
+	}
+
+	frames := frameQuality(scores)
+	if len(frames) != 2 || frames[1] != (FrameQuality{Frame: 1, VMAF: 96.25, SSIM: 0.987, PSNR: 46.31}) {
+		t.Errorf("unexpected frames: %+v", frames)
+	}
+
+	if _, err := parseQualityLog("vmaf", []byte("not json")); err == nil {
+		t.Error("expected error for invalid vmaf log")
+	}
+}
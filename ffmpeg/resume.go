@@ -0,0 +1,204 @@
+package ffmpeg
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Written to an HLS output directory while it's encoded, so an interrupted
+// encode of the same input and payload resumes after its last segment.
+const hlsResumeFile = ".ffmpegd-resume.json"
+
+// hlsProgress is the complete segments of an interrupted HLS encode.
+type hlsProgress struct {
+	Segments []string
+	Duration float64 // Seconds.
+}
+
+// resumeManifest identifies the encode writing an output.
+type resumeManifest struct {
+	Input   string `json:"input"`
+	Payload string `json:"payload"`
+}
+
+// isHLSResumable reports whether an HLS encode can resume after its last
+// complete segment. Requires a single rendition without a clip range, and
+// without encryption, which generates a new key each run.
+func isHLSResumable(opt *ffmpegOptions) bool {
+	return opt.Format.Container == "hls" && len(opt.Raw) == 0 &&
+		len(opt.Outputs) == 0 && !opt.Format.Clip && !opt.Format.HLS.Encrypt
+}
+
+// runHLS runs a single rendition HLS encode, resuming an interrupted encode
+// of the same input and payload from its playlist.
+func (f *FFmpeg) runHLS(input, output, data string, args []string, options *ffmpegOptions) error {
+	dir, playlist := hlsPaths(output, 1)
+	manifest := filepath.Join(dir, hlsResumeFile)
+
+	p, err := hlsResume(dir, playlist, input, data)
+	if err != nil {
+		return err
+	}
+	if p != nil {
+		args = resumeHLSArgs(args, p)
+	} else {
+		if err := prepareOutput(output, options); err != nil {
+			return err
+		}
+		b, err := json.Marshal(resumeManifest{Input: input, Payload: data})
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(manifest, b, 0644); err != nil {
+			return err
+		}
+	}
+
+	if err := f.run(args); err != nil {
+		return err
+	}
+	return os.Remove(manifest)
+}
+
+// hlsResume returns the complete segments of an interrupted encode of the
+// same input and payload, removing any partial segment. Returns nil if there
+// is nothing to resume.
+func hlsResume(dir, playlist, input, data string) (*hlsProgress, error) {
+	if !hasResumeManifest(dir, input, data) {
+		return nil, nil
+	}
+
+	b, err := os.ReadFile(playlist)
+	if err != nil {
+		return nil, nil
+	}
+	p := parseHLSPlaylist(string(b))
+	if p == nil || len(p.Segments) == 0 {
+		return nil, nil
+	}
+
+	// Segments not yet in the playlist were being written.
+	matches, err := filepath.Glob(filepath.Join(dir, "segment_*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range matches {
+		if !contains(p.Segments, filepath.Base(path)) {
+			if err := os.Remove(path); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return p, nil
+}
+
+// hasResumeManifest reports whether an HLS output directory was being
+// written by an encode of the input and payload.
+func hasResumeManifest(dir, input, data string) bool {
+	b, err := os.ReadFile(filepath.Join(dir, hlsResumeFile))
+	if err != nil {
+		return false
+	}
+	m := resumeManifest{}
+	return json.Unmarshal(b, &m) == nil && m.Input == input && m.Payload == data
+}
+
+// resumesOutput reports whether output is a resumable HLS output left by an
+// interrupted encode of the input and payload.
+func resumesOutput(input, output, data string) bool {
+	options, err := decodeOptions(data)
+	if err != nil || !isHLSResumable(options) {
+		return false
+	}
+	dir, _ := hlsPaths(output, 1)
+	return hasResumeManifest(dir, input, data)
+}
+
+// parseHLSPlaylist returns the segments listed in a media playlist, or nil
+// if the playlist is complete.
+func parseHLSPlaylist(playlist string) *hlsProgress {
+	p := &hlsProgress{Segments: []string{}}
+	for _, line := range strings.Split(playlist, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "#EXT-X-ENDLIST":
+			return nil
+		case strings.HasPrefix(line, "#EXTINF:"):
+			v := strings.TrimSuffix(strings.TrimPrefix(line, "#EXTINF:"), ",")
+			if i := strings.Index(v, ","); i >= 0 {
+				v = v[:i]
+			}
+			d, _ := strconv.ParseFloat(v, 64)
+			p.Duration += d
+		case line != "" && !strings.HasPrefix(line, "#"):
+			p.Segments = append(p.Segments, line)
+		}
+	}
+	p.Duration = roundSeconds(p.Duration)
+	return p
+}
+
+// resumeHLSArgs seeks the input past the complete segments and appends the
+// rest to the playlist, continuing the segment numbers and timestamps.
+func resumeHLSArgs(args []string, p *hlsProgress) []string {
+	ss := formatSeconds(p.Duration)
+	i := argIndex(args, "-i")
+	out := append([]string{}, args[:i]...)
+	out = append(out, "-ss", ss)
+	out = append(out, args[i:len(args)-1]...)
+	out = append(out,
+		"-start_number", strconv.Itoa(len(p.Segments)),
+		"-hls_flags", "append_list",
+		"-output_ts_offset", ss)
+	return append(out, args[len(args)-1])
+}
+
+// CleanPartial removes the outputs an interrupted encode left behind so it
+// can run again, returning the paths removed. Single files are removed from
+// their temporary path, leaving any existing output. Encoded chunks and
+// complete HLS segments are kept, and Run resumes from them.
+func CleanPartial(output, data string) ([]string, error) {
+	options, err := decodeOptions(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	switch {
+	case len(options.Raw) > 0:
+		paths = []string{TempOutput(output)}
+	case options.Format.Container == "hls":
+		if isHLSResumable(options) {
+			return nil, nil
+		}
+		if paths, err = hlsFiles(output, len(options.Outputs)); err != nil {
+			return nil, err
+		}
+	case options.Format.Container == "dash":
+		if paths, err = dashFiles(output); err != nil {
+			return nil, err
+		}
+	case len(options.Outputs) > 0:
+		if paths, err = Outputs(output, data); err != nil {
+			return nil, err
+		}
+	default:
+		paths = []string{TempOutput(output)}
+	}
+
+	removed := []string{}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return removed, err
+		}
+		removed = append(removed, path)
+	}
+	return removed, nil
+}
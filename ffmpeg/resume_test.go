@@ -0,0 +1,93 @@
+package ffmpeg
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const partialPlaylist = `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:6
+#EXT-X-MEDIA-SEQUENCE:0
+#EXT-X-PLAYLIST-TYPE:VOD
+#EXTINF:6.006000,
+segment_000.ts
+#EXTINF:6.006000,
+segment_001.ts
+#EXTINF:4.004000,
+segment_002.ts
+`
+
+func TestParseHLSPlaylist(t *testing.T) {
+	p := parseHLSPlaylist(partialPlaylist)
+	if p == nil || len(p.Segments) != 3 || p.Segments[2] != "segment_002.ts" || p.Duration != 16.016 {
+		t.Errorf("got %+v", p)
+	}
+	if p := parseHLSPlaylist(partialPlaylist + "#EXT-X-ENDLIST\n"); p != nil {
+		t.Errorf("expected nil for a complete playlist, got %+v", p)
+	}
+}
+
+func TestHLSResume(t *testing.T) {
+	dir := t.TempDir()
+	playlist := filepath.Join(dir, hlsPlaylist)
+	for _, name := range []string{"segment_000.ts", "segment_001.ts", "segment_002.ts", "segment_003.ts"} {
+		os.WriteFile(filepath.Join(dir, name), []byte{0}, 0644)
+	}
+	os.WriteFile(playlist, []byte(partialPlaylist), 0644)
+	os.WriteFile(filepath.Join(dir, hlsResumeFile), []byte(`{"input":"in.mp4","payload":"{}"}`), 0644)
+
+	// A different payload starts over.
+	if p, err := hlsResume(dir, playlist, "in.mp4", `{"video":{}}`); err != nil || p != nil {
+		t.Errorf("got %+v, %v", p, err)
+	}
+
+	p, err := hlsResume(dir, playlist, "in.mp4", "{}")
+	if err != nil || p == nil || len(p.Segments) != 3 {
+		t.Fatalf("got %+v, %v", p, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "segment_003.ts")); !os.IsNotExist(err) {
+		t.Error("partial segment was not removed")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "segment_002.ts")); err != nil {
+		t.Error("complete segment was removed")
+	}
+
+	args := []string{"-hide_banner", "-i", "in.mp4", "-c:v", "libx264", "-f", "hls", "-hls_time", "6", playlist}
+	got := strings.Join(resumeHLSArgs(args, p), " ")
+	want := "-hide_banner -ss 16.016 -i in.mp4 -c:v libx264 -f hls -hls_time 6 " +
+		"-start_number 3 -hls_flags append_list -output_ts_offset 16.016 " + playlist
+	if got != want {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestCleanPartial(t *testing.T) {
+	dir := t.TempDir()
+	output := filepath.Join(dir, "out.mp4")
+	temp := TempOutput(output)
+	os.WriteFile(output, []byte{0}, 0644)
+	os.WriteFile(temp, []byte{0}, 0644)
+
+	removed, err := CleanPartial(output, `{"video":{"codec":"libx264"}}`)
+	if err != nil || len(removed) != 1 || removed[0] != temp {
+		t.Errorf("got %v, %v", removed, err)
+	}
+	if _, err := os.Stat(temp); !os.IsNotExist(err) {
+		t.Error("partial output was not removed")
+	}
+	if _, err := os.Stat(output); err != nil {
+		t.Error("existing output was removed")
+	}
+
+	// Resumable HLS segments are kept.
+	hls := filepath.Join(dir, "hls")
+	os.MkdirAll(hls, 0755)
+	os.WriteFile(filepath.Join(hls, "segment_000.ts"), []byte{0}, 0644)
+	removed, err = CleanPartial(hls, `{"format":{"container":"hls"}}`)
+	if err != nil || len(removed) != 0 {
+		t.Errorf("got %v, %v", removed, err)
+	}
+}
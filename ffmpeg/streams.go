@@ -0,0 +1,193 @@
+package ffmpeg
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// streamOptions selects and tags the input streams written to the output.
+// If unset, ffmpeg's default stream selection is used.
+type streamOptions struct {
+	Map       []streamSelector `json:"map"`       // Streams in output order. Defaults to the first video and default audio.
+	AllAudio  bool             `json:"all_audio"` // Include every audio track.
+	Subtitles string           `json:"subtitles"` // "copy", "auto" or a codec to include every subtitle track, or "none".
+}
+
+// streamSelector selects input streams by index, or by type, language and
+// disposition from the probed streams.
+type streamSelector struct {
+	Index       *int            `json:"index"`       // Input stream index.
+	Type        string          `json:"type"`        // video, audio or subtitle.
+	Language    string          `json:"language"`    // Language tag, e.g. "eng".
+	Disposition string          `json:"disposition"` // e.g. default, forced or comment.
+	All         bool            `json:"all"`         // Select every match instead of the first.
+	Set         *streamMetadata `json:"set"`         // Output stream language and dispositions.
+}
+
+type streamMetadata struct {
+	Language string `json:"language"`
+	Default  *bool  `json:"default"`
+	Forced   *bool  `json:"forced"`
+}
+
+// isSet reports whether any stream mapping is set.
+func (o streamOptions) isSet() bool {
+	return len(o.Map) > 0 || o.AllAudio || o.Subtitles != ""
+}
+
+// setStreams maps the selected input streams, followed by any sidecar
+// subtitle inputs, and sets the language and dispositions of the output
+// streams.
+func setStreams(opt streamOptions, probe *FFProbeResponse, sidecars []sidecar) ([]string, error) {
+	type mapped struct {
+		stream stream
+		set    *streamMetadata
+	}
+	streams := []mapped{}
+	seen := map[int]bool{}
+	add := func(s stream, set *streamMetadata) {
+		if s.CodecType == "subtitle" && opt.Subtitles == "none" {
+			return
+		}
+		if !seen[s.Index] {
+			seen[s.Index] = true
+			streams = append(streams, mapped{s, set})
+		}
+	}
+
+	if len(opt.Map) > 0 {
+		for i, sel := range opt.Map {
+			matches := selectStreams(sel, probe)
+			if len(matches) == 0 {
+				return nil, errors.New("no input stream matches map[" + strconv.Itoa(i) + "]")
+			}
+			for _, s := range matches {
+				add(s, sel.Set)
+			}
+		}
+	} else {
+		if video := selectStreams(streamSelector{Type: "video"}, probe); len(video) > 0 {
+			add(video[0], nil)
+		}
+		audio := selectStreams(streamSelector{Type: "audio", Disposition: "default"}, probe)
+		if len(audio) == 0 {
+			audio = selectStreams(streamSelector{Type: "audio"}, probe)
+		}
+		if len(audio) > 0 {
+			add(audio[0], nil)
+		}
+	}
+
+	for _, s := range probe.Streams {
+		if opt.AllAudio && s.CodecType == "audio" {
+			add(s, nil)
+		}
+		if opt.Subtitles != "" && opt.Subtitles != "none" && s.CodecType == "subtitle" {
+			// Bitmap subtitles can't be converted to text.
+			if opt.Subtitles != "copy" && textSubtitleCodecs[opt.Subtitles] && !textSubtitleCodecs[s.CodecName] {
+				continue
+			}
+			add(s, nil)
+		}
+	}
+
+	args := []string{}
+	for _, m := range streams {
+		args = append(args, "-map", "0:"+strconv.Itoa(m.stream.Index))
+	}
+	for i := range sidecars {
+		args = append(args, "-map", strconv.Itoa(i+1)+":0")
+	}
+
+	// Subtitle codec.
+	if opt.Subtitles != "" && opt.Subtitles != "none" {
+		args = append(args, "-c:s", opt.Subtitles)
+	}
+
+	// Output stream metadata, indexed by output stream.
+	for i, m := range streams {
+		args = append(args, setStreamMetadata(i, m.set)...)
+	}
+	for i, s := range sidecars {
+		forced := s.Forced
+		args = append(args, setStreamMetadata(len(streams)+i, &streamMetadata{Language: s.Language, Forced: &forced})...)
+	}
+	return args, nil
+}
+
+// selectStreams returns the probed streams matching a selector, in input
+// order. Attached pictures are only selected by index or disposition.
+func selectStreams(sel streamSelector, probe *FFProbeResponse) []stream {
+	matches := []stream{}
+	for _, s := range probe.Streams {
+		if sel.Index != nil && s.Index != *sel.Index {
+			continue
+		}
+		if sel.Type != "" && s.CodecType != sel.Type {
+			continue
+		}
+		if sel.Language != "" && !strings.EqualFold(s.Tags.Language, sel.Language) {
+			continue
+		}
+		if sel.Disposition != "" && !s.Disposition.has(sel.Disposition) {
+			continue
+		}
+		if sel.Index == nil && sel.Disposition == "" && s.Disposition.AttachedPic == 1 {
+			continue
+		}
+
+		matches = append(matches, s)
+		if !sel.All {
+			break
+		}
+	}
+	return matches
+}
+
+// setStreamMetadata sets the language and dispositions of output stream n.
+func setStreamMetadata(n int, set *streamMetadata) []string {
+	args := []string{}
+	if set == nil {
+		return args
+	}
+
+	if set.Language != "" {
+		args = append(args, "-metadata:s:"+strconv.Itoa(n), "language="+set.Language)
+	}
+
+	if set.Default != nil || set.Forced != nil {
+		flags := []string{}
+		if set.Default != nil && *set.Default {
+			flags = append(flags, "default")
+		}
+		if set.Forced != nil && *set.Forced {
+			flags = append(flags, "forced")
+		}
+		disposition := strings.Join(flags, "+")
+		if disposition == "" {
+			disposition = "0"
+		}
+		args = append(args, "-disposition:"+strconv.Itoa(n), disposition)
+	}
+	return args
+}
+
+// has reports whether a disposition flag is set, by its ffprobe name.
+func (d disposition) has(name string) bool {
+	flags := map[string]int{
+		"default":          d.Default,
+		"dub":              d.Dub,
+		"original":         d.Original,
+		"comment":          d.Comment,
+		"lyrics":           d.Lyrics,
+		"karaoke":          d.Karoake,
+		"forced":           d.Forced,
+		"hearing_impaired": d.HearingImpaired,
+		"visual_impaired":  d.VisualImpaired,
+		"clean_effects":    d.CleanEffects,
+		"attached_pic":     d.AttachedPic,
+		"timed_thumbnails": d.TimedThumbnails,
+	}
+	return flags[name] == 1
+}
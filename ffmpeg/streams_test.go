@@ -0,0 +1,56 @@
+package ffmpeg
+
+import (
+	"strings"
+	"testing"
+)
+
+var testStreamsProbe = &FFProbeResponse{
+	Streams: []stream{
+		{Index: 0, CodecType: "video"},
+		{Index: 1, CodecType: "audio", Tags: tags{Language: "eng"}},
+		{Index: 2, CodecType: "audio", Tags: tags{Language: "fre"}, Disposition: disposition{Default: 1}},
+		{Index: 3, CodecType: "audio", Tags: tags{Language: "eng"}, Disposition: disposition{Comment: 1}},
+		{Index: 4, CodecType: "subtitle", CodecName: "subrip", Tags: tags{Language: "eng"}},
+		{Index: 5, CodecType: "subtitle", CodecName: "subrip", Tags: tags{Language: "eng"}, Disposition: disposition{Forced: 1}},
+		{Index: 6, CodecType: "video", Disposition: disposition{AttachedPic: 1}},
+	},
+}
+
+func TestSetStreams(t *testing.T) {
+	index := 6
+	yes, no := true, false
+	tests := []struct {
+		opt  streamOptions
+		want string
+	}{
+		{streamOptions{AllAudio: true}, "-map 0:0 -map 0:2 -map 0:1 -map 0:3"},
+		{streamOptions{Subtitles: "mov_text"}, "-map 0:0 -map 0:2 -map 0:4 -map 0:5 -c:s mov_text"},
+		{streamOptions{Map: []streamSelector{{Type: "video"}, {Type: "audio", Language: "eng", All: true}}}, "-map 0:0 -map 0:1 -map 0:3"},
+		{streamOptions{Map: []streamSelector{{Type: "audio", Disposition: "comment"}, {Index: &index}}}, "-map 0:3 -map 0:6"},
+		{streamOptions{Map: []streamSelector{{Type: "subtitle", All: true}}, Subtitles: "none"}, ""},
+		{
+			streamOptions{Map: []streamSelector{
+				{Type: "video"},
+				{Type: "audio", Language: "eng", Set: &streamMetadata{Language: "en", Default: &yes}},
+				{Type: "subtitle", Disposition: "forced", Set: &streamMetadata{Default: &no, Forced: &yes}},
+			}, Subtitles: "copy"},
+			"-map 0:0 -map 0:1 -map 0:5 -map 0:4 -c:s copy -metadata:s:1 language=en -disposition:1 default -disposition:2 forced",
+		},
+	}
+
+	for _, tt := range tests {
+		args, err := setStreams(tt.opt, testStreamsProbe, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(args, " "); got != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+	}
+
+	opt := streamOptions{Map: []streamSelector{{Type: "audio", Language: "ger"}}}
+	if _, err := setStreams(opt, testStreamsProbe, nil); err == nil {
+		t.Error("expected error for unmatched selector")
+	}
+}
@@ -0,0 +1,175 @@
+package ffmpeg
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Sidecar subtitle file extensions.
+var sidecarExts = []string{".srt", ".ass", ".ssa", ".vtt"}
+
+// Text subtitle codecs, which can be converted between each other.
+var textSubtitleCodecs = map[string]bool{
+	"subrip":   true,
+	"srt":      true,
+	"ass":      true,
+	"ssa":      true,
+	"mov_text": true,
+	"webvtt":   true,
+	"text":     true,
+}
+
+// Subtitle codecs picked for each container by the "auto" subtitles option.
+var subtitleCodecs = map[string]string{
+	"mp4":  "mov_text",
+	"m4v":  "mov_text",
+	"mov":  "mov_text",
+	"webm": "webvtt",
+	"mkv":  "copy",
+}
+
+type subtitleOptions struct {
+	Sidecars   bool   `json:"sidecars"`     // Add .srt, .ass and .vtt files next to the input as subtitle tracks.
+	BurnIn     *int   `json:"burn_in"`      // Subtitle track to burn into the video, counting subtitle streams only.
+	BurnInFile string `json:"burn_in_file"` // Subtitle file to burn into the video instead.
+}
+
+// sidecar is a subtitle file found next to the input.
+type sidecar struct {
+	Path     string
+	Language string
+	Forced   bool
+}
+
+// isSet reports whether any subtitle option is set.
+func (o subtitleOptions) isSet() bool {
+	return o.Sidecars || o.BurnIn != nil || o.BurnInFile != ""
+}
+
+// setInputStreams returns the sidecar inputs and stream maps for the probed
+// input. A burn-in filter is set on the video filter options.
+func setInputStreams(input, output string, opt *ffmpegOptions, probe *FFProbeResponse) ([]string, error) {
+	sidecars := []sidecar{}
+	if opt.Subtitle.Sidecars {
+		var err error
+		if sidecars, err = findSidecars(input); err != nil {
+			return nil, err
+		}
+	}
+	return mapStreams(input, output, opt, probe, sidecars)
+}
+
+// mapStreams returns the sidecar inputs and stream maps for the probed input.
+func mapStreams(input, output string, opt *ffmpegOptions, probe *FFProbeResponse, sidecars []sidecar) ([]string, error) {
+	args := []string{}
+
+	// Burn in.
+	if opt.Subtitle.BurnIn != nil || opt.Subtitle.BurnInFile != "" {
+		burnIn, err := setBurnIn(input, opt.Subtitle, probe)
+		if err != nil {
+			return nil, err
+		}
+		opt.Filter.burnIn = burnIn
+	}
+
+	if !opt.Streams.isSet() && len(sidecars) == 0 {
+		return args, nil
+	}
+
+	// Pick the subtitle codec for the container.
+	if opt.Streams.Subtitles == "auto" {
+		container := opt.Format.Container
+		if container == "" {
+			container = strings.ToLower(strings.TrimPrefix(filepath.Ext(output), "."))
+		}
+		opt.Streams.Subtitles = subtitleCodecs[container]
+		if opt.Streams.Subtitles == "" {
+			opt.Streams.Subtitles = "copy"
+		}
+	}
+
+	for _, s := range sidecars {
+		args = append(args, "-i", s.Path)
+	}
+
+	streams, err := setStreams(opt.Streams, probe, sidecars)
+	if err != nil {
+		return nil, err
+	}
+	return append(args, streams...), nil
+}
+
+// findSidecars returns the subtitle files named after the input, e.g.
+// movie.srt, movie.en.srt or movie.en.forced.srt for movie.mkv.
+func findSidecars(input string) ([]sidecar, error) {
+	dir := filepath.Dir(input)
+	base := strings.TrimSuffix(filepath.Base(input), filepath.Ext(input))
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	sidecars := []sidecar{}
+	for _, e := range entries {
+		ext := filepath.Ext(e.Name())
+		if e.IsDir() || !isSidecarExt(strings.ToLower(ext)) || !strings.HasPrefix(e.Name(), base) {
+			continue
+		}
+
+		// Tags between the input name and extension.
+		tags := strings.TrimSuffix(strings.TrimPrefix(e.Name(), base), ext)
+		if tags != "" && tags[0] != '.' {
+			continue
+		}
+		s := sidecar{Path: filepath.Join(dir, e.Name())}
+		for _, tag := range strings.Split(strings.TrimPrefix(tags, "."), ".") {
+			if strings.EqualFold(tag, "forced") {
+				s.Forced = true
+			} else if len(tag) == 2 || len(tag) == 3 {
+				s.Language = strings.ToLower(tag)
+			}
+		}
+		sidecars = append(sidecars, s)
+	}
+	return sidecars, nil
+}
+
+// setBurnIn returns the subtitles filter burning a subtitle track or file
+// into the video.
+func setBurnIn(input string, opt subtitleOptions, probe *FFProbeResponse) (string, error) {
+	if opt.BurnInFile != "" {
+		if _, err := os.Stat(opt.BurnInFile); err != nil {
+			return "", err
+		}
+		return "subtitles=filename=" + escapeFilterValue(opt.BurnInFile), nil
+	}
+
+	subs := selectStreams(streamSelector{Type: "subtitle", All: true}, probe)
+	n := *opt.BurnIn
+	if n < 0 || n >= len(subs) {
+		return "", fmt.Errorf("input has no subtitle track %d", n)
+	}
+	if !textSubtitleCodecs[subs[n].CodecName] {
+		return "", errors.New("subtitle track " + strconv.Itoa(n) + " is not a text subtitle and cannot be burned in")
+	}
+	return "subtitles=filename=" + escapeFilterValue(input) + ":si=" + strconv.Itoa(n), nil
+}
+
+// escapeFilterValue escapes a filter option value, then the filtergraph.
+func escapeFilterValue(s string) string {
+	value := strings.NewReplacer(`\`, `\\`, `:`, `\:`, `'`, `\'`).Replace(s)
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`, `[`, `\[`, `]`, `\]`, `,`, `\,`, `;`, `\;`).Replace(value)
+}
+
+func isSidecarExt(ext string) bool {
+	for _, e := range sidecarExts {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package ffmpeg
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFindSidecars(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"movie.mkv", "movie.srt", "movie.en.forced.srt", "movie.fre.ass", "movies.srt", "movie.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sidecars, err := findSidecars(filepath.Join(dir, "movie.mkv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []sidecar{
+		{Path: filepath.Join(dir, "movie.en.forced.srt"), Language: "en", Forced: true},
+		{Path: filepath.Join(dir, "movie.fre.ass"), Language: "fre"},
+		{Path: filepath.Join(dir, "movie.srt")},
+	}
+	if len(sidecars) != len(want) {
+		t.Fatalf("got %+v, want %+v", sidecars, want)
+	}
+	for i := range want {
+		if sidecars[i] != want[i] {
+			t.Errorf("got %+v, want %+v", sidecars[i], want[i])
+		}
+	}
+}
+
+func TestMapStreamsSubtitles(t *testing.T) {
+	probe := &FFProbeResponse{
+		Streams: []stream{
+			{Index: 0, CodecType: "video"},
+			{Index: 1, CodecType: "audio"},
+			{Index: 2, CodecType: "subtitle", CodecName: "hdmv_pgs_subtitle"},
+			{Index: 3, CodecType: "subtitle", CodecName: "subrip"},
+		},
+	}
+	sidecars := []sidecar{{Path: "movie.en.srt", Language: "en"}}
+
+	opt := &ffmpegOptions{Streams: streamOptions{Subtitles: "auto"}}
+	args, err := mapStreams("movie.mkv", "out.mp4", opt, probe, sidecars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "-i movie.en.srt -map 0:0 -map 0:1 -map 0:3 -map 1:0 -c:s mov_text -metadata:s:3 language=en -disposition:3 0"
+	if got := strings.Join(args, " "); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	track := 1
+	opt = &ffmpegOptions{Subtitle: subtitleOptions{BurnIn: &track}}
+	args, err = mapStreams("C:/movie's.mkv", "out.mp4", opt, probe, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(args) != 0 {
+		t.Errorf("unexpected args: %v", args)
+	}
+	if want := `subtitles=filename=C\\:/movie\\\'s.mkv:si=1`; opt.Filter.burnIn != want {
+		t.Errorf("got %s, want %s", opt.Filter.burnIn, want)
+	}
+	if vf := setVideoFilters(opt.Video, opt.Filter); !strings.HasSuffix(vf, opt.Filter.burnIn) {
+		t.Errorf("burn in missing from video filters: %s", vf)
+	}
+
+	track = 0
+	if _, err := mapStreams("movie.mkv", "out.mp4", opt, probe, nil); err == nil {
+		t.Error("expected error burning in bitmap subtitles")
+	}
+}
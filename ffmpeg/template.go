@@ -0,0 +1,185 @@
+package ffmpeg
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Output collision policies, applied when the output already exists.
+const (
+	CollisionOverwrite = "overwrite" // Replace the existing output. The default.
+	CollisionSkip      = "skip"      // Leave the existing output and skip the job.
+	CollisionRename    = "rename"    // Write to the next free name, e.g. out-1.mp4.
+	CollisionFail      = "fail"      // Fail the job.
+)
+
+// ErrOutputExists is returned when an output exists and the collision policy
+// is skip or fail.
+var ErrOutputExists = errors.New("output exists")
+
+// Most names tried by the rename collision policy.
+const maxRenames = 1000
+
+// OutputVars are the values of the tokens in an output template.
+type OutputVars struct {
+	Input  string
+	Preset string
+	JobID  string
+	Date   time.Time
+	Width  int // Tokens for unknown sizes are left in the template.
+	Height int
+}
+
+// ExpandOutput replaces the tokens in an output template. {name} and {ext}
+// are the input's base name and extension, {preset} the preset name or
+// "custom", {date} the date as 2006-01-02, {jobid} the job ID, and {width}
+// and {height} the size of the video.
+func ExpandOutput(template string, v OutputVars) string {
+	ext := filepath.Ext(v.Input)
+	preset := v.Preset
+	if preset == "" {
+		preset = "custom"
+	}
+	tokens := []string{
+		"{name}", strings.TrimSuffix(filepath.Base(v.Input), ext),
+		"{ext}", strings.TrimPrefix(ext, "."),
+		"{preset}", preset,
+		"{jobid}", v.JobID,
+	}
+	if !v.Date.IsZero() {
+		tokens = append(tokens, "{date}", v.Date.Format("2006-01-02"))
+	}
+	if v.Width > 0 && v.Height > 0 {
+		tokens = append(tokens, "{width}", strconv.Itoa(v.Width), "{height}", strconv.Itoa(v.Height))
+	}
+	return strings.NewReplacer(tokens...).Replace(template)
+}
+
+// Tokens expanded in output templates.
+var outputTokens = []string{"{name}", "{ext}", "{preset}", "{date}", "{jobid}", "{width}", "{height}"}
+
+// HasTokens reports whether an output has tokens to expand.
+func HasTokens(output string) bool {
+	for _, t := range outputTokens {
+		if strings.Contains(output, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasSizeTokens reports whether an output still has {width} or {height}
+// tokens to expand.
+func HasSizeTokens(output string) bool {
+	return strings.Contains(output, "{width}") || strings.Contains(output, "{height}")
+}
+
+// CheckCollision returns an error if policy isn't a collision policy.
+func CheckCollision(policy string) error {
+	switch policy {
+	case "", CollisionOverwrite, CollisionSkip, CollisionRename, CollisionFail:
+		return nil
+	}
+	return errors.New("unknown collision policy: " + policy)
+}
+
+// ResolveOutput applies the collision policy to the output of an encode.
+// Returns the path to write, or the existing path with ErrOutputExists if the
+// job should be skipped or fail. Each of multiple outputs is checked, and
+// they can't be renamed. An HLS output that an interrupted encode of the same
+// input and payload resumes from isn't a collision.
+func ResolveOutput(input, output, data, policy string) (string, error) {
+	exists := func(path string) bool {
+		return exists(path) && !resumesOutput(input, path, data)
+	}
+	paths := multipleOutputs(data)
+	if len(paths) == 0 {
+		return resolveOutput(output, policy, exists)
+	}
+	if policy == CollisionRename {
+		return output, errors.New("multiple outputs can't use the rename collision policy")
+	}
+	for _, path := range paths {
+		if _, err := resolveOutput(path, policy, exists); err != nil {
+			return path, err
+		}
+	}
+	return output, nil
+}
+
+func resolveOutput(output, policy string, exists func(string) bool) (string, error) {
+	switch policy {
+	case "", CollisionOverwrite:
+		return output, nil
+	case CollisionSkip, CollisionFail:
+		if exists(output) {
+			return output, ErrOutputExists
+		}
+		return output, nil
+	case CollisionRename:
+		ext := filepath.Ext(output)
+		base := strings.TrimSuffix(output, ext)
+		path := output
+		for n := 1; exists(path); n++ {
+			if n > maxRenames {
+				return output, ErrOutputExists
+			}
+			path = base + "-" + strconv.Itoa(n) + ext
+		}
+		return path, nil
+	}
+	return output, CheckCollision(policy)
+}
+
+// TempOutput returns the hidden path an output is encoded to before it's
+// renamed into place. It keeps the extension ffmpeg picks the muxer from.
+func TempOutput(output string) string {
+	ext := filepath.Ext(output)
+	name := strings.TrimSuffix(filepath.Base(output), ext)
+	return filepath.Join(filepath.Dir(output), "."+name+".partial"+ext)
+}
+
+// UsesTempOutput reports whether a payload writes a single file, which is
+// encoded to a temporary path. Multiple outputs, HLS and DASH are written in
+// place.
+func UsesTempOutput(data string) bool {
+	options, err := decodeOptions(data)
+	if err != nil {
+		return false
+	}
+	return len(options.Raw) > 0 ||
+		(len(options.Outputs) == 0 && options.Format.Container != "hls" && options.Format.Container != "dash")
+}
+
+// overwrites reports whether ffmpeg replaces existing outputs. Outputs
+// written in place are only replaced with the overwrite policy, or when an
+// interrupted HLS encode resumes. Single files are encoded to a temporary
+// path, and the policy is applied when they're committed.
+func overwrites(input, output, data, policy string) bool {
+	return policy == "" || policy == CollisionOverwrite || UsesTempOutput(data) || resumesOutput(input, output, data)
+}
+
+// CommitOutput renames an encoded temporary file to its output, applying the
+// collision policy again in case the output was created while encoding.
+// Returns the output written, or ErrOutputExists with the temporary file
+// removed.
+func CommitOutput(temp, output, policy string) (string, error) {
+	path, err := resolveOutput(output, policy, exists)
+	if err != nil {
+		os.Remove(temp)
+		return output, err
+	}
+	if err := os.Rename(temp, path); err != nil {
+		return output, err
+	}
+	return path, nil
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,183 @@
+package ffmpeg
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpandOutput(t *testing.T) {
+	v := OutputVars{
+		Input: "/media/in/clip.final.mov",
+		JobID: "abc123",
+		Date:  time.Date(2024, 3, 9, 12, 0, 0, 0, time.UTC),
+	}
+	got := ExpandOutput("/out/{date}/{name}-{preset}-{width}x{height}.{ext}.{jobid}.mp4", v)
+	if want := "/out/2024-03-09/clip.final-custom-{width}x{height}.mov.abc123.mp4"; got != want {
+		t.Errorf("got %s", got)
+	}
+	if !HasSizeTokens(got) {
+		t.Error("expected size tokens")
+	}
+
+	v.Preset, v.Width, v.Height = "web-720p", 1280, 720
+	got = ExpandOutput(got, v)
+	if want := "/out/2024-03-09/clip.final-custom-1280x720.mov.abc123.mp4"; got != want {
+		t.Errorf("got %s", got)
+	}
+	if got := ExpandOutput("{name}_{preset}.mp4", v); got != "clip.final_web-720p.mp4" {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestResolveOutput(t *testing.T) {
+	dir := t.TempDir()
+	output := filepath.Join(dir, "out.mp4")
+	if got, err := ResolveOutput("in.mp4", output, "{}", CollisionFail); err != nil || got != output {
+		t.Errorf("got %s, %v", got, err)
+	}
+
+	os.WriteFile(output, []byte{0}, 0644)
+	os.WriteFile(filepath.Join(dir, "out-1.mp4"), []byte{0}, 0644)
+	tests := []struct {
+		policy string
+		want   string
+		err    bool
+	}{
+		{"", output, false},
+		{CollisionOverwrite, output, false},
+		{CollisionSkip, output, true},
+		{CollisionFail, output, true},
+		{CollisionRename, filepath.Join(dir, "out-2.mp4"), false},
+		{"keep", output, true},
+	}
+	for _, tt := range tests {
+		got, err := ResolveOutput("in.mp4", output, "{}", tt.policy)
+		if got != tt.want || (err != nil) != tt.err {
+			t.Errorf("%q: got %s, %v", tt.policy, got, err)
+		}
+	}
+	if _, err := ResolveOutput("in.mp4", output, "{}", CollisionSkip); err != ErrOutputExists {
+		t.Errorf("expected ErrOutputExists, got %v", err)
+	}
+
+	// Each of multiple outputs is checked, and they aren't renamed.
+	other := filepath.Join(dir, "other.mp4")
+	b, _ := json.Marshal(ffmpegOptions{Outputs: []outputOptions{{Output: other}, {Output: output}}})
+	multi := string(b)
+	if got, err := ResolveOutput("in.mp4", "", multi, CollisionFail); err != ErrOutputExists || got != output {
+		t.Errorf("got %s, %v", got, err)
+	}
+	if _, err := ResolveOutput("in.mp4", "", multi, CollisionRename); err == nil {
+		t.Error("expected an error renaming multiple outputs")
+	}
+	if _, err := ResolveOutput("in.mp4", "", multi, CollisionOverwrite); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOverwriteFlag(t *testing.T) {
+	dir := t.TempDir()
+	hls := `{"format":{"container":"hls"}}`
+	multi := `{"outputs":[{"output":"a.mp4"},{"output":"b.mp4"}]}`
+	tests := []struct {
+		output string
+		data   string
+		policy string
+		want   string
+	}{
+		{"out.mp4", `{"format":{"container":"mp4"}}`, CollisionFail, "-y out.mp4"}, // Encoded to a temporary path.
+		{filepath.Join(dir, "hls"), hls, CollisionOverwrite, "-y"},
+		{filepath.Join(dir, "hls"), hls, CollisionSkip, "-n"},
+		{"out", multi, "", "-y a.mp4 -map [v1] -map 0:a? -y b.mp4"},
+		{"out", multi, CollisionFail, "-n a.mp4 -map [v1] -map 0:a? -n b.mp4"},
+	}
+	for _, tt := range tests {
+		argv, _, err := Command(testFile, tt.output, tt.data, tt.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(argv, " "); !strings.Contains(got, " "+tt.want+" ") && !strings.HasSuffix(got, " "+tt.want) {
+			t.Errorf("%s %s: got %s, want %s", tt.data, tt.policy, got, tt.want)
+		}
+	}
+
+	// An interrupted HLS encode resumes over its own output.
+	output := filepath.Join(dir, "resume")
+	os.MkdirAll(output, 0755)
+	b, _ := json.Marshal(resumeManifest{Input: testFile, Payload: hls})
+	os.WriteFile(filepath.Join(output, hlsResumeFile), b, 0644)
+	argv, _, err := Command(testFile, output, hls, CollisionFail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(argv, " "); !strings.Contains(got, " -y ") {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestCommitOutput(t *testing.T) {
+	dir := t.TempDir()
+	output := filepath.Join(dir, "out.mp4")
+	temp := TempOutput(output)
+	if want := filepath.Join(dir, ".out.partial.mp4"); temp != want {
+		t.Errorf("got temp output %s", temp)
+	}
+
+	os.WriteFile(temp, []byte("new"), 0644)
+	if got, err := CommitOutput(temp, output, CollisionFail); err != nil || got != output {
+		t.Fatalf("got %s, %v", got, err)
+	}
+	if b, _ := os.ReadFile(output); string(b) != "new" {
+		t.Errorf("got output %q", b)
+	}
+
+	// An output created while encoding is kept.
+	os.WriteFile(temp, []byte("newer"), 0644)
+	if _, err := CommitOutput(temp, output, CollisionSkip); err != ErrOutputExists {
+		t.Errorf("expected ErrOutputExists, got %v", err)
+	}
+	if _, err := os.Stat(temp); !os.IsNotExist(err) {
+		t.Error("temporary output was not removed")
+	}
+	if b, _ := os.ReadFile(output); string(b) != "new" {
+		t.Errorf("got output %q", b)
+	}
+}
+
+func TestUsesTempOutput(t *testing.T) {
+	tests := []struct {
+		data string
+		want bool
+	}{
+		{`{"format":{"container":"mp4"}}`, true},
+		{`{"raw":["-c","copy"]}`, true},
+		{`{"format":{"container":"hls"}}`, false},
+		{`{"format":{"container":"dash"}}`, false},
+		{`{"outputs":[{"name":"720p"}]}`, false},
+	}
+	for _, tt := range tests {
+		if got := UsesTempOutput(tt.data); got != tt.want {
+			t.Errorf("%s: got %v", tt.data, got)
+		}
+	}
+}
+
+func TestResolveOutputResume(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "hls")
+	os.MkdirAll(output, 0755)
+	data := `{"format":{"container":"hls"}}`
+	b, _ := json.Marshal(resumeManifest{Input: "in.mp4", Payload: data})
+	os.WriteFile(filepath.Join(output, hlsResumeFile), b, 0644)
+
+	// The output an interrupted encode resumes from isn't a collision.
+	if got, err := ResolveOutput("in.mp4", output, data, CollisionFail); err != nil || got != output {
+		t.Errorf("got %s, %v", got, err)
+	}
+	if got, err := ResolveOutput("other.mp4", output, data, CollisionRename); err != nil || got != output+"-1" {
+		t.Errorf("got %s, %v", got, err)
+	}
+}
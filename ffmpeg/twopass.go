@@ -0,0 +1,245 @@
+package ffmpeg
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Matches a size or bitrate with an optional k, M or G suffix, e.g. 25MB,
+// 8MiB, 128k or 1048576.
+var sizePattern = regexp.MustCompile(`(?i)^(\d+(?:\.\d+)?)\s*([kmg]?)(i?)b?$`)
+
+const (
+	// Audio bitrate assumed when sizing the video if none is set, matching
+	// ffmpeg's aac default.
+	defaultAudioBitrate = 128000
+
+	// Fraction of the target size left for container overhead.
+	muxOverhead = 0.02
+
+	// Lowest video bitrate a target size is computed to.
+	minVideoBitrate = 10000
+
+	// Times the second pass is rerun at a lower bitrate when the output is
+	// over the target size.
+	maxSizeRetries = 2
+
+	// Pass log file name, written to a temporary directory while encoding.
+	passLogFile = "ffmpeg2pass"
+)
+
+// isTwoPass reports whether the options encode in two passes. Multiple
+// outputs, HLS and DASH encode in a single pass.
+func isTwoPass(opt *ffmpegOptions) bool {
+	if opt.Video.Pass != "2" && opt.Video.Pass != "size" {
+		return false
+	}
+	return len(opt.Raw) == 0 && len(opt.Outputs) == 0 &&
+		opt.Format.Container != "hls" && opt.Format.Container != "dash"
+}
+
+// runTwoPass runs the first pass to a pass log and the second to the output.
+// With a target size, the second pass is rerun at a lower bitrate until the
+// output fits.
+func (f *FFmpeg) runTwoPass(input, output string, options *ffmpegOptions) error {
+	var target int64
+	if options.Video.Pass == "size" {
+		var err error
+		if target, err = setTargetBitrate(input, options); err != nil {
+			return err
+		}
+	}
+
+	args, err := buildArgs(input, output, options)
+	if err != nil {
+		return err
+	}
+	if err := prepareOutput(output, options); err != nil {
+		return err
+	}
+
+	dir, err := os.MkdirTemp("", "ffmpegd-pass")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	log := filepath.Join(dir, passLogFile)
+
+	if err := f.run(passArgs(args, options.Video.Codec, 1, log)); err != nil {
+		return err
+	}
+
+	pass2 := passArgs(args, options.Video.Codec, 2, log)
+	for retry := 0; ; retry++ {
+		if f.cancelled() {
+			return ErrCancelled
+		}
+		if err := f.run(pass2); err != nil {
+			return err
+		}
+		if target == 0 {
+			return nil
+		}
+
+		info, err := os.Stat(output)
+		if err != nil {
+			return err
+		}
+		if info.Size() <= target {
+			return nil
+		}
+		if retry == maxSizeRetries {
+			return fmt.Errorf("output is %d bytes, over the target size of %d bytes", info.Size(), target)
+		}
+
+		// Scale the bitrate down by the overshoot, with a margin.
+		bitrate, _ := parseSize(options.Video.Bitrate)
+		bitrate = int64(float64(bitrate) * float64(target) / float64(info.Size()) * 0.97)
+		options.Video.Bitrate = formatBitrate(bitrate)
+		setArg(pass2, "-b:v", options.Video.Bitrate)
+	}
+}
+
+// setTargetBitrate probes the input and sets the video bitrate that fits the
+// output in the target size. Returns the target size in bytes.
+func setTargetBitrate(input string, opt *ffmpegOptions) (int64, error) {
+	if opt.Video.TargetSize == "" {
+		return 0, errors.New("target_size is required when pass is \"size\"")
+	}
+	target, err := parseSize(opt.Video.TargetSize)
+	if err != nil {
+		return 0, err
+	}
+
+	probe, err := FFProbe{}.Run(input)
+	if err != nil {
+		return 0, err
+	}
+	bitrate, err := targetBitrate(target, opt, probe)
+	if err != nil {
+		return 0, err
+	}
+	opt.Video.Bitrate = formatBitrate(bitrate)
+	return target, nil
+}
+
+// targetBitrate returns the video bitrate that fits the encoded duration in
+// the target size, after the audio and container overhead.
+func targetBitrate(target int64, opt *ffmpegOptions, probe *FFProbeResponse) (int64, error) {
+	duration := probe.Duration()
+	if opt.Format.Clip {
+		var err error
+		clip := concatInput{StartTime: opt.Format.StartTime, StopTime: opt.Format.StopTime}
+		if duration, err = rangeDuration(clip, probe); err != nil {
+			return 0, err
+		}
+	}
+	if duration <= 0 {
+		return 0, errors.New("cannot compute bitrate for target size, input duration is unknown")
+	}
+
+	audio := audioBitrate(opt, probe)
+	video := int64(float64(target)*8*(1-muxOverhead)/duration) - audio
+	if video < minVideoBitrate {
+		return 0, fmt.Errorf("target size %s is too small for %s seconds with %s audio",
+			opt.Video.TargetSize, formatSeconds(duration), formatBitrate(audio))
+	}
+	return video, nil
+}
+
+// audioBitrate returns the total bitrate of the output audio streams.
+func audioBitrate(opt *ffmpegOptions, probe *FFProbeResponse) int64 {
+	streams := probe.audioStreams()
+	if len(streams) > 1 && !opt.Streams.AllAudio {
+		streams = streams[:1]
+	}
+
+	var total int64
+	for _, s := range streams {
+		bitrate := int64(defaultAudioBitrate)
+		if opt.Audio.Codec == "copy" {
+			if b, err := strconv.ParseInt(s.BitRate, 10, 64); err == nil && b > 0 {
+				bitrate = b
+			}
+		} else if b, err := parseSize(opt.Audio.Quality); err == nil {
+			bitrate = b
+		}
+		total += bitrate
+	}
+	return total
+}
+
+// passArgs returns the arguments for one pass of a two-pass encode sharing
+// the pass log. The first pass discards its output and skips audio.
+func passArgs(args []string, codec string, pass int, log string) []string {
+	n := strconv.Itoa(pass)
+	out := append([]string{}, args[:len(args)-1]...)
+
+	// libx265 ignores -pass, so it's set in its params.
+	if codec == "libx265" {
+		params := "pass=" + n + ":stats=" + log + ".log"
+		if i := argIndex(out, "-x265-params"); i >= 0 {
+			out[i+1] += ":" + params
+		} else {
+			out = append(out, "-x265-params", params)
+		}
+	} else {
+		out = append(out, "-pass", n, "-passlogfile", log)
+	}
+
+	if pass == 1 {
+		return append(out, "-an", "-f", "null", "-")
+	}
+	return append(out, args[len(args)-1])
+}
+
+// argIndex returns the index of a flag followed by a value in args, or -1.
+func argIndex(args []string, flag string) int {
+	for i := 0; i < len(args)-1; i++ {
+		if args[i] == flag {
+			return i
+		}
+	}
+	return -1
+}
+
+// setArg sets the value following flag in args.
+func setArg(args []string, flag, value string) {
+	if i := argIndex(args, flag); i >= 0 {
+		args[i+1] = value
+	}
+}
+
+// parseSize parses a size or bitrate. k, M and G are powers of 1000, and
+// Ki, Mi and Gi powers of 1024.
+func parseSize(s string) (int64, error) {
+	m := sizePattern.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return 0, errors.New("invalid size: " + s)
+	}
+	v, _ := strconv.ParseFloat(m[1], 64)
+
+	base := 1000.0
+	if m[3] != "" {
+		base = 1024
+	}
+	switch strings.ToLower(m[2]) {
+	case "k":
+		v *= base
+	case "m":
+		v *= base * base
+	case "g":
+		v *= base * base * base
+	}
+	return int64(v), nil
+}
+
+// formatBitrate formats bits per second in kilobits, e.g. 1500k.
+func formatBitrate(b int64) string {
+	return strconv.FormatInt(b/1000, 10) + "k"
+}
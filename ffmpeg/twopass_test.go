@@ -0,0 +1,86 @@
+package ffmpeg
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int64
+	}{
+		{"25MB", 25000000},
+		{"8MiB", 8388608},
+		{"128k", 128000},
+		{"1.5G", 1500000000},
+		{"700 KB", 700000},
+		{"1048576", 1048576},
+	}
+	for _, tt := range tests {
+		if got, err := parseSize(tt.s); err != nil || got != tt.want {
+			t.Errorf("%s: got %d, %v, want %d", tt.s, got, err, tt.want)
+		}
+	}
+	if _, err := parseSize("big"); err == nil {
+		t.Error("expected error for invalid size")
+	}
+}
+
+func TestTargetBitrate(t *testing.T) {
+	probe := &FFProbeResponse{
+		Format: format{Duration: "600"},
+		Streams: []stream{
+			{CodecType: "video"},
+			{CodecType: "audio", BitRate: "192000"},
+			{CodecType: "audio", BitRate: "96000"},
+		},
+	}
+
+	// 25MB over 100 seconds of the input with 128k audio.
+	opt := &ffmpegOptions{
+		Format: formatOptions{Clip: true, StartTime: "00:01:00", StopTime: "00:02:40"},
+		Video:  videoOptions{Pass: "size", TargetSize: "25MB"},
+		Audio:  audioOptions{Codec: "aac", Quality: "128k"},
+	}
+	got, err := targetBitrate(25000000, opt, probe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 1832000 {
+		t.Errorf("got %d", got)
+	}
+
+	// Copied audio uses the source bitrate of each mapped stream.
+	opt = &ffmpegOptions{Audio: audioOptions{Codec: "copy"}, Streams: streamOptions{AllAudio: true}}
+	if got := audioBitrate(opt, probe); got != 288000 {
+		t.Errorf("got audio bitrate %d", got)
+	}
+
+	opt = &ffmpegOptions{Video: videoOptions{TargetSize: "1MB"}}
+	if _, err := targetBitrate(1000000, opt, probe); err == nil {
+		t.Error("expected error for a target size too small")
+	}
+}
+
+func TestPassArgs(t *testing.T) {
+	args := []string{"-i", "in.mp4", "-c:v", "libx264", "-b:v", "1500k", "-c:a", "aac", "-y", "out.mp4"}
+
+	pass1 := strings.Join(passArgs(args, "libx264", 1, "/tmp/log"), " ")
+	if pass1 != "-i in.mp4 -c:v libx264 -b:v 1500k -c:a aac -y -pass 1 -passlogfile /tmp/log -an -f null -" {
+		t.Errorf("unexpected pass 1: %s", pass1)
+	}
+	pass2 := passArgs(args, "libx264", 2, "/tmp/log")
+	setArg(pass2, "-b:v", "1200k")
+	if got := strings.Join(pass2, " "); got != "-i in.mp4 -c:v libx264 -b:v 1200k -c:a aac -y -pass 2 -passlogfile /tmp/log out.mp4" {
+		t.Errorf("unexpected pass 2: %s", got)
+	}
+	if args[5] != "1500k" {
+		t.Error("passArgs modified args")
+	}
+
+	args = []string{"-i", "in.mp4", "-c:v", "libx265", "-x265-params", "aq-mode=3", "-y", "out.mp4"}
+	if got := strings.Join(passArgs(args, "libx265", 2, "/tmp/log"), " "); got != "-i in.mp4 -c:v libx265 -x265-params aq-mode=3:pass=2:stats=/tmp/log.log -y out.mp4" {
+		t.Errorf("unexpected x265 pass 2: %s", got)
+	}
+}
@@ -0,0 +1,363 @@
+// Package protocol defines the ffmpegd websocket protocol.
+//
+// Every frame is an Envelope carrying a protocol version, a message type and
+// type-specific data. Frames sent by a client may set an ID, and the server
+// sets ReplyTo on any frame that answers it:
+//
+//	-> {"v":1,"type":"hello","id":"1"}
+//	<- {"v":1,"type":"hello","reply_to":"1","data":{"version":1,...}}
+//	-> {"v":1,"type":"encode","id":"2","data":{"input":"in.mp4","output":"out.mp4","payload":{...}}}
+//	<- {"v":1,"type":"accepted","reply_to":"2","data":{"job_id":"5f1c0e2a9b3d4c7e"}}
+//	<- {"v":1,"type":"progress","data":{"job_id":"5f1c0e2a9b3d4c7e","percent":42.5,...}}
+//	<- {"v":1,"type":"done","data":{"job_id":"5f1c0e2a9b3d4c7e"}}
+//
+// Frames without a version are treated as the original ffmpeg-commander
+// format and are answered in that format.
+package protocol
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// Version is the current protocol version.
+const Version = 1
+
+// Client message types.
+const (
+	TypeHello       = "hello"
+	TypeEncode      = "encode"
+	TypeCancel      = "cancel"
+	TypeSubscribe   = "subscribe"
+	TypeUnsubscribe = "unsubscribe"
+	TypeRerun       = "rerun"
+	TypeDryRun      = "dryrun"
+
+	// Image jobs take an Encode with image options as the payload.
+	TypePoster     = "poster"
+	TypeThumbnails = "thumbnails"
+	TypeSprite     = "sprite"
+	TypePreview    = "preview"
+
+	// Audio, concat and quality jobs take an Encode with their options as the
+	// payload. Quality jobs compare the output to the input.
+	TypeAudio   = "audio"
+	TypeConcat  = "concat"
+	TypeQuality = "quality"
+
+	// CRF search jobs take an Encode, find the highest CRF meeting a VMAF
+	// target on samples of the input and then encode it.
+	TypeCRFSearch = "crf_search"
+
+	// Preset messages are answered with TypePresets.
+	TypePresets      = "presets"
+	TypeSavePreset   = "save_preset"
+	TypeDeletePreset = "delete_preset"
+)
+
+// Server message types.
+const (
+	TypeAccepted  = "accepted"
+	TypeProgress  = "progress"
+	TypeLog       = "log"
+	TypeDone      = "done"
+	TypeError     = "error"
+	TypeCancelled = "cancelled"
+	TypeCommand   = "command"
+)
+
+// Envelope wraps every frame sent in either direction.
+type Envelope struct {
+	V       int             `json:"v"`
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	ReplyTo string          `json:"reply_to,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// New creates an envelope of the current version with data encoded.
+func New(typ string, data interface{}) (*Envelope, error) {
+	e := &Envelope{
+		V:    Version,
+		Type: typ,
+	}
+	if data == nil {
+		return e, nil
+	}
+
+	b, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	e.Data = b
+	return e, nil
+}
+
+// Reply creates an envelope answering the frame with the given ID.
+func Reply(id, typ string, data interface{}) (*Envelope, error) {
+	e, err := New(typ, data)
+	if err != nil {
+		return nil, err
+	}
+	e.ReplyTo = id
+	return e, nil
+}
+
+// Decode unmarshals the envelope data into v.
+func (e *Envelope) Decode(v interface{}) error {
+	if len(e.Data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(e.Data, v)
+}
+
+// Hello is sent by a client to open a session, and answered by the server
+// with its capabilities.
+type Hello struct {
+	Version      int           `json:"version"`
+	Server       string        `json:"server,omitempty"`
+	Types        []string      `json:"types,omitempty"`        // Message types the server accepts.
+	Capabilities *Capabilities `json:"capabilities,omitempty"` // What the server's ffmpeg is built with.
+}
+
+// Capabilities lists the codecs, filters, formats and protocols the server's
+// ffmpeg is built with.
+type Capabilities struct {
+	Encoders        []*Codec `json:"encoders"`
+	Decoders        []*Codec `json:"decoders"`
+	Filters         []string `json:"filters"`
+	Muxers          []string `json:"muxers"`
+	PixFmts         []string `json:"pix_fmts"`
+	InputProtocols  []string `json:"input_protocols"`
+	OutputProtocols []string `json:"output_protocols"`
+}
+
+// Codec is an encoder or decoder.
+type Codec struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"` // video, audio or subtitle.
+	Description string `json:"description"`
+	Hardware    bool   `json:"hardware,omitempty"` // Hardware accelerated, e.g. nvenc, qsv or vaapi.
+}
+
+// Encode submits an encode job.
+type Encode struct {
+	Input     string  `json:"input"`
+	Output    string  `json:"output"`              // May contain tokens such as {name} and {preset}.
+	Collision string  `json:"collision,omitempty"` // overwrite, skip, rename or fail if the output exists.
+	Preset    string  `json:"preset,omitempty"`    // Named preset the payload overrides.
+	Payload   Payload `json:"payload"`             // ffmpeg-commander options.
+}
+
+// Payload is an ffmpeg-commander options object. It may be sent as a JSON
+// object or as a string containing JSON.
+type Payload json.RawMessage
+
+// String returns the payload as a JSON string.
+func (p Payload) String() string {
+	return string(p)
+}
+
+// MarshalJSON encodes the payload as raw JSON.
+func (p Payload) MarshalJSON() ([]byte, error) {
+	if len(p) == 0 {
+		return []byte("null"), nil
+	}
+	return p, nil
+}
+
+// UnmarshalJSON accepts a JSON object, or a string containing one.
+func (p *Payload) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		s, err := strconv.Unquote(string(b))
+		if err != nil {
+			return err
+		}
+		b = []byte(s)
+	}
+	*p = append((*p)[:0], b...)
+	return nil
+}
+
+// Merge returns the payload with the fields of overrides merged onto it.
+// Objects are merged recursively, and any other value in overrides replaces
+// the payload's.
+func (p Payload) Merge(overrides Payload) (Payload, error) {
+	if len(overrides) == 0 || string(overrides) == "null" {
+		return p, nil
+	}
+	if len(p) == 0 || string(p) == "null" {
+		return overrides, nil
+	}
+
+	var base, over map[string]interface{}
+	if err := json.Unmarshal(p, &base); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(overrides, &over); err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(mergeObjects(base, over))
+	if err != nil {
+		return nil, err
+	}
+	return Payload(b), nil
+}
+
+func mergeObjects(base, over map[string]interface{}) map[string]interface{} {
+	for k, v := range over {
+		if o, ok := v.(map[string]interface{}); ok {
+			if b, ok := base[k].(map[string]interface{}); ok {
+				base[k] = mergeObjects(b, o)
+				continue
+			}
+		}
+		base[k] = v
+	}
+	return base
+}
+
+// Preset is a named payload jobs can reference with Encode.Preset.
+type Preset struct {
+	Name        string  `json:"name"`
+	Description string  `json:"description,omitempty"`
+	Builtin     bool    `json:"builtin"` // Built-in presets cannot be changed or deleted.
+	Payload     Payload `json:"payload"`
+}
+
+// Presets lists every preset. It is sent in reply to TypePresets, and to
+// TypeSavePreset or TypeDeletePreset after the change is made.
+type Presets struct {
+	Presets []*Preset `json:"presets"`
+}
+
+// DeletePreset deletes a user-defined preset.
+type DeletePreset struct {
+	Name string `json:"name"`
+}
+
+// Command is the ffmpeg command generated for an Encode by TypeDryRun,
+// without running ffmpeg.
+type Command struct {
+	Args     []string `json:"args"`
+	Command  string   `json:"command"` // Shell-quoted.
+	Warnings []string `json:"warnings"`
+}
+
+// Cancel stops a queued or running job.
+type Cancel struct {
+	JobID string `json:"job_id"`
+}
+
+// Rerun resubmits a job from history with the same input, output and payload.
+type Rerun struct {
+	JobID string `json:"job_id"`
+}
+
+// Subscribe starts (or with TypeUnsubscribe, stops) sending a job's frames to
+// the client. JobID "*" subscribes to all jobs.
+type Subscribe struct {
+	JobID string `json:"job_id"`
+}
+
+// Accepted is sent when a job is queued.
+type Accepted struct {
+	JobID string `json:"job_id"`
+}
+
+// Progress reports encoding progress for a job.
+type Progress struct {
+	JobID   string           `json:"job_id"`
+	Percent float64          `json:"percent"`
+	Frame   int              `json:"frame"`
+	Speed   string           `json:"speed"`
+	FPS     float64          `json:"fps"`
+	Outputs []OutputProgress `json:"outputs,omitempty"` // Set for multi-output jobs.
+	Probe   *CRFProbe        `json:"probe,omitempty"`   // Set by crf_search jobs for each CRF tried.
+}
+
+// CRFProbe is the result of encoding samples of the input at one CRF.
+type CRFProbe struct {
+	CRF     int     `json:"crf"`
+	VMAF    float64 `json:"vmaf"`    // Mean VMAF of the samples.
+	Bitrate int64   `json:"bitrate"` // Bits per second.
+	Size    int64   `json:"size"`    // Bytes, of all samples.
+}
+
+// CRFSearch is the CRF chosen by a crf_search job.
+type CRFSearch struct {
+	CRF    int        `json:"crf"`
+	Target float64    `json:"target"`
+	VMAF   float64    `json:"vmaf"`
+	Met    bool       `json:"met"` // False if no CRF met the target, and the lowest was used.
+	Probes []CRFProbe `json:"probes"`
+}
+
+// OutputProgress reports the bytes written so far to one output of a job.
+type OutputProgress struct {
+	Output string `json:"output"`
+	Size   int64  `json:"size"`
+}
+
+// Log is a line of ffmpeg output for a job.
+type Log struct {
+	JobID string `json:"job_id"`
+	Line  string `json:"line"`
+}
+
+// Done is sent when a job completes successfully.
+type Done struct {
+	JobID   string    `json:"job_id"`
+	Result  *Result   `json:"result,omitempty"`  // First output.
+	Results []*Result `json:"results,omitempty"` // Every output.
+}
+
+// Result describes the output of a completed job, as probed by ffprobe.
+type Result struct {
+	Output           string     `json:"output"`
+	Size             int64      `json:"size"`     // Bytes.
+	Duration         float64    `json:"duration"` // Seconds.
+	Bitrate          int64      `json:"bitrate"`  // Bits per second.
+	Codecs           []string   `json:"codecs"`
+	CompressionRatio float64    `json:"compression_ratio"`    // Input size / output size.
+	Files            []string   `json:"files,omitempty"`      // Playlists and segments of packaged outputs.
+	Quality          *Quality   `json:"quality,omitempty"`    // Set by quality jobs, or encodes with quality options.
+	CRFSearch        *CRFSearch `json:"crf_search,omitempty"` // Set by crf_search jobs.
+	Skipped          bool       `json:"skipped,omitempty"`    // The output existed and the collision policy is skip.
+}
+
+// Quality reports objective quality scores of an output against its input.
+type Quality struct {
+	VMAF     *Score         `json:"vmaf,omitempty"`
+	SSIM     *Score         `json:"ssim,omitempty"`
+	PSNR     *Score         `json:"psnr,omitempty"` // dB.
+	Frames   []FrameQuality `json:"frames,omitempty"`
+	Warnings []string       `json:"warnings,omitempty"` // Metrics that were skipped.
+}
+
+// Score aggregates the per-frame scores of a metric.
+type Score struct {
+	Mean float64 `json:"mean"`
+	Min  float64 `json:"min"`
+	Max  float64 `json:"max"`
+}
+
+// FrameQuality is the scores of a single frame.
+type FrameQuality struct {
+	Frame int     `json:"frame"`
+	VMAF  float64 `json:"vmaf,omitempty"`
+	SSIM  float64 `json:"ssim,omitempty"`
+	PSNR  float64 `json:"psnr,omitempty"`
+}
+
+// Error reports a failed job, or a request that could not be handled when
+// JobID is empty.
+type Error struct {
+	JobID   string `json:"job_id,omitempty"`
+	Message string `json:"message"`
+}
+
+// Cancelled is sent when a job is cancelled.
+type Cancelled struct {
+	JobID string `json:"job_id"`
+}
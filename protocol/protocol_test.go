@@ -0,0 +1,72 @@
+package protocol
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestEnvelopeRoundTrip(t *testing.T) {
+	env, err := Reply("1", TypeProgress, Progress{JobID: "abc", Percent: 42.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := json.Marshal(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got Envelope
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.V != Version || got.Type != TypeProgress || got.ReplyTo != "1" {
+		t.Errorf("unexpected envelope: %s", b)
+	}
+
+	var p Progress
+	if err := got.Decode(&p); err != nil {
+		t.Fatal(err)
+	}
+	if p.JobID != "abc" || p.Percent != 42.5 {
+		t.Errorf("unexpected progress: %+v", p)
+	}
+}
+
+func TestPayloadObjectOrString(t *testing.T) {
+	tests := []string{
+		`{"input":"in.mp4","payload":{"format":{"container":"mp4"}}}`,
+		`{"input":"in.mp4","payload":"{\"format\":{\"container\":\"mp4\"}}"}`,
+	}
+
+	for _, tt := range tests {
+		var e Encode
+		if err := json.Unmarshal([]byte(tt), &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Payload.String() != `{"format":{"container":"mp4"}}` {
+			t.Errorf("unexpected payload: %s", e.Payload)
+		}
+	}
+}
+
+func TestPayloadMerge(t *testing.T) {
+	preset := Payload(`{"format":{"container":"mp4"},"video":{"codec":"libx264","crf":23,"preset":"medium"},"outputs":[{"video":{"size":"1080"}}]}`)
+	overrides := Payload(`{"video":{"crf":20},"audio":{"codec":"aac"},"outputs":[]}`)
+
+	got, err := preset.Merge(overrides)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"audio":{"codec":"aac"},"format":{"container":"mp4"},"outputs":[],"video":{"codec":"libx264","crf":20,"preset":"medium"}}`
+	if got.String() != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	if got, _ := preset.Merge(nil); got.String() != preset.String() {
+		t.Errorf("unexpected payload without overrides: %s", got)
+	}
+	if _, err := preset.Merge(Payload(`[1]`)); err == nil {
+		t.Error("expected error merging a non-object")
+	}
+}